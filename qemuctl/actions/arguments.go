@@ -0,0 +1,69 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+)
+
+/*
+ * parseMachineArguments parses flagSet allowing the machine name to come
+ * either before or after the flags ("events vm0 --json" or "events --json vm0").
+ * Any positional arguments after the machine name are returned in extra.
+ */
+func parseMachineArguments(flagSet *flag.FlagSet, arguments []string) (machineName string, extra []string, err error) {
+	if len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		machineName = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return "", nil, err
+	}
+
+	extra = flagSet.Args()
+	if len(machineName) == 0 && len(extra) > 0 {
+		machineName = extra[0]
+		extra = extra[1:]
+	}
+
+	if len(machineName) == 0 {
+		return "", nil, fmt.Errorf("machine name is mandatory")
+	}
+
+	return machineName, extra, nil
+}
+
+/*
+ * parseInterspersedArguments parses flagSet letting flags come after
+ * positional arguments too ("attach vm0 disk data.img --persist"), where
+ * the flag package stops. Positional arguments are returned in order.
+ */
+func parseInterspersedArguments(flagSet *flag.FlagSet, arguments []string) (positional []string, err error) {
+	for {
+		err = flagSet.Parse(arguments)
+		if err != nil {
+			return nil, err
+		}
+
+		if flagSet.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, flagSet.Arg(0))
+		arguments = flagSet.Args()[1:]
+	}
+}
+
+/* stringList is a flag that may be given several times (--set a=1 --set b=2) */
+type stringList []string
+
+func (list *stringList) String() string {
+	return strings.Join(*list, ",")
+}
+
+func (list *stringList) Set(value string) error {
+	*list = append(*list, value)
+	return nil
+}
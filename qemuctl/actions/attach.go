@@ -0,0 +1,518 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// Kinds of devices attach and detach know about
+const (
+	DeviceKindDisk  string = "disk"
+	DeviceKindUSB   string = "usb"
+	DeviceKindCDRom string = "cdrom"
+	DeviceKindNIC   string = "nic"
+)
+
+/* Ids given to attached devices when --id is not, followed by a number */
+var deviceIDPrefixes = map[string]string{
+	DeviceKindDisk:  "disk",
+	DeviceKindUSB:   "stick",
+	DeviceKindCDRom: "cdrom",
+	DeviceKindNIC:   "net",
+}
+
+// AttachAction adds a disk, USB stick, cdrom drive or network interface to
+// a started machine. With --persist it goes into the configuration as well,
+// to be there on the next start; a stopped machine only gets that part.
+type AttachAction struct {
+	machine       *runtime.Machine
+	configData    *helpers.ConfigurationData
+	kind          string
+	deviceID      string
+	format        string
+	diskInterface string
+	readOnly      bool
+	model         string
+	macAddress    string
+	backend       string
+	bridge        string
+	ifName        string
+	networkName   string
+	persist       bool
+}
+
+// DetachAction removes a device from a started machine, once the guest has
+// let go of it, and from the configuration with --persist.
+type DetachAction struct {
+	timeout time.Duration
+	persist bool
+}
+
+func (action *AttachAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl attach <machine> disk <file> [--id ID] [--format raw|qcow2] [--interface virtio-blk|virtio-scsi|nvme|usb] [--read-only] [--persist]")
+	fmt.Println("    qemuctl attach <machine> usb <file> [--id ID] [--format raw|qcow2] [--read-only] [--persist]")
+	fmt.Println("    qemuctl attach <machine> cdrom [<iso>] [--id ID] [--persist]")
+	fmt.Println("    qemuctl attach <machine> nic [--id ID] [--model MODEL] [--mac MAC] [--backend user|bridge|tap] [--bridge BRIDGE] [--ifname TAP] [--persist]")
+	fmt.Println("    qemuctl attach <machine> nic --network NAME [--model MODEL] [--persist]")
+}
+
+func (action *AttachAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl attach", flag.ContinueOnError)
+
+	flagSet.StringVar(&action.deviceID, "id", "", "device id (a free one by default)")
+	flagSet.StringVar(&action.format, "format", "", "image format (guessed from the file name by default)")
+	flagSet.StringVar(&action.diskInterface, "interface", "", "disk interface (virtio-blk by default, virtio-scsi for cdroms)")
+	flagSet.BoolVar(&action.readOnly, "read-only", false, "attach the image read-only")
+	flagSet.StringVar(&action.model, "model", "", "network device model")
+	flagSet.StringVar(&action.macAddress, "mac", "", "MAC address (a random one by default)")
+	flagSet.StringVar(&action.backend, "backend", "", "network backend: user, bridge or tap")
+	flagSet.StringVar(&action.bridge, "bridge", "", "host bridge (bridge backend)")
+	flagSet.StringVar(&action.ifName, "ifname", "", "host tap interface (tap backend)")
+	flagSet.StringVar(&action.networkName, "network", "", "join a network made with 'qemuctl network create'")
+	flagSet.BoolVar(&action.persist, "persist", false, "add the device to the machine configuration too")
+
+	positional, err := parseInterspersedArguments(flagSet, arguments)
+	if err != nil {
+		action.usage()
+		return err
+	}
+
+	if len(positional) < 2 {
+		action.usage()
+		return fmt.Errorf("machine name and device kind are mandatory")
+	}
+	action.kind = positional[1]
+
+	action.machine, action.configData, err = loadHotplugMachine(positional[0], action.persist)
+	if err != nil {
+		return err
+	}
+
+	switch action.kind {
+	case DeviceKindDisk, DeviceKindUSB, DeviceKindCDRom:
+		err = action.attachDisk(positional[2:])
+	case DeviceKindNIC:
+		err = action.attachNIC()
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown device kind '%s'", action.kind)
+		}
+	}
+
+	return err
+}
+
+func (action *AttachAction) attachDisk(files []string) (err error) {
+	var configBytes []byte
+	var disk helpers.Disk = helpers.Disk{
+		Format:    action.format,
+		Interface: action.diskInterface,
+		ReadOnly:  action.readOnly,
+	}
+
+	switch action.kind {
+	case DeviceKindUSB:
+		disk.Interface = helpers.DiskInterfaceUSB
+	case DeviceKindCDRom:
+		{
+			/* IDE has no hot-plug: cdroms go on virtio-scsi */
+			disk.Media = helpers.DiskMediaCDRom
+			if len(disk.Interface) == 0 {
+				disk.Interface = helpers.DiskInterfaceVirtioSCSI
+			}
+		}
+	}
+
+	if len(files) > 0 {
+		err = setDiskSource(&disk, files[0])
+		if err != nil {
+			return err
+		}
+	} else if action.kind != DeviceKindCDRom {
+		action.usage()
+		return fmt.Errorf("image file is mandatory")
+	}
+
+	disk.ID, err = action.getDeviceID()
+	if err != nil {
+		return err
+	}
+
+	if action.persist {
+		configBytes, err = updateMachineConfig(action.machine, "disks", append(action.configData.Disks, disk))
+		if err != nil {
+			return err
+		}
+	}
+
+	return applyDeviceChange(action.machine,
+		fmt.Sprintf("attaching %s '%s' to machine '%s'", action.kind, disk.ID, action.machine.Name),
+		func(hotplug *qemuctl_qemu.Hotplug) error {
+			return hotplug.AttachDisk(&disk)
+		}, action.configData, configBytes)
+}
+
+func (action *AttachAction) attachNIC() (err error) {
+	var configBytes []byte
+	var configKey string = "net"
+	var configValue interface{}
+	var nic helpers.NetworkInterface
+
+	if len(action.networkName) > 0 {
+		attachment := helpers.NetworkAttachment{Name: action.networkName, Model: action.model}
+
+		nic, err = attachment.GetInterface(action.configData.Machine.MachineName)
+		if err != nil {
+			return err
+		}
+
+		configKey, configValue = "networks", append(action.configData.Networks, attachment)
+	} else {
+		nic = helpers.NetworkInterface{
+			Model:      action.model,
+			MacAddress: action.macAddress,
+			Backend:    action.backend,
+			Bridge:     helpers.BridgeNetwork{Interface: action.bridge},
+			Tap:        helpers.TapNetwork{IfName: action.ifName},
+		}
+
+		/* --bridge and --ifname tell the backend well enough */
+		if len(nic.Backend) == 0 && len(action.bridge) > 0 {
+			nic.Backend = helpers.NetworkBackendBridge
+		} else if len(nic.Backend) == 0 && len(action.ifName) > 0 {
+			nic.Backend = helpers.NetworkBackendTap
+		}
+
+		/* Keep the MAC the guest sees if the interface is persisted */
+		if len(nic.MacAddress) == 0 {
+			nic.MacAddress, err = helpers.RandomMacAddress()
+			if err != nil {
+				return err
+			}
+		}
+
+		nic.ID, err = action.getDeviceID()
+		if err != nil {
+			return err
+		}
+
+		configValue = append(action.configData.Net, nic)
+	}
+
+	if nic.GetBackend() == helpers.NetworkBackendBridge && len(nic.Bridge.Interface) == 0 {
+		return fmt.Errorf("the bridge backend needs --bridge")
+	}
+
+	updatedConfig := *action.configData
+	updatedConfig.Net = append(append(helpers.NetworkList{}, action.configData.Net...), nic)
+	err = helpers.CheckMacAddresses(&updatedConfig, action.machine.Name)
+	if err != nil {
+		return err
+	}
+
+	if action.persist {
+		configBytes, err = updateMachineConfig(action.machine, configKey, configValue)
+		if err != nil {
+			return err
+		}
+	}
+
+	return applyDeviceChange(action.machine,
+		fmt.Sprintf("attaching nic '%s' to machine '%s'", nic.ID, action.machine.Name),
+		func(hotplug *qemuctl_qemu.Hotplug) error {
+			return hotplug.AttachNIC(&nic)
+		}, action.configData, configBytes)
+}
+
+/*
+ * getDeviceID returns --id, or the first "<prefix><n>" that neither the
+ * configuration nor the running machine uses.
+ */
+func (action *AttachAction) getDeviceID() (deviceID string, err error) {
+	var usedIDs map[string]bool = make(map[string]bool)
+
+	if len(action.deviceID) > 0 {
+		return action.deviceID, nil
+	}
+
+	for index := range action.configData.Disks {
+		usedIDs[action.configData.Disks[index].GetID(index)] = true
+	}
+	for index := range action.configData.Net {
+		usedIDs[action.configData.Net[index].GetID(index)] = true
+	}
+
+	/* Devices attached without --persist are only known to QEMU */
+	if action.machine.IsStarted() {
+		deviceIDs, err := qemuctl_qemu.NewHotplug(action.machine, action.configData).ListDeviceIDs()
+		if err != nil {
+			return "", err
+		}
+
+		for _, id := range deviceIDs {
+			usedIDs[strings.TrimSuffix(id, qemuctl_qemu.GetDeviceID(""))] = true
+		}
+	}
+
+	for index := 0; ; index++ {
+		deviceID = fmt.Sprintf("%s%d", deviceIDPrefixes[action.kind], index)
+		if !usedIDs[deviceID] {
+			return deviceID, nil
+		}
+	}
+}
+
+func (action *DetachAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl detach <machine> disk|usb|cdrom|nic <id> [--timeout DURATION] [--persist]")
+}
+
+func (action *DetachAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl detach", flag.ContinueOnError)
+	var configBytes []byte
+	var configKey string
+	var configValue interface{}
+	var found bool
+	var operation func(hotplug *qemuctl_qemu.Hotplug) error
+
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QemuDeviceReleaseTimeout, "how long the guest has to release the device")
+	flagSet.BoolVar(&action.persist, "persist", false, "remove the device from the machine configuration too")
+
+	positional, err := parseInterspersedArguments(flagSet, arguments)
+	if err != nil {
+		action.usage()
+		return err
+	}
+
+	if len(positional) < 3 {
+		action.usage()
+		return fmt.Errorf("machine name, device kind and device id are mandatory")
+	}
+	kind, deviceID := positional[1], positional[2]
+
+	machine, configData, err := loadHotplugMachine(positional[0], action.persist)
+	if err != nil {
+		return err
+	}
+
+	/* PCI devices only go once the guest has released them */
+	if machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is paused, resume it so that the guest can release the device", machine.Name)
+	}
+
+	switch kind {
+	case DeviceKindDisk, DeviceKindUSB, DeviceKindCDRom:
+		{
+			var disks helpers.DiskList
+
+			for _, disk := range namedDisks(configData.Disks) {
+				if disk.ID == deviceID {
+					found = true
+					continue
+				}
+				disks = append(disks, disk)
+			}
+
+			configKey, configValue = "disks", disks
+			operation = func(hotplug *qemuctl_qemu.Hotplug) error {
+				return hotplug.DetachDisk(deviceID)
+			}
+		}
+	case DeviceKindNIC:
+		{
+			var nics helpers.NetworkList
+			var attachments []helpers.NetworkAttachment
+
+			for _, nic := range namedInterfaces(configData.Net) {
+				if nic.ID == deviceID {
+					found = true
+					continue
+				}
+				nics = append(nics, nic)
+			}
+			configKey, configValue = "net", nics
+
+			/* Interfaces on networks are named after them */
+			for _, attachment := range configData.Networks {
+				if attachment.GetID() == deviceID {
+					found = true
+					configKey = "networks"
+					continue
+				}
+				attachments = append(attachments, attachment)
+			}
+			if configKey == "networks" {
+				configValue = attachments
+			}
+
+			operation = func(hotplug *qemuctl_qemu.Hotplug) error {
+				return hotplug.DetachNIC(deviceID)
+			}
+		}
+	default:
+		{
+			action.usage()
+			return fmt.Errorf("unknown device kind '%s'", kind)
+		}
+	}
+
+	if action.persist && !found && !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' has no %s '%s' in its configuration", machine.Name, kind, deviceID)
+	}
+
+	if action.persist && found {
+		configBytes, err = updateMachineConfig(machine, configKey, configValue)
+		if err != nil {
+			return err
+		}
+	} else if action.persist {
+		log.Printf("[detach] '%s' is not in the configuration of '%s', nothing to save", deviceID, machine.Name)
+	}
+
+	return applyDeviceChange(machine,
+		fmt.Sprintf("detaching %s '%s' from machine '%s'", kind, deviceID, machine.Name),
+		func(hotplug *qemuctl_qemu.Hotplug) error {
+			hotplug.Timeout = action.timeout
+			return operation(hotplug)
+		}, configData, configBytes)
+}
+
+/*
+ * loadHotplugMachine returns the machine devices are changed on, and its
+ * configuration. Without persist, only a started machine has anything to
+ * change.
+ */
+func loadHotplugMachine(machineName string, persist bool) (machine *runtime.Machine, configData *helpers.ConfigurationData, err error) {
+	machine = runtime.NewMachine(machineName)
+	if machine == nil || !machine.Exists() {
+		return nil, nil, fmt.Errorf("machine '%s' does not exist", machineName)
+	}
+
+	/* The saved state only fits the hardware it was saved from */
+	if machine.IsSuspended() {
+		return nil, nil, fmt.Errorf("cannot change the devices of a suspended machine ('%s' must be started first)", machineName)
+	}
+
+	if !machine.IsStarted() && !persist {
+		return nil, nil, fmt.Errorf("machine '%s' is not started (--persist changes its configuration only)", machineName)
+	}
+
+	configData, err = helpers.NewConfigHandler(machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return machine, configData, nil
+}
+
+/* setDiskSource makes path the file or the host device of disk */
+func setDiskSource(disk *helpers.Disk, path string) (err error) {
+	/* QEMU does not run from here */
+	path, err = filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	fileInfo, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	disk.File, disk.Device = "", ""
+	if fileInfo.Mode()&os.ModeDevice != 0 {
+		disk.Device = path
+	} else {
+		disk.File = path
+	}
+
+	return nil
+}
+
+/*
+ * namedDisks returns disks with their ids spelled out: removing one must not
+ * rename those after it, their nodes and provisioned images go by id.
+ */
+func namedDisks(disks helpers.DiskList) (named helpers.DiskList) {
+	for index, disk := range disks {
+		disk.ID = disk.GetID(index)
+		named = append(named, disk)
+	}
+
+	return named
+}
+
+/* namedInterfaces is namedDisks for network interfaces */
+func namedInterfaces(nics helpers.NetworkList) (named helpers.NetworkList) {
+	for index, nic := range nics {
+		nic.ID = nic.GetID(index)
+		named = append(named, nic)
+	}
+
+	return named
+}
+
+/*
+ * updateMachineConfig returns the configuration of machine with key set to
+ * value. Nothing is written: a failed hot-plug must leave the file alone.
+ */
+func updateMachineConfig(machine *runtime.Machine, key string, value interface{}) (configBytes []byte, err error) {
+	configBytes, err = os.ReadFile(machine.ConfigFile)
+	if err != nil {
+		return nil, err
+	}
+
+	configBytes, err = helpers.SetConfigValue(configBytes, key, value)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = helpers.ValidateConfigData(configBytes)
+	if err != nil {
+		return nil, fmt.Errorf("the configuration would not be valid: %s", err.Error())
+	}
+
+	return configBytes, nil
+}
+
+/* applyDeviceChange runs operation on a started machine, then saves configBytes if any */
+func applyDeviceChange(machine *runtime.Machine, description string, operation func(*qemuctl_qemu.Hotplug) error,
+	configData *helpers.ConfigurationData, configBytes []byte) (err error) {
+
+	if machine.IsStarted() {
+		fmt.Printf("[qemuctl] %s... ", description)
+
+		err = operation(qemuctl_qemu.NewHotplug(machine, configData))
+		if err != nil {
+			fmt.Println("\033[31merror!\033[0m")
+			return err
+		}
+
+		fmt.Println("\033[32mok!\033[0m")
+	}
+
+	if configBytes == nil {
+		return nil
+	}
+
+	fmt.Printf("[qemuctl] saving the configuration of '%s'... ", machine.Name)
+
+	err = machine.WriteConfigFile(configBytes)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
@@ -0,0 +1,187 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type CloneAction struct {
+	sourceName string
+	targetName string
+	fullCopy   bool
+}
+
+func (action *CloneAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl clone", flag.ExitOnError)
+	var names []string
+
+	flagSet.BoolVar(&action.fullCopy, "full", false, "copy the disks instead of creating overlays on them")
+
+	/* Both names may come before or after the flags */
+	for len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		names = append(names, arguments[0])
+		arguments = arguments[1:]
+	}
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+	names = append(names, flagSet.Args()...)
+
+	if len(names) != 2 {
+		return fmt.Errorf("usage: qemuctl clone <source> <target> [--full]")
+	}
+	action.sourceName = names[0]
+	action.targetName = names[1]
+
+	fmt.Printf("[clone] cloning machine '%s' to '%s'... ", action.sourceName, action.targetName)
+
+	err = action.handleClone()
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *CloneAction) handleClone() (err error) {
+	var source *runtime.Machine
+	var target *runtime.Machine
+	var configData *helpers.ConfigurationData
+	var configBytes []byte
+
+	if !helpers.IsValidName(action.targetName) {
+		return fmt.Errorf("invalid machine name '%s'", action.targetName)
+	}
+
+	source = runtime.NewMachine(action.sourceName)
+	if source == nil || !source.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.sourceName)
+	}
+
+	/* Overlays on a disk that is still being written to would be corrupted */
+	if source.IsStarted() {
+		return fmt.Errorf("machine '%s' is started, stop it before cloning", action.sourceName)
+	}
+
+	target = runtime.NewMachine(action.targetName)
+	if target.Exists() {
+		return fmt.Errorf("machine '%s' exists", action.targetName)
+	}
+
+	configBytes, err = os.ReadFile(source.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	configData, err = helpers.ParseConfigData(configBytes)
+	if err != nil {
+		return err
+	}
+
+	configBytes, err = action.updateConfig(configBytes, configData)
+	if err != nil {
+		return err
+	}
+
+	target.CreateRuntime()
+
+	disks, err := qemuctl_qemu.CloneDiskImages(configData, source, target, action.fullCopy)
+	if err == nil && len(disks) > 0 {
+		configBytes, err = helpers.SetConfigValue(configBytes, "disks", disks)
+	}
+
+	if err == nil {
+		err = target.WriteConfigFile(configBytes)
+	}
+
+	if err != nil {
+		log.Printf("[clone] cleaning up '%s'", target.RuntimeDirectory)
+		target.Destroy()
+		return err
+	}
+
+	/* Fresh machine data: the clone has never run */
+	target.QemuPid = 0
+	target.SSHLocalPort = 0
+	target.Supervised = false
+	return target.UpdateStatus(runtime.MachineStatusStopped)
+}
+
+/* updateConfig gives the clone its name, its own host ports and MAC addresses; "auto" ports stay so */
+func (action *CloneAction) updateConfig(configBytes []byte, configData *helpers.ConfigurationData) (updatedBytes []byte, err error) {
+	var usedPorts map[int]bool = helpers.GetUsedHostPorts("")
+
+	configBytes, err = helpers.SetConfigValue(configBytes, "machine.name", action.targetName)
+	if err != nil {
+		return nil, err
+	}
+
+	if configData.SSH.LocalPort > 0 {
+		port, err := helpers.FindFreePort(helpers.ForwardProtocolTCP, configData.SSH.HostAddress, int(configData.SSH.LocalPort)+1, usedPorts)
+		if err != nil {
+			return nil, err
+		}
+		usedPorts[port] = true
+
+		log.Printf("[clone] ssh port %d -> %d", configData.SSH.LocalPort, port)
+		configBytes, err = helpers.SetConfigValue(configBytes, "ssh.localPort", port)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var netChanged bool = false
+
+	for _, forward := range configData.Net.GetPortForwards() {
+		if forward.HostPort.IsAuto() {
+			continue
+		}
+
+		port, err := helpers.FindFreePort(forward.GetProtocol(), forward.HostAddress, int(forward.HostPort)+1, usedPorts)
+		if err != nil {
+			return nil, err
+		}
+		usedPorts[port] = true
+
+		log.Printf("[clone] forwarded port %d -> %d", forward.HostPort, port)
+		forward.HostPort = helpers.HostPort(port)
+		netChanged = true
+	}
+
+	for index := range configData.Net {
+		nic := &configData.Net[index]
+		if len(nic.MacAddress) == 0 {
+			continue
+		}
+
+		mac, err := helpers.RandomMacAddress()
+		if err != nil {
+			return nil, err
+		}
+
+		log.Printf("[clone] interface '%s' mac %s -> %s", nic.GetID(index), nic.MacAddress, mac)
+		nic.MacAddress = mac
+		netChanged = true
+	}
+
+	/* Interfaces are written back as a list, older single NIC layouts included */
+	if netChanged {
+		configBytes, err = helpers.SetConfigValue(configBytes, "net", configData.Net)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return configBytes, nil
+}
@@ -0,0 +1,117 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	/* Ctrl-], as in telnet and virsh console */
+	ConsoleEscapeCharacter byte   = 0x1d
+	ConsoleEscapeName      string = "^]"
+)
+
+type ConsoleAction struct {
+	machineName string
+}
+
+func (action *ConsoleAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl console", flag.ExitOnError)
+
+	action.machineName, _, err = parseMachineArguments(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+
+	return action.handleConsole()
+}
+
+func (action *ConsoleAction) handleConsole() (err error) {
+	var machine *runtime.Machine
+	var socket net.Conn
+
+	machine = runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", action.machineName)
+	}
+
+	socketPath := qemuctl_qemu.NewQemuMonitor(machine).GetSerialSocketPath()
+
+	log.Printf("[console] connecting to '%s'", socketPath)
+	socket, err = net.Dial("unix", socketPath)
+	if err != nil {
+		return fmt.Errorf("could not attach to console of '%s': %s", action.machineName, err.Error())
+	}
+	defer socket.Close()
+
+	fmt.Printf("[qemuctl] connected to '%s' (escape character is %s)\r\n", action.machineName, ConsoleEscapeName)
+
+	savedState, err := makeRaw(os.Stdin.Fd())
+	if err != nil {
+		log.Printf("[console] could not set terminal in raw mode: %s", err.Error())
+	} else {
+		defer restoreTerminal(os.Stdin.Fd(), savedState)
+	}
+
+	/* Machine output goes straight to the terminal */
+	outputDone := make(chan error, 1)
+	go func() {
+		_, copyErr := io.Copy(os.Stdout, socket)
+		outputDone <- copyErr
+	}()
+
+	inputDone := make(chan error, 1)
+	go func() {
+		inputDone <- action.forwardInput(socket)
+	}()
+
+	select {
+	case err = <-inputDone:
+		log.Printf("[console] detached from '%s'", action.machineName)
+	case err = <-outputDone:
+		log.Printf("[console] console of '%s' closed", action.machineName)
+	}
+
+	fmt.Printf("\r\n[qemuctl] disconnected from '%s'\r\n", action.machineName)
+
+	return err
+}
+
+/* forwardInput copies stdin to the socket until the escape character */
+func (action *ConsoleAction) forwardInput(socket net.Conn) (err error) {
+	var buffer []byte = make([]byte, 256)
+
+	for {
+		nBytes, readErr := os.Stdin.Read(buffer)
+
+		for index := 0; index < nBytes; index++ {
+			if buffer[index] == ConsoleEscapeCharacter {
+				_, err = socket.Write(buffer[:index])
+				return err
+			}
+		}
+
+		if nBytes > 0 {
+			if _, err = socket.Write(buffer[:nBytes]); err != nil {
+				return err
+			}
+		}
+
+		if readErr == io.EOF {
+			return nil
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+}
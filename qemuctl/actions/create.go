@@ -4,23 +4,29 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"strconv"
+	"os"
 
 	helpers "luizpuglisi.com/qemuctl/helpers"
-	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
 
 type CreateAction struct {
-	machineName string
-	qemuBinary  string
-	configFile  string
+	machineName  string
+	qemuBinary   string
+	configFile   string
+	templateName string
+	overrides    stringList
+	dryRun       bool
 }
 
 func (action *CreateAction) Run(arguments []string) (err error) {
-	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl start", flag.ExitOnError)
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl create", flag.ExitOnError)
 
 	flagSet.StringVar(&action.configFile, "config", "", "YAML configuration file")
+	flagSet.StringVar(&action.templateName, "from-template", "", "create the machine from TEMPLATE, without a config file")
+	flagSet.StringVar(&action.machineName, "name", "", "machine name (same as --set machine.name=NAME)")
+	flagSet.Var(&action.overrides, "set", "override a config value, as KEY=VALUE (repeatable)")
+	flagSet.BoolVar(&action.dryRun, "dry-run", false, "print the QEMU command line instead of creating the machine")
 
 	err = flagSet.Parse(arguments)
 	if err != nil {
@@ -28,9 +34,9 @@ func (action *CreateAction) Run(arguments []string) (err error) {
 	}
 
 	/* Do flags validation */
-	if len(action.configFile) == 0 {
+	if (len(action.configFile) == 0) == (len(action.templateName) == 0) {
 		flagSet.Usage()
-		return fmt.Errorf("--config is mandatory")
+		return fmt.Errorf("one of --config or --from-template is mandatory")
 	}
 
 	/* Do proper handling */
@@ -42,26 +48,85 @@ func (action *CreateAction) Run(arguments []string) (err error) {
 	return nil
 }
 
+/*
+ * getConfigBytes returns the config the machine is created from: the config
+ * file, or a document extending the template, with --name and --set applied.
+ */
+func (action *CreateAction) getConfigBytes() (configBytes []byte, err error) {
+	var overrides []string
+
+	if len(action.configFile) > 0 {
+		log.Printf("[create] using config file: %s", action.configFile)
+
+		configBytes, err = os.ReadFile(action.configFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not open file '%s': %s", action.configFile, err.Error())
+		}
+	} else {
+		log.Printf("[create] using template: %s", action.templateName)
+
+		if !helpers.IsValidName(action.templateName) {
+			return nil, fmt.Errorf("invalid template name '%s'", action.templateName)
+		}
+
+		if !runtime.TemplateExists(action.templateName) {
+			return nil, fmt.Errorf("template '%s' does not exist", action.templateName)
+		}
+		configBytes = []byte(fmt.Sprintf("%s: %s\n", helpers.ConfigExtendsKey, action.templateName))
+	}
+
+	if len(action.machineName) > 0 {
+		overrides = append(overrides, fmt.Sprintf("machine.name=%s", action.machineName))
+	}
+	overrides = append(overrides, action.overrides...)
+
+	/* Keep the file as is (and its line numbers in errors) when there is nothing to change */
+	if len(overrides) == 0 {
+		return configBytes, nil
+	}
+
+	return helpers.SetConfigValues(configBytes, overrides)
+}
+
 func (action *CreateAction) handleCreate() (err error) {
 	var configData *helpers.ConfigurationData = nil
-	var qemu *qemuctl_qemu.QemuCommand
+	var configBytes []byte
 	var machine *runtime.Machine
+	var source string = action.configFile
 
 	err = nil
 
-	log.Printf("[create] using config file: %s", action.configFile)
+	if len(source) == 0 {
+		source = fmt.Sprintf("template '%s'", action.templateName)
+	}
 
-	configHandle := helpers.NewConfigHandler(action.configFile)
-	configData, err = configHandle.ParseConfigFile()
+	configBytes, err = action.getConfigBytes()
+	if err != nil {
+		return err
+	}
+
+	configData, err = helpers.ValidateConfigData(configBytes)
 	if err != nil {
 		return err
 	}
 
 	action.machineName = configData.Machine.MachineName
 	machine = runtime.NewMachine(action.machineName)
+	if machine == nil {
+		return fmt.Errorf("could not read the data of machine '%s'", action.machineName)
+	}
+
+	err = helpers.CheckMacAddresses(configData, action.machineName)
+	if err != nil {
+		return err
+	}
+
+	if action.dryRun {
+		return printQemuCommand(machine, configData, false)
+	}
 
 	fmt.Printf("[qemuctl] Creating machine '%s' (%s).... ",
-		action.machineName, action.configFile)
+		action.machineName, source)
 
 	/* Check machine status */
 	if machine.Exists() {
@@ -71,52 +136,31 @@ func (action *CreateAction) handleCreate() (err error) {
 		machine.CreateRuntime()
 	}
 
-	/* First, we update the config file for the machine and use it to create it */
-	log.Printf("[create] updating '%s' config file", action.machineName)
-	err = machine.UpdateConfigFile(action.configFile)
+	/* The machine gets the resolved config: later template changes do not affect it */
+	configBytes, err = helpers.ResolveConfigData(configBytes)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[create] writing '%s' config file", action.machineName)
+	err = machine.WriteConfigFile(configBytes)
 	if err != nil {
 		return err
 	}
 
 	log.Printf("[create] using machine config file: '%s'", machine.ConfigFile)
-	configHandle = helpers.NewConfigHandler(machine.ConfigFile)
+	configHandle := helpers.NewConfigHandler(machine.ConfigFile)
 	configData, err = configHandle.ParseConfigFile()
 	if err != nil {
 		return err
 	}
 
-	/* Get QemuCommand instance */
-	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
-	qemu = qemuctl_qemu.NewQemuCommand(configData, qemuMonitor)
-
-	log.Printf("[create] launching qemu")
-	err = qemu.Launch()
+	err = launchMachine(machine, configData)
 	if err != nil {
-		machine.QemuPid = 0
-		machine.SSHLocalPort = 0
-		machine.UpdateStatus(runtime.MachineStatusDegraded)
+		fmt.Println("\033[31merror!\033[0m")
 		return err
-	} else {
-		procPid := 0
-		pidData, err := qemuMonitor.GetPidFileData()
-		if err != nil {
-			log.Printf("[create] could not get process pid: %s", err.Error())
-		} else {
-			procPid, err = strconv.Atoi(pidData)
-			if err != nil {
-				log.Printf("[start] could not convert pid string to int %s", err.Error())
-			} else {
-				log.Printf("[start] got machine pid: %d", procPid)
-			}
-		}
-
-		log.Printf("[create] new machine: QemuPid is %d, SSHLocalPort is %d", procPid, configData.SSH.LocalPort)
-		machine.QemuPid = procPid
-		machine.SSHLocalPort = configData.SSH.LocalPort
-		machine.UpdateStatus(runtime.MachineStatusStarted)
-
-		fmt.Println("\033[32mok!\033[0m")
 	}
 
+	fmt.Println("\033[32mok!\033[0m")
 	return nil
 }
@@ -0,0 +1,32 @@
+package qemuctl_actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	api "luizpuglisi.com/qemuctl/api"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+	supervisor "luizpuglisi.com/qemuctl/supervisor"
+)
+
+type DaemonAction struct {
+}
+
+func (action *DaemonAction) Run(arguments []string) (err error) {
+	var server *api.Server = api.NewServer(supervisor.NewSupervisor())
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		log.Printf("[daemon] got %s, shutting down (machines keep running)", received.String())
+		server.Close()
+	}()
+
+	fmt.Printf("[qemuctl] daemon listening on '%s'\n", runtime.GetControlSocketPath())
+
+	return server.Serve()
+}
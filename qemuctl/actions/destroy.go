@@ -3,6 +3,7 @@ package qemuctl_actions
 import (
 	"fmt"
 
+	helpers "luizpuglisi.com/qemuctl/helpers"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
 
@@ -30,11 +31,20 @@ func (action *DestroyAction) Run(arguments []string) (err error) {
 	if machine.IsStarted() {
 		fmt.Printf("[qemuctl] \033[33mwarning\033[0m: machine '%s' is started, cannot destroy!\n", action.machineName)
 		return nil
-	} else {
-		fmt.Printf("[qemuctl] destroying machine '%s'... ", action.machineName)
-		machine.Destroy()
-		fmt.Println("\033[32mok!\033[0m")
 	}
 
+	/* Clones made without --full would lose their backing files */
+	user, err := helpers.FindDiskUser(machine)
+	if err != nil {
+		return err
+	}
+	if len(user) > 0 {
+		return fmt.Errorf("cannot destroy machine '%s': machine '%s' uses its disks as backing files", action.machineName, user)
+	}
+
+	fmt.Printf("[qemuctl] destroying machine '%s'... ", action.machineName)
+	machine.Destroy()
+	fmt.Println("\033[32mok!\033[0m")
+
 	return nil
 }
@@ -0,0 +1,171 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type DiskAction struct {
+	machineName  string
+	diskID       string
+	outputFormat string
+	machine      *runtime.Machine
+	imagePath    string
+}
+
+func (action *DiskAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl disk info <machine> [--disk id]")
+	fmt.Println("    qemuctl disk resize <machine> <size> [--disk id]")
+	fmt.Println("    qemuctl disk convert <machine> <output-file> [--disk id] [--format qcow2|raw|...]")
+}
+
+func (action *DiskAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl disk", flag.ExitOnError)
+	var subCommand string
+	var extra []string
+
+	if len(arguments) < 1 {
+		action.usage()
+		return fmt.Errorf("disk command is mandatory")
+	}
+	subCommand = arguments[0]
+
+	flagSet.StringVar(&action.diskID, "disk", "", "disk id (defaults to the first disk)")
+	flagSet.StringVar(&action.outputFormat, "format", qemuctl_qemu.QemuImgDefaultFormat, "output image format (convert)")
+
+	action.machineName, extra, err = parseMachineArguments(flagSet, arguments[1:])
+	if err != nil {
+		action.usage()
+		return err
+	}
+
+	err = action.loadMachine()
+	if err != nil {
+		return err
+	}
+
+	switch subCommand {
+	case "info":
+		err = action.handleInfo()
+	case "resize":
+		{
+			if len(extra) < 1 {
+				action.usage()
+				return fmt.Errorf("new size is mandatory")
+			}
+			err = action.handleResize(extra[0])
+		}
+	case "convert":
+		{
+			if len(extra) < 1 {
+				action.usage()
+				return fmt.Errorf("output file is mandatory")
+			}
+			err = action.handleConvert(extra[0])
+		}
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown disk command '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+func (action *DiskAction) loadMachine() (err error) {
+	var configData *helpers.ConfigurationData
+
+	action.machine = runtime.NewMachine(action.machineName)
+	if !action.machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	configData, err = helpers.NewConfigHandler(action.machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return err
+	}
+
+	for index := range configData.Disks {
+		disk := &configData.Disks[index]
+
+		if len(action.diskID) == 0 && disk.IsCDRom() {
+			continue
+		}
+
+		if len(action.diskID) == 0 || disk.GetID(index) == action.diskID {
+			action.imagePath = qemuctl_qemu.GetDiskImagePath(disk, index, action.machine)
+			return nil
+		}
+	}
+
+	if len(action.diskID) > 0 {
+		return fmt.Errorf("machine '%s' has no disk '%s'", action.machineName, action.diskID)
+	}
+
+	return fmt.Errorf("machine '%s' has no disk image", action.machineName)
+}
+
+func (action *DiskAction) handleInfo() (err error) {
+	var info *qemuctl_qemu.QemuImgInfo
+
+	info, err = qemuctl_qemu.NewQemuImg().Info(action.imagePath)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-16s %s\n", "image:", info.Filename)
+	fmt.Printf("%-16s %s\n", "format:", info.Format)
+	fmt.Printf("%-16s %d bytes\n", "virtual size:", info.VirtualSize)
+	fmt.Printf("%-16s %d bytes\n", "disk size:", info.ActualSize)
+	if len(info.BackingFilename) > 0 {
+		fmt.Printf("%-16s %s\n", "backing file:", info.BackingFilename)
+	}
+	fmt.Printf("%-16s %d\n", "snapshots:", len(info.Snapshots))
+
+	fmt.Println("")
+	return nil
+}
+
+func (action *DiskAction) handleResize(size string) (err error) {
+	if action.machine.IsStarted() {
+		return fmt.Errorf("cannot resize the disk of a running machine ('%s' is started)", action.machineName)
+	}
+
+	if action.machine.IsSuspended() {
+		return fmt.Errorf("cannot resize the disk of a suspended machine ('%s' is suspended)", action.machineName)
+	}
+
+	fmt.Printf("[qemuctl] resizing '%s' to %s... ", action.imagePath, size)
+
+	err = qemuctl_qemu.NewQemuImg().Resize(action.imagePath, size)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *DiskAction) handleConvert(outputPath string) (err error) {
+	if action.machine.IsStarted() {
+		return fmt.Errorf("cannot convert the disk of a running machine ('%s' is started)", action.machineName)
+	}
+
+	fmt.Printf("[qemuctl] converting '%s' to %s image '%s'... ", action.imagePath, action.outputFormat, outputPath)
+
+	err = qemuctl_qemu.NewQemuImg().Convert(action.imagePath, outputPath, action.outputFormat)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
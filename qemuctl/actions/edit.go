@@ -34,6 +34,11 @@ func (action *EditAction) Run(arguments []string) (err error) {
 		return fmt.Errorf("cannot edit a running machine ('%s' is started)", action.machineName)
 	}
 
+	/* The saved state only fits the hardware it was saved from */
+	if machine.IsSuspended() {
+		return fmt.Errorf("cannot edit a suspended machine ('%s' must be started and stopped first)", action.machineName)
+	}
+
 	log.Printf("[edit] looking for a valid EDITOR")
 	editorBin := os.ExpandEnv("$EDITOR")
 	if len(editorBin) == 0 {
@@ -0,0 +1,143 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"log"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+)
+
+// EjectAction empties a cdrom drive and InsertAction puts an image in one,
+// to swap installation media for instance. The drive itself stays; see
+// "qemuctl attach cdrom" to add one.
+type EjectAction struct {
+	cdromID string
+	persist bool
+}
+
+type InsertAction struct {
+	cdromID string
+	persist bool
+}
+
+func (action *EjectAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl eject <machine> [--cdrom ID] [--persist]")
+}
+
+func (action *InsertAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl insert <machine> <iso> [--cdrom ID] [--persist]")
+}
+
+func (action *EjectAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl eject", flag.ContinueOnError)
+
+	flagSet.StringVar(&action.cdromID, "cdrom", "", "cdrom drive id (defaults to the first one)")
+	flagSet.BoolVar(&action.persist, "persist", false, "leave the drive empty in the machine configuration too")
+
+	positional, err := parseInterspersedArguments(flagSet, arguments)
+	if err != nil {
+		action.usage()
+		return err
+	}
+
+	if len(positional) < 1 {
+		action.usage()
+		return fmt.Errorf("machine name is mandatory")
+	}
+
+	return changeMedium(positional[0], action.cdromID, "", action.persist)
+}
+
+func (action *InsertAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl insert", flag.ContinueOnError)
+
+	flagSet.StringVar(&action.cdromID, "cdrom", "", "cdrom drive id (defaults to the first one)")
+	flagSet.BoolVar(&action.persist, "persist", false, "put the image in the machine configuration too")
+
+	positional, err := parseInterspersedArguments(flagSet, arguments)
+	if err != nil {
+		action.usage()
+		return err
+	}
+
+	if len(positional) < 2 {
+		action.usage()
+		return fmt.Errorf("machine name and image file are mandatory")
+	}
+
+	return changeMedium(positional[0], action.cdromID, positional[1], action.persist)
+}
+
+/* changeMedium puts imagePath in the cdrom drive cdromID, or empties it when imagePath is empty */
+func changeMedium(machineName string, cdromID string, imagePath string, persist bool) (err error) {
+	var configBytes []byte
+	var description string
+
+	machine, configData, err := loadHotplugMachine(machineName, persist)
+	if err != nil {
+		return err
+	}
+
+	disks := namedDisks(configData.Disks)
+	index, err := findCDRom(disks, cdromID)
+	if err != nil && (!machine.IsStarted() || len(cdromID) == 0) {
+		return fmt.Errorf("machine '%s': %s", machine.Name, err.Error())
+	}
+
+	/* A drive attached without --persist is only known to QEMU */
+	var disk helpers.Disk = helpers.Disk{ID: cdromID, Media: helpers.DiskMediaCDRom}
+	if index >= 0 {
+		disk = disks[index]
+	}
+
+	disk.File, disk.Device, disk.Image = "", "", helpers.DiskImage{}
+	description = fmt.Sprintf("ejecting cdrom '%s' of machine '%s'", disk.ID, machine.Name)
+	if len(imagePath) > 0 {
+		err = setDiskSource(&disk, imagePath)
+		if err != nil {
+			return err
+		}
+		description = fmt.Sprintf("inserting '%s' in cdrom '%s' of machine '%s'", imagePath, disk.ID, machine.Name)
+	}
+
+	if persist && index >= 0 {
+		disks[index] = disk
+		configBytes, err = updateMachineConfig(machine, "disks", disks)
+		if err != nil {
+			return err
+		}
+	} else if persist {
+		log.Printf("[medium] '%s' is not in the configuration of '%s', nothing to save", disk.ID, machine.Name)
+	}
+
+	return applyDeviceChange(machine, description,
+		func(hotplug *qemuctl_qemu.Hotplug) error {
+			if !disk.HasMedium() {
+				return hotplug.EjectMedium(disk.ID)
+			}
+			return hotplug.InsertMedium(&disk)
+		}, configData, configBytes)
+}
+
+/* findCDRom returns the index of the cdrom drive cdromID, or of the first one */
+func findCDRom(disks helpers.DiskList, cdromID string) (index int, err error) {
+	for index := range disks {
+		if !disks[index].IsCDRom() {
+			continue
+		}
+
+		if len(cdromID) == 0 || disks[index].ID == cdromID {
+			return index, nil
+		}
+	}
+
+	if len(cdromID) > 0 {
+		return -1, fmt.Errorf("no cdrom drive '%s' in the configuration", cdromID)
+	}
+
+	return -1, fmt.Errorf("no cdrom drive in the configuration (--cdrom names one attached since start)")
+}
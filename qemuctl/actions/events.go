@@ -0,0 +1,126 @@
+package qemuctl_actions
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"time"
+
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type EventsAction struct {
+	machineName string
+	jsonOutput  bool
+	untilEvent  string
+	timeout     time.Duration
+}
+
+func (action *EventsAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl events", flag.ExitOnError)
+
+	flagSet.BoolVar(&action.jsonOutput, "json", false, "print events as JSON lines")
+	flagSet.StringVar(&action.untilEvent, "until", "", "exit once EVENT is received")
+	flagSet.DurationVar(&action.timeout, "timeout", 0, "stop listening after DURATION; with --until, failing")
+
+	action.machineName, _, err = parseMachineArguments(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+
+	return action.handleEvents()
+}
+
+func (action *EventsAction) handleEvents() (err error) {
+	var machine *runtime.Machine
+	var client *qemuctl_qemu.QmpClient
+
+	machine = runtime.NewMachine(action.machineName)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", action.machineName)
+	}
+
+	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	log.Printf("[events] attaching to '%s'", qemuMonitor.GetUnixSocketPath())
+	client, err = qemuMonitor.Connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if !action.jsonOutput {
+		fmt.Printf("[qemuctl] listening for events on machine '%s'\n", action.machineName)
+	}
+
+	/* A nil channel never fires: no timeout */
+	var deadline <-chan time.Time
+	if action.timeout > 0 {
+		deadline = time.After(action.timeout)
+	}
+
+	for {
+		select {
+		case event, ok := <-client.Events():
+			if !ok {
+				return action.handleClosed()
+			}
+
+			err = action.printEvent(&event)
+			if err != nil {
+				return err
+			}
+
+			if len(action.untilEvent) > 0 && event.Event == action.untilEvent {
+				log.Printf("[events] got %s, exiting", event.Event)
+				return nil
+			}
+
+		case <-deadline:
+			if len(action.untilEvent) > 0 {
+				return fmt.Errorf("no %s from machine '%s' within %s", action.untilEvent, action.machineName, action.timeout)
+			}
+			return nil
+		}
+	}
+}
+
+/* handleClosed reports the end of the event stream: QEMU went away */
+func (action *EventsAction) handleClosed() (err error) {
+	if len(action.untilEvent) > 0 {
+		return fmt.Errorf("connection to machine '%s' closed before %s", action.machineName, action.untilEvent)
+	}
+
+	if !action.jsonOutput {
+		fmt.Printf("[qemuctl] connection to machine '%s' closed\n", action.machineName)
+	}
+
+	return nil
+}
+
+func (action *EventsAction) printEvent(event *qemuctl_qemu.QmpEvent) (err error) {
+	if action.jsonOutput {
+		jsonBytes, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonBytes))
+
+		return nil
+	}
+
+	timestamp := event.Timestamp.Time().Format("2006-01-02 15:04:05.000000")
+	if len(event.Data) > 0 {
+		fmt.Printf("%s  \033[34m%-16s\033[0m %s\n", timestamp, event.Event, string(event.Data))
+	} else {
+		fmt.Printf("%s  \033[34m%s\033[0m\n", timestamp, event.Event)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	exporter "luizpuglisi.com/qemuctl/exporter"
+)
+
+// ExporterAction serves Prometheus metrics about every machine
+type ExporterAction struct {
+	listen string
+}
+
+func (action *ExporterAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl exporter", flag.ContinueOnError)
+
+	flagSet.StringVar(&action.listen, "listen", exporter.ExporterDefaultListen, "address to serve metrics on")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	server := exporter.NewExporter(action.listen)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		received := <-signals
+		log.Printf("[exporter] got %s, shutting down", received.String())
+		server.Close()
+	}()
+
+	fmt.Printf("[qemuctl] serving metrics on '%s%s'\n", action.listen, exporter.ExporterMetricsPath)
+
+	return server.Serve()
+}
@@ -0,0 +1,236 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// GuestAction talks to qemu-guest-agent in a started machine, through the
+// channel guestAgent.enabled adds to it.
+type GuestAction struct {
+	machineName string
+	timeout     time.Duration
+	reboot      bool
+	machine     *runtime.Machine
+}
+
+func (action *GuestAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl guest <machine> ip")
+	fmt.Println("    qemuctl guest <machine> exec [--timeout DURATION] [--] <command> [arguments...]")
+	fmt.Println("    qemuctl guest <machine> {fsfreeze|fsthaw}")
+	fmt.Println("    qemuctl guest <machine> shutdown [--reboot]")
+}
+
+func (action *GuestAction) Run(arguments []string) (err error) {
+	var subCommand string
+	var flagSet *flag.FlagSet
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("machine name and guest command are mandatory")
+	}
+
+	action.machineName = arguments[0]
+	subCommand = arguments[1]
+
+	flagSet = flag.NewFlagSet("qemuctl guest "+subCommand, flag.ContinueOnError)
+	switch subCommand {
+	case "exec":
+		flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QemuAgentExecTimeout,
+			"how long the command gets to exit")
+	case "shutdown":
+		flagSet.BoolVar(&action.reboot, "reboot", false, "reboot the guest instead of powering it off")
+	}
+
+	/* Flags stop at the command for exec, whose own flags are left alone */
+	err = flagSet.Parse(arguments[2:])
+	if err != nil {
+		action.usage()
+		return err
+	}
+
+	action.machine = runtime.NewMachine(action.machineName)
+	if !action.machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !action.machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", action.machineName)
+	}
+
+	if action.machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is paused: its guest agent cannot answer", action.machineName)
+	}
+
+	switch subCommand {
+	case "ip":
+		err = action.handleIP()
+	case "exec":
+		if flagSet.NArg() == 0 {
+			action.usage()
+			return fmt.Errorf("command to run is mandatory")
+		}
+		err = action.handleExec(flagSet.Arg(0), flagSet.Args()[1:])
+	case "fsfreeze":
+		err = action.handleFreeze()
+	case "fsthaw":
+		err = action.handleThaw()
+	case "shutdown":
+		err = action.handleShutdown()
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown guest command '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+func (action *GuestAction) connect() (agent *qemuctl_qemu.GuestAgentClient, err error) {
+	return qemuctl_qemu.NewQemuMonitor(action.machine).ConnectAgent()
+}
+
+func (action *GuestAction) handleIP() (err error) {
+	var interfaces []qemuctl_qemu.GuestAgentInterface
+
+	agent, err := action.connect()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	interfaces, err = agent.GetInterfaces()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-16s %-20s %s\n", "INTERFACE", "MAC", "ADDRESSES")
+	fmt.Printf("%s\n", strings.Repeat("-", 80))
+	for _, guestInterface := range interfaces {
+		var addresses []string
+
+		for _, address := range guestInterface.IPAddresses {
+			addresses = append(addresses, fmt.Sprintf("%s/%d", address.Address, address.Prefix))
+		}
+
+		macAddress := guestInterface.HardwareAddress
+		if len(macAddress) == 0 {
+			macAddress = "N/A"
+		}
+
+		addressString := "N/A"
+		if len(addresses) > 0 {
+			addressString = strings.Join(addresses, ",")
+		}
+
+		fmt.Printf("%-16s %-20s %s\n", guestInterface.Name, macAddress, addressString)
+	}
+
+	fmt.Println("")
+	return nil
+}
+
+/* handleExec runs command in the guest and passes its output on, as ssh would */
+func (action *GuestAction) handleExec(command string, commandArguments []string) (err error) {
+	var result *qemuctl_qemu.GuestExecResult
+
+	agent, err := action.connect()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	result, err = agent.Exec(command, commandArguments, action.timeout)
+	if err != nil {
+		return err
+	}
+
+	os.Stdout.Write(result.OutData)
+	os.Stderr.Write(result.ErrData)
+
+	if result.OutTruncated || result.ErrTruncated {
+		fmt.Printf("[\033[33mwarning\033[0m] the guest agent truncated the output of '%s'\n", command)
+	}
+
+	/* Exit as the command did, signals the way shells report them */
+	if result.Signal > 0 {
+		return &ExitStatusError{Command: command, Status: 128 + result.Signal}
+	} else if result.ExitCode != 0 {
+		return &ExitStatusError{Command: command, Status: result.ExitCode}
+	}
+
+	return nil
+}
+
+func (action *GuestAction) handleFreeze() (err error) {
+	var count int
+
+	agent, err := action.connect()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	fmt.Printf("[qemuctl] freezing filesystems of machine '%s'... ", action.machineName)
+	count, err = agent.FreezeFilesystems()
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Printf("\033[32mok!\033[0m (%d frozen, see 'qemuctl guest %s fsthaw')\n", count, action.machineName)
+	return nil
+}
+
+func (action *GuestAction) handleThaw() (err error) {
+	var count int
+
+	agent, err := action.connect()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	fmt.Printf("[qemuctl] thawing filesystems of machine '%s'... ", action.machineName)
+	count, err = agent.ThawFilesystems()
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Printf("\033[32mok!\033[0m (%d thawed)\n", count)
+	return nil
+}
+
+/* handleShutdown only asks the guest: "qemuctl stop" also waits and escalates */
+func (action *GuestAction) handleShutdown() (err error) {
+	var mode string = qemuctl_qemu.QgaShutdownPowerdown
+
+	if action.reboot {
+		mode = qemuctl_qemu.QgaShutdownReboot
+	}
+
+	agent, err := action.connect()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	fmt.Printf("[qemuctl] asking machine '%s' to %s... ", action.machineName, mode)
+	err = agent.Shutdown(mode)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
@@ -2,12 +2,20 @@ package qemuctl_actions
 
 import (
 	"fmt"
+	"log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
 
+/* How long each guest agent gets to tell the guest addresses */
+const ListAgentTimeout time.Duration = 500 * time.Millisecond
+
 type ListAction struct {
 }
 
@@ -21,27 +29,33 @@ func (action *ListAction) Run(arguments []string) (err error) {
 		return err
 	}
 
-	fmt.Printf("%-32s %-16s %-16s %-12s\n", "MACHINE", "STATUS", "SSH", "QEMU PID")
-	fmt.Printf("%s\n", strings.Repeat("-", 76))
+	var machines []*runtime.Machine
 	for _, _value := range dirEntries {
 		if _value.Type().IsDir() {
-			machine := action.getMachine(_value.Name())
+			machines = append(machines, action.getMachine(_value.Name()))
+		}
+	}
 
-			/* Format QEMU PID */
-			qemuPid := "N/A"
-			if machine.QemuPid > 0 {
-				qemuPid = fmt.Sprint(machine.QemuPid)
-			}
+	guestIPs := action.getGuestIPs(machines)
 
-			/* Format SSH string  */
-			sshString := "N/A"
-			if machine.SSHLocalPort > 0 {
-				sshString = fmt.Sprintf("127.0.0.1:%d", machine.SSHLocalPort)
-			}
+	fmt.Printf("%-32s %-16s %-22s %-12s %-20s %-32s %s\n", "MACHINE", "STATUS", "SSH", "QEMU PID", "NETWORKS", "GUEST IPS", "FORWARDS")
+	fmt.Printf("%s\n", strings.Repeat("-", 156))
+	for index, machine := range machines {
+		/* Format QEMU PID */
+		qemuPid := "N/A"
+		if machine.QemuPid > 0 {
+			qemuPid = fmt.Sprint(machine.QemuPid)
+		}
 
-			fmt.Printf("%-32s %-16s %-16s %-12s\n",
-				machine.Name, machine.Status, sshString, qemuPid)
+		/* Format SSH string  */
+		sshString := "N/A"
+		if machine.SSHLocalPort > 0 {
+			sshString = machine.GetSSHAddress()
 		}
+
+		fmt.Printf("%-32s %-16s %-22s %-12s %-20s %-32s %s\n",
+			machine.Name, machine.Status, sshString, qemuPid, action.getNetworks(machine),
+			guestIPs[index], formatHostForwards(machine))
 	}
 
 	fmt.Println("")
@@ -51,3 +65,59 @@ func (action *ListAction) Run(arguments []string) (err error) {
 func (action *ListAction) getMachine(machineName string) (machine *runtime.Machine) {
 	return runtime.NewMachine(machineName)
 }
+
+/* getNetworks returns the private networks machine joins, as "lab0,lab1" */
+func (action *ListAction) getNetworks(machine *runtime.Machine) string {
+	var networkNames []string
+
+	configData, err := helpers.NewConfigHandler(machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return "N/A"
+	}
+
+	for _, attachment := range configData.Networks {
+		networkNames = append(networkNames, attachment.Name)
+	}
+
+	if len(networkNames) == 0 {
+		return "N/A"
+	}
+
+	return strings.Join(networkNames, ",")
+}
+
+/*
+ * getGuestIPs returns the guest addresses the agents of machines report, in
+ * the same order: "N/A" without agent, "-" when it does not answer. Agents
+ * are asked all at once, so that silent ones do not add up.
+ */
+func (action *ListAction) getGuestIPs(machines []*runtime.Machine) (guestIPs []string) {
+	var waitGroup sync.WaitGroup
+
+	guestIPs = make([]string, len(machines))
+	for index, machine := range machines {
+		monitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+		/* A paused guest cannot answer */
+		guestIPs[index] = "N/A"
+		if !machine.IsStarted() || machine.IsPaused() || !monitor.HasAgentChannel() {
+			continue
+		}
+
+		waitGroup.Add(1)
+		go func(index int) {
+			defer waitGroup.Done()
+
+			ips, err := monitor.GetGuestIPs(ListAgentTimeout)
+			if err != nil {
+				log.Printf("[list] %s", err.Error())
+				guestIPs[index] = "-"
+			} else if len(ips) > 0 {
+				guestIPs[index] = ips
+			}
+		}(index)
+	}
+
+	waitGroup.Wait()
+	return guestIPs
+}
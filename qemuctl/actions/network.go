@@ -0,0 +1,129 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// NetworkAction manages private networks; machines join them with "networks:"
+type NetworkAction struct {
+	networkName  string
+	localAddress string
+}
+
+func (action *NetworkAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl network create [--local-address ADDRESS] <name>")
+	fmt.Println("    qemuctl network rm <name>")
+	fmt.Println("    qemuctl network list")
+}
+
+func (action *NetworkAction) Run(arguments []string) (err error) {
+	if len(arguments) < 1 {
+		action.usage()
+		return fmt.Errorf("network command is mandatory")
+	}
+
+	if arguments[0] == "list" {
+		return action.handleList()
+	}
+
+	flagSet := flag.NewFlagSet("network", flag.ContinueOnError)
+	flagSet.StringVar(&action.localAddress, "local-address", runtime.NetworkDefaultLocalAddress,
+		"address of the host interface multicast goes through")
+
+	err = flagSet.Parse(arguments[1:])
+	if err != nil {
+		return err
+	}
+
+	if flagSet.NArg() < 1 || len(flagSet.Arg(0)) == 0 {
+		action.usage()
+		return fmt.Errorf("network name is mandatory")
+	}
+	action.networkName = flagSet.Arg(0)
+
+	if !helpers.IsValidName(action.networkName) {
+		return fmt.Errorf("invalid network name '%s'", action.networkName)
+	}
+
+	switch arguments[0] {
+	case "create":
+		err = action.handleCreate()
+	case "rm":
+		err = action.handleRemove()
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown network command '%s'", arguments[0])
+		}
+	}
+
+	return err
+}
+
+func (action *NetworkAction) handleCreate() (err error) {
+	if net.ParseIP(action.localAddress) == nil {
+		return fmt.Errorf("invalid local address '%s'", action.localAddress)
+	}
+
+	fmt.Printf("[network] creating network '%s'... ", action.networkName)
+
+	network, err := runtime.CreateNetwork(action.networkName, action.localAddress)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Printf("\033[32mok!\033[0m (%s)\n", network.GetMcastAddress())
+	return nil
+}
+
+func (action *NetworkAction) handleRemove() (err error) {
+	fmt.Printf("[network] removing network '%s'... ", action.networkName)
+
+	/* Machines would not start anymore */
+	if machineNames := helpers.GetNetworkMachines()[action.networkName]; len(machineNames) > 0 {
+		fmt.Println("\033[31merror!\033[0m")
+		return fmt.Errorf("network '%s' is used by: %s", action.networkName, strings.Join(machineNames, ", "))
+	}
+
+	err = runtime.RemoveNetwork(action.networkName)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *NetworkAction) handleList() (err error) {
+	var networks []*runtime.Network
+
+	networks, err = runtime.ListNetworks()
+	if err != nil {
+		return err
+	}
+
+	networkMachines := helpers.GetNetworkMachines()
+
+	fmt.Printf("%-32s %-22s %-16s %s\n", "NETWORK", "GROUP", "LOCAL ADDRESS", "MACHINES")
+	fmt.Printf("%s\n", strings.Repeat("-", 96))
+	for _, network := range networks {
+		machines := "N/A"
+		if len(networkMachines[network.Name]) > 0 {
+			machines = strings.Join(networkMachines[network.Name], ",")
+		}
+
+		fmt.Printf("%-32s %-22s %-16s %s\n", network.Name, network.GetMcastAddress(), network.LocalAddress, machines)
+	}
+
+	fmt.Println("")
+	return nil
+}
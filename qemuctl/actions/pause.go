@@ -0,0 +1,58 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// PauseAction freezes the guest, ResumeAction lets it run again and
+// ResetAction resets it; QEMU keeps running in all three cases.
+type PauseAction struct {
+}
+
+type ResumeAction struct {
+}
+
+type ResetAction struct {
+}
+
+func (action *PauseAction) Run(arguments []string) (err error) {
+	return runControlAction("pause", "pausing", qemuctl_qemu.PauseMachine, arguments)
+}
+
+func (action *ResumeAction) Run(arguments []string) (err error) {
+	return runControlAction("resume", "resuming", qemuctl_qemu.ResumeMachine, arguments)
+}
+
+func (action *ResetAction) Run(arguments []string) (err error) {
+	return runControlAction("reset", "resetting", qemuctl_qemu.ResetMachine, arguments)
+}
+
+/* runControlAction applies operation to the machine named in arguments */
+func runControlAction(name string, verb string, operation func(*runtime.Machine) error, arguments []string) (err error) {
+	var machine *runtime.Machine
+
+	machineName, _, err := parseMachineArguments(flag.NewFlagSet(name, flag.ContinueOnError), arguments)
+	if err != nil {
+		return err
+	}
+
+	machine = runtime.NewMachine(machineName)
+	if machine == nil || !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", machineName)
+	}
+
+	fmt.Printf("[qemuctl] %s machine '%s'... ", verb, machineName)
+
+	err = operation(machine)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
@@ -0,0 +1,83 @@
+package qemuctl_actions
+
+import (
+	"fmt"
+	"os"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type RenameAction struct {
+	machineName string
+	newName     string
+}
+
+func (action *RenameAction) Run(arguments []string) (err error) {
+	if len(arguments) < 2 {
+		return fmt.Errorf("usage: qemuctl rename <machine> <new name>")
+	}
+	action.machineName = arguments[0]
+	action.newName = arguments[1]
+
+	fmt.Printf("[rename] renaming machine '%s' to '%s'... ", action.machineName, action.newName)
+
+	err = action.handleRename()
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *RenameAction) handleRename() (err error) {
+	var machine *runtime.Machine
+	var configBytes []byte
+
+	if !helpers.IsValidName(action.newName) {
+		return fmt.Errorf("invalid machine name '%s'", action.newName)
+	}
+
+	machine = runtime.NewMachine(action.machineName)
+	if machine == nil || !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if machine.IsStarted() {
+		return fmt.Errorf("cannot rename a running machine ('%s' is started)", action.machineName)
+	}
+
+	/* Overlays record the absolute path of their backing file */
+	user, err := helpers.FindDiskUser(machine)
+	if err != nil {
+		return err
+	}
+	if len(user) > 0 {
+		return fmt.Errorf("machine '%s' uses disks of '%s' as backing files", user, action.machineName)
+	}
+
+	configBytes, err = os.ReadFile(machine.ConfigFile)
+	if err != nil {
+		return err
+	}
+
+	configBytes, err = helpers.SetConfigValue(configBytes, "machine.name", action.newName)
+	if err != nil {
+		return err
+	}
+
+	err = machine.Rename(action.newName)
+	if err != nil {
+		return err
+	}
+
+	err = machine.WriteConfigFile(configBytes)
+	if err != nil {
+		return err
+	}
+
+	/* Rewrite machine data so it is consistent with the new location */
+	return machine.UpdateStatus(machine.Status)
+}
@@ -0,0 +1,115 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+	"strings"
+
+	client "luizpuglisi.com/qemuctl/client"
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// ShowCommandAction prints the QEMU command line of a machine or config file
+type ShowCommandAction struct {
+	machineName string
+	configFile  string
+	shellQuoted bool
+}
+
+func (action *ShowCommandAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl show-command", flag.ExitOnError)
+	var configData *helpers.ConfigurationData
+	var machine *runtime.Machine
+
+	flagSet.StringVar(&action.configFile, "config", "", "YAML configuration file instead of a machine")
+	flagSet.BoolVar(&action.shellQuoted, "shell", false, "print a single shell-quoted command line")
+
+	if len(arguments) > 0 && !strings.HasPrefix(arguments[0], "-") {
+		action.machineName = arguments[0]
+		arguments = arguments[1:]
+	}
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if len(action.machineName) == 0 && flagSet.NArg() > 0 {
+		action.machineName = flagSet.Arg(0)
+	}
+
+	/* Either a machine or a config file, not both */
+	if (len(action.machineName) == 0) == (len(action.configFile) == 0) {
+		return fmt.Errorf("usage: qemuctl show-command <machine|--config file> [--shell]")
+	}
+
+	if len(action.configFile) == 0 {
+		machine = runtime.NewMachine(action.machineName)
+		if machine == nil || !machine.Exists() {
+			return fmt.Errorf("machine '%s' does not exist", action.machineName)
+		}
+		action.configFile = machine.ConfigFile
+	}
+
+	configData, err = helpers.NewConfigHandler(action.configFile).ValidateConfigFile()
+	if err != nil {
+		return err
+	}
+
+	/* A config file may describe a machine that does not exist yet */
+	if machine == nil {
+		machine = runtime.NewMachine(configData.Machine.MachineName)
+		if machine == nil {
+			return fmt.Errorf("could not read the data of machine '%s'", configData.Machine.MachineName)
+		}
+	}
+
+	return printQemuCommand(machine, configData, action.shellQuoted)
+}
+
+/*
+ * printQemuCommand prints the argv QEMU would get, one option and its value
+ * per line, or as a single shell-quoted line ready to be pasted.
+ */
+func printQemuCommand(machine *runtime.Machine, configData *helpers.ConfigurationData, shellQuoted bool) (err error) {
+	var qemuArgs []string
+
+	/* A start goes through qemuctl daemon when one runs; a started machine shows how it runs */
+	var supervised bool = client.NewClient().IsRunning()
+	if machine.IsStarted() {
+		supervised = machine.Supervised
+	}
+
+	/* Shows the ports a start would pick right now, and port conflicts */
+	qemu, err := qemuctl_qemu.NewMachineCommand(configData, machine, supervised)
+	if err != nil {
+		return err
+	}
+
+	qemuArgs, err = qemu.GetCommandLine()
+	if err != nil {
+		return err
+	}
+
+	if shellQuoted {
+		fmt.Println(helpers.ShellJoin(qemuArgs))
+		return nil
+	}
+
+	fmt.Println(qemuArgs[0])
+	for index := 1; index < len(qemuArgs); index++ {
+		line := qemuArgs[index]
+
+		/* Options and their values go together */
+		if strings.HasPrefix(line, "-") && index+1 < len(qemuArgs) && !strings.HasPrefix(qemuArgs[index+1], "-") {
+			index++
+			line = fmt.Sprintf("%s %s", line, qemuArgs[index])
+		}
+
+		fmt.Printf("    %s\n", line)
+	}
+
+	return nil
+}
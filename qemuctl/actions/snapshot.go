@@ -0,0 +1,240 @@
+package qemuctl_actions
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type SnapshotAction struct {
+	machineName string
+	tag         string
+	machine     *runtime.Machine
+}
+
+func (action *SnapshotAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl snapshot {create|restore|delete} <machine> <tag>")
+	fmt.Println("    qemuctl snapshot list <machine>")
+}
+
+func (action *SnapshotAction) Run(arguments []string) (err error) {
+	var subCommand string
+
+	if len(arguments) < 2 {
+		action.usage()
+		return fmt.Errorf("snapshot command and machine name are mandatory")
+	}
+
+	subCommand = arguments[0]
+	action.machineName = arguments[1]
+
+	action.machine = runtime.NewMachine(action.machineName)
+	if !action.machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if subCommand == "list" {
+		return action.handleList()
+	}
+
+	if len(arguments) < 3 || len(arguments[2]) == 0 {
+		action.usage()
+		return fmt.Errorf("snapshot tag is mandatory")
+	}
+	action.tag = arguments[2]
+
+	/* Snapshots of started machines go through the monitor, which takes plain names only */
+	if subCommand == "create" && !helpers.IsValidName(action.tag) {
+		return fmt.Errorf("invalid snapshot tag '%s' (letters, digits, '.', '_' and '-' only)", action.tag)
+	}
+
+	switch subCommand {
+	case "create":
+		err = action.handleCreate()
+	case "restore":
+		err = action.handleRestore()
+	case "delete":
+		err = action.handleDelete()
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown snapshot command '%s'", subCommand)
+		}
+	}
+
+	return err
+}
+
+/* getDiskImages returns the qcow2 images holding internal snapshots of a stopped machine */
+func (action *SnapshotAction) getDiskImages() (images []string, err error) {
+	var configData *helpers.ConfigurationData
+
+	configData, err = helpers.NewConfigHandler(action.machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	images = qemuctl_qemu.GetSnapshotImages(configData, action.machine)
+	if len(images) == 0 {
+		return nil, fmt.Errorf("machine '%s' has no qcow2 disk image to snapshot", action.machineName)
+	}
+
+	return images, nil
+}
+
+/* offlineSnapshot runs a qemu-img snapshot operation on every disk image */
+func (action *SnapshotAction) offlineSnapshot(operation func(string, string) error) (err error) {
+	var images []string
+
+	images, err = action.getDiskImages()
+	if err != nil {
+		return err
+	}
+
+	for _, imagePath := range images {
+		log.Printf("[snapshot] offline snapshot '%s' on '%s'", action.tag, imagePath)
+		err = operation(imagePath, action.tag)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* checkDiskUser refuses to change images that clones made without --full read as backing files */
+func (action *SnapshotAction) checkDiskUser() (err error) {
+	user, err := helpers.FindDiskUser(action.machine)
+	if err != nil {
+		return err
+	}
+
+	if len(user) > 0 {
+		return fmt.Errorf("machine '%s' uses disks of '%s' as backing files", user, action.machineName)
+	}
+
+	return nil
+}
+
+func (action *SnapshotAction) handleCreate() (err error) {
+	var machineState string = runtime.MachineStatusStopped
+
+	fmt.Printf("[qemuctl] creating snapshot '%s' of machine '%s'... ", action.tag, action.machineName)
+
+	if action.machine.IsStarted() {
+		machineState = runtime.MachineStatusStarted
+
+		log.Printf("[snapshot] saving vm state of '%s' as '%s'", action.machineName, action.tag)
+		err = qemuctl_qemu.NewQemuMonitor(action.machine).SaveSnapshot(action.tag)
+	} else {
+		err = action.offlineSnapshot(qemuctl_qemu.NewQemuImg().SnapshotCreate)
+	}
+
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	err = action.machine.AddSnapshot(runtime.SnapshotData{
+		Tag:          action.tag,
+		Date:         time.Now(),
+		MachineState: machineState,
+	})
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *SnapshotAction) handleRestore() (err error) {
+	var snapshot *runtime.SnapshotData
+
+	if snapshot = action.machine.GetSnapshot(action.tag); snapshot == nil {
+		return fmt.Errorf("snapshot '%s' does not exist", action.tag)
+	}
+
+	/* Its saved state would no longer match the disks */
+	if action.machine.IsSuspended() {
+		return fmt.Errorf("cannot restore a snapshot of a suspended machine ('%s' is suspended)", action.machineName)
+	}
+
+	fmt.Printf("[qemuctl] restoring snapshot '%s' of machine '%s'... ", action.tag, action.machineName)
+
+	if action.machine.IsStarted() {
+		if snapshot.MachineState != runtime.MachineStatusStarted {
+			fmt.Println("\033[31merror!\033[0m")
+			return fmt.Errorf("snapshot '%s' is disk-only; stop machine '%s' to restore it", action.tag, action.machineName)
+		}
+
+		err = qemuctl_qemu.NewQemuMonitor(action.machine).LoadSnapshot(action.tag)
+	} else {
+		err = action.checkDiskUser()
+		if err == nil {
+			err = action.offlineSnapshot(qemuctl_qemu.NewQemuImg().SnapshotApply)
+		}
+	}
+
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *SnapshotAction) handleDelete() (err error) {
+	if action.machine.GetSnapshot(action.tag) == nil {
+		return fmt.Errorf("snapshot '%s' does not exist", action.tag)
+	}
+
+	fmt.Printf("[qemuctl] deleting snapshot '%s' of machine '%s'... ", action.tag, action.machineName)
+
+	if action.machine.IsStarted() {
+		err = qemuctl_qemu.NewQemuMonitor(action.machine).DeleteSnapshot(action.tag)
+	} else {
+		err = action.offlineSnapshot(qemuctl_qemu.NewQemuImg().SnapshotDelete)
+	}
+
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	err = action.machine.RemoveSnapshot(action.tag)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *SnapshotAction) handleList() (err error) {
+	var snapshots []runtime.SnapshotData
+
+	snapshots, err = action.machine.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-32s %-24s %-16s\n", "TAG", "DATE", "MACHINE STATE")
+	fmt.Printf("%s\n", strings.Repeat("-", 72))
+	for _, snapshot := range snapshots {
+		fmt.Printf("%-32s %-24s %-16s\n",
+			snapshot.Tag, snapshot.Date.Format("2006-01-02 15:04:05"), snapshot.MachineState)
+	}
+
+	fmt.Println("")
+	return nil
+}
@@ -0,0 +1,293 @@
+package qemuctl_actions
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	SSHDefaultBin         string        = "ssh"
+	SCPDefaultBin         string        = "scp"
+	SSHDefaultWaitTimeout time.Duration = 120 * time.Second
+	SSHProbeInterval      time.Duration = 2 * time.Second
+)
+
+/* sshTarget is what ssh and scp need to reach a machine */
+type sshTarget struct {
+	address      string
+	port         int
+	user         string
+	identityFile string
+}
+
+func getSSHTarget(machineName string) (target *sshTarget, err error) {
+	var machine *runtime.Machine
+	var configData *helpers.ConfigurationData
+
+	machine = runtime.NewMachine(machineName)
+	if !machine.Exists() {
+		return nil, fmt.Errorf("machine '%s' does not exist", machineName)
+	}
+
+	if !machine.IsStarted() {
+		return nil, fmt.Errorf("machine '%s' is not started", machineName)
+	}
+
+	if machine.SSHLocalPort <= 0 {
+		return nil, fmt.Errorf("machine '%s' has no SSH port forward", machineName)
+	}
+
+	configData, err = helpers.NewConfigHandler(machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	target = &sshTarget{
+		address:      helpers.GetConnectAddress(machine.SSHAddress),
+		port:         machine.SSHLocalPort,
+		user:         configData.SSH.User,
+		identityFile: configData.SSH.IdentityFile,
+	}
+
+	/* Fall back to the user cloud-init creates */
+	if len(target.user) == 0 {
+		target.user = configData.CloudInit.User
+	}
+
+	if strings.HasPrefix(target.identityFile, "~/") {
+		target.identityFile = os.ExpandEnv("$HOME") + target.identityFile[1:]
+	}
+
+	return target, nil
+}
+
+func (target *sshTarget) getHost() string {
+	if len(target.user) > 0 {
+		return fmt.Sprintf("%s@%s", target.user, target.address)
+	}
+
+	return target.address
+}
+
+/* getRemotePath returns the scp argument for path on target: IPv6 hosts need brackets there */
+func (target *sshTarget) getRemotePath(path string) string {
+	var host string = target.address
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if len(target.user) > 0 {
+		host = fmt.Sprintf("%s@%s", target.user, host)
+	}
+
+	return fmt.Sprintf("%s:%s", host, path)
+}
+
+/*
+ * getOptions returns the options shared by ssh and scp. Host keys change
+ * every time a machine is recreated, so they are not checked nor recorded.
+ */
+func (target *sshTarget) getOptions() (options []string) {
+	options = []string{
+		"-o", "StrictHostKeyChecking=no",
+		"-o", "UserKnownHostsFile=/dev/null",
+		"-o", "LogLevel=ERROR",
+	}
+
+	if len(target.identityFile) > 0 {
+		options = append(options, "-i", target.identityFile)
+	}
+
+	return options
+}
+
+/*
+ * waitForSSH waits until sshd answers on the forwarded port. The user network
+ * accepts connections as soon as QEMU starts, so we wait for the SSH banner.
+ */
+func (target *sshTarget) waitForSSH(timeout time.Duration) (err error) {
+	var address string = net.JoinHostPort(target.address, fmt.Sprint(target.port))
+	var deadline time.Time = time.Now().Add(timeout)
+
+	for {
+		conn, dialErr := net.DialTimeout("tcp", address, SSHProbeInterval)
+		if dialErr == nil {
+			conn.SetReadDeadline(time.Now().Add(SSHProbeInterval))
+			banner, readErr := bufio.NewReader(conn).ReadString('\n')
+			conn.Close()
+
+			if readErr == nil && strings.HasPrefix(banner, "SSH-") {
+				log.Printf("[ssh] sshd is up on %s: %s", address, strings.TrimSpace(banner))
+				return nil
+			}
+			err = fmt.Errorf("no SSH banner on %s", address)
+		} else {
+			err = dialErr
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timeout waiting for sshd on %s: %s", address, err.Error())
+		}
+
+		log.Printf("[ssh] waiting for sshd on %s: %s", address, err.Error())
+		time.Sleep(SSHProbeInterval)
+	}
+}
+
+// ExitStatusError is a command run for the user that failed; qemuctl exits
+// with its status, as scripts expect from "qemuctl ssh vm -- false".
+type ExitStatusError struct {
+	Command string
+	Status  int
+}
+
+func (exitError *ExitStatusError) Error() string {
+	return fmt.Sprintf("%s exited with status %d", exitError.Command, exitError.Status)
+}
+
+func runInteractive(binary string, args []string) (err error) {
+	var binaryPath string
+
+	binaryPath, err = exec.LookPath(binary)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[ssh] running '%s %s'", binaryPath, strings.Join(args, " "))
+
+	command := exec.Command(binaryPath, args...)
+	command.Stdin = os.Stdin
+	command.Stdout = os.Stdout
+	command.Stderr = os.Stderr
+
+	err = command.Run()
+	if exitError, ok := err.(*exec.ExitError); ok {
+		return &ExitStatusError{Command: binary, Status: exitError.ExitCode()}
+	}
+
+	return err
+}
+
+type SSHAction struct {
+	machineName string
+	waitTimeout time.Duration
+}
+
+func (action *SSHAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl ssh", flag.ExitOnError)
+	var command []string
+	var target *sshTarget
+	var sshArgs []string
+
+	flagSet.DurationVar(&action.waitTimeout, "timeout", SSHDefaultWaitTimeout, "how long to wait for sshd")
+
+	action.machineName, command, err = parseMachineArguments(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+
+	if len(command) > 0 && command[0] == "--" {
+		command = command[1:]
+	}
+
+	target, err = getSSHTarget(action.machineName)
+	if err != nil {
+		return err
+	}
+
+	err = target.waitForSSH(action.waitTimeout)
+	if err != nil {
+		return err
+	}
+
+	sshArgs = append(target.getOptions(), "-p", fmt.Sprint(target.port), target.getHost())
+	sshArgs = append(sshArgs, command...)
+
+	return runInteractive(SSHDefaultBin, sshArgs)
+}
+
+type CopyAction struct {
+	recursive   bool
+	waitTimeout time.Duration
+}
+
+/* splitRemotePath splits "machine:path"; machine is empty for local paths */
+func splitRemotePath(path string) (machineName string, remotePath string) {
+	if index := strings.Index(path, ":"); index > 0 && !strings.Contains(path[:index], "/") {
+		return path[:index], path[index+1:]
+	}
+
+	return "", path
+}
+
+func (action *CopyAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl cp", flag.ExitOnError)
+	var source, destination string
+	var machineName string
+	var target *sshTarget
+	var scpArgs []string
+
+	flagSet.BoolVar(&action.recursive, "r", false, "copy directories recursively")
+	flagSet.DurationVar(&action.waitTimeout, "timeout", SSHDefaultWaitTimeout, "how long to wait for sshd")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	if flagSet.NArg() != 2 {
+		fmt.Println("usage:")
+		fmt.Println("    qemuctl cp [-r] <src> <machine>:<dst>")
+		fmt.Println("    qemuctl cp [-r] <machine>:<src> <dst>")
+		return fmt.Errorf("source and destination are mandatory")
+	}
+	source, destination = flagSet.Arg(0), flagSet.Arg(1)
+
+	sourceMachine, sourcePath := splitRemotePath(source)
+	destinationMachine, destinationPath := splitRemotePath(destination)
+
+	switch {
+	case len(sourceMachine) > 0 && len(destinationMachine) > 0:
+		return fmt.Errorf("copying between two machines is not supported")
+	case len(sourceMachine) == 0 && len(destinationMachine) == 0:
+		return fmt.Errorf("either source or destination must be <machine>:<path>")
+	case len(sourceMachine) > 0:
+		machineName = sourceMachine
+	default:
+		machineName = destinationMachine
+	}
+
+	target, err = getSSHTarget(machineName)
+	if err != nil {
+		return err
+	}
+
+	err = target.waitForSSH(action.waitTimeout)
+	if err != nil {
+		return err
+	}
+
+	scpArgs = append(target.getOptions(), "-P", fmt.Sprint(target.port))
+	if action.recursive {
+		scpArgs = append(scpArgs, "-r")
+	}
+
+	if len(sourceMachine) > 0 {
+		scpArgs = append(scpArgs, target.getRemotePath(sourcePath), destinationPath)
+	} else {
+		scpArgs = append(scpArgs, sourcePath, target.getRemotePath(destinationPath))
+	}
+
+	return runInteractive(SCPDefaultBin, scpArgs)
+}
@@ -1,10 +1,12 @@
 package qemuctl_actions
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"strconv"
 
+	client "luizpuglisi.com/qemuctl/client"
 	helpers "luizpuglisi.com/qemuctl/helpers"
 	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
 	runtime "luizpuglisi.com/qemuctl/runtime"
@@ -17,14 +19,22 @@ type StartAction struct {
 	machineName string
 	configFile  string
 	qemuBinary  string
+	dryRun      bool
 }
 
 func (action *StartAction) Run(arguments []string) (err error) {
-	/* Check for machine name */
-	if len(arguments) < 1 {
-		return fmt.Errorf("machine name is mandatory")
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl start", flag.ExitOnError)
+
+	flagSet.BoolVar(&action.dryRun, "dry-run", false, "print the QEMU command line instead of starting the machine")
+
+	action.machineName, _, err = parseMachineArguments(flagSet, arguments)
+	if err != nil {
+		return err
+	}
+
+	if action.dryRun {
+		return action.handleDryRun()
 	}
-	action.machineName = arguments[0]
 
 	fmt.Printf("[start] starting machine '%s'... ", action.machineName)
 
@@ -57,41 +67,108 @@ func (action *StartAction) handleStart() (err error) {
 		return fmt.Errorf("[start] cannot start a degraded machine")
 	}
 
+	if machine.IsSuspended() {
+		log.Printf("[start] machine '%s' is suspended, restoring its state", machine.Name)
+	}
+
 	/* in this release, starting a machine means creating it again */
 	log.Printf("[start] relaunching machine '%s' (%s)", machine.Name, machine.ConfigFile)
 
-	log.Printf("[start] parsing config file '%s'", machine.ConfigFile)
+	log.Printf("[start] validating config file '%s'", machine.ConfigFile)
 	configHandle := helpers.NewConfigHandler(machine.ConfigFile)
-	configData, err := configHandle.ParseConfigFile()
+	configData, err := configHandle.ValidateConfigFile()
+	if err != nil {
+		return err
+	}
+
+	return launchMachine(machine, configData)
+}
+
+func (action *StartAction) handleDryRun() (err error) {
+	var machine *runtime.Machine = runtime.NewMachine(action.machineName)
+
+	if machine == nil || !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	configData, err := helpers.NewConfigHandler(machine.ConfigFile).ValidateConfigFile()
 	if err != nil {
 		return err
 	}
 
-	log.Printf("[start] creating qemuMonitor instance")
-	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	return printQemuCommand(machine, configData, false)
+}
+
+/*
+ * launchMachine runs QEMU for machine: through qemuctl daemon when one is
+ * running, so that it supervises the process, or directly otherwise.
+ */
+func launchMachine(machine *runtime.Machine, configData *helpers.ConfigurationData) (err error) {
+	var daemonClient *client.Client = client.NewClient()
+
+	if daemonClient.IsRunning() {
+		log.Printf("[launch] asking qemuctl daemon to start '%s'", machine.Name)
+
+		machineInfo, err := daemonClient.StartMachine(machine.Name)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[launch] daemon started '%s' with pid %d", machine.Name, machineInfo.QemuPid)
+		return nil
+	}
+
+	log.Printf("[launch] building the qemu command")
+	qemu, err := qemuctl_qemu.NewMachineCommand(configData, machine, false)
+	if err != nil {
+		return err
+	}
+	qemuMonitor := qemu.Monitor
+	qemu.PrepareRestore()
 
-	log.Printf("[start] launching qemu command")
-	qemu := qemuctl_qemu.NewQemuCommand(configData, qemuMonitor)
+	err = qemu.Prepare()
+	if err != nil {
+		return err
+	}
 
+	log.Printf("[launch] launching qemu command")
 	err = qemu.Launch()
 	if err == nil {
 		procPid := 0
 		pidString, err := qemuMonitor.GetPidFileData()
 		if err != nil {
-			log.Printf("[start] could not get process pid: %s", err.Error())
+			log.Printf("[launch] could not get process pid: %s", err.Error())
 		} else {
 			procPid, err = strconv.Atoi(pidString)
 			if err != nil {
-				log.Printf("[start] could not convert pid string to int %s", err.Error())
+				log.Printf("[launch] could not convert pid string to int %s", err.Error())
 			} else {
-				log.Printf("[start] got machine pid: %d", procPid)
+				log.Printf("[launch] got machine pid: %d", procPid)
 			}
 		}
 		machine.QemuPid = procPid
-		machine.SSHLocalPort = configData.SSH.LocalPort
+		machine.SSHLocalPort = int(configData.SSH.LocalPort)
+		machine.SSHAddress = helpers.GetConnectAddress(configData.SSH.HostAddress)
+		machine.HostForwards = helpers.GetHostForwards(configData)
+		machine.Supervised = false
 		machine.UpdateStatus(runtime.MachineStatusStarted)
+	} else if len(qemu.IncomingFile) > 0 {
+		/* The guest did not run: it can still be restored */
+		qemuctl_qemu.RecordSuspended(machine)
+		return err
 	} else {
+		machine.QemuPid = 0
+		machine.SSHLocalPort = 0
+		machine.HostForwards = nil
 		machine.UpdateStatus(runtime.MachineStatusDegraded)
+		return err
+	}
+
+	status, err := qemu.FinishRestore()
+	if status == runtime.MachineStatusSuspended {
+		qemuctl_qemu.RecordSuspended(machine)
+	} else if status != runtime.MachineStatusStarted {
+		machine.UpdateStatus(status)
 	}
 
 	return err
@@ -2,7 +2,10 @@ package qemuctl_actions
 
 import (
 	"fmt"
+	"net"
+	"strings"
 
+	helpers "luizpuglisi.com/qemuctl/helpers"
 	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
@@ -33,18 +36,62 @@ func (action *StatusAction) Run(arguments []string) (err error) {
 		return fmt.Errorf("invalid machine name")
 	}
 
+	/* No QEMU to ask: its state waits on disk for the next start */
+	if machine.IsSuspended() {
+		fmt.Printf("[\033[33mqemuctl\033[0m] machine '%s' is \033[33m%s\033[0m\n",
+			action.machineName, machine.Status)
+		return nil
+	}
+
 	machineStatus, err = qemuMonitor.QueryStatus()
 	if err != nil {
 		return err
 	}
 
-	if machineStatus.Return.Running {
+	if machineStatus.Running {
 		fmt.Printf("[\033[33mqemuctl\033[0m] machine '%s' is \033[32m%s\033[0m\n",
-			action.machineName, machineStatus.Return.Status)
+			action.machineName, machineStatus.Status)
 	} else {
 		fmt.Printf("[\033[33mqemuctl\033[0m] machine '%s' is \033[33m%s\033[0m\n",
-			action.machineName, machineStatus.Return.Status)
+			action.machineName, machineStatus.Status)
+	}
+
+	/* Effective forwards, "auto" ports included */
+	if machine.SSHLocalPort > 0 {
+		fmt.Printf("    ssh       %s -> 22\n", machine.GetSSHAddress())
+	}
+	for _, forward := range machine.HostForwards {
+		fmt.Printf("    forward   %s -> %d\n", formatHostForward(forward), forward.GuestPort)
 	}
 
 	return nil
 }
+
+/* formatHostForward returns the host side of forward as "[udp:][address:]port" */
+func formatHostForward(forward runtime.HostForward) (hostSide string) {
+	hostSide = fmt.Sprint(forward.HostPort)
+	if len(forward.HostAddress) > 0 {
+		hostSide = net.JoinHostPort(forward.HostAddress, hostSide)
+	}
+
+	if len(forward.Protocol) > 0 && forward.Protocol != helpers.ForwardProtocolTCP {
+		hostSide = forward.Protocol + ":" + hostSide
+	}
+
+	return hostSide
+}
+
+/* formatHostForwards returns the forwards of machine as "8080->80,udp:5353->53" */
+func formatHostForwards(machine *runtime.Machine) string {
+	var forwards []string
+
+	for _, forward := range machine.HostForwards {
+		forwards = append(forwards, fmt.Sprintf("%s->%d", formatHostForward(forward), forward.GuestPort))
+	}
+
+	if len(forwards) == 0 {
+		return "N/A"
+	}
+
+	return strings.Join(forwards, ",")
+}
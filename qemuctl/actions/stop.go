@@ -1,8 +1,11 @@
 package qemuctl_actions
 
 import (
+	"flag"
 	"fmt"
+	"time"
 
+	client "luizpuglisi.com/qemuctl/client"
 	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
@@ -13,36 +16,74 @@ func init() {
 
 type StopAction struct {
 	machineName string
+	timeout     time.Duration
+	force       bool
 }
 
 func (action *StopAction) Run(arguments []string) (err error) {
-	var machine *runtime.Machine
+	flagSet := flag.NewFlagSet("stop", flag.ContinueOnError)
+	flagSet.DurationVar(&action.timeout, "timeout", qemuctl_qemu.QemuStopDefaultTimeout,
+		"how long the guest gets to power off before QEMU is made to quit")
+	flagSet.BoolVar(&action.force, "force", false, "skip the guest powerdown")
 
-	if len(arguments) < 1 {
-		return fmt.Errorf("machine name is mandatory")
+	action.machineName, _, err = parseMachineArguments(flagSet, arguments)
+	if err != nil {
+		return err
 	}
 
-	if action.machineName = arguments[0]; len(action.machineName) == 0 {
-		return fmt.Errorf("machine name is mandatory")
-	}
+	return action.stop()
+}
+
+func (action *StopAction) stop() (err error) {
+	var machine *runtime.Machine
+	var method string
 
 	machine = runtime.NewMachine(action.machineName)
-	qemuMonitor := qemuctl_qemu.NewQemuMonitor(machine)
+	if !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", action.machineName)
+	}
 
 	fmt.Printf("[qemuctl] Stopping machine '%s'...", action.machineName)
 
-	err = qemuMonitor.SendShutdownCommand()
+	/* Supervised machines are stopped by the daemon so it won't restart them */
+	if daemonClient := client.NewClient(); machine.Supervised && daemonClient.IsRunning() {
+		machineInfo, err := daemonClient.StopMachine(action.machineName, action.timeout, action.force)
+		if err != nil {
+			fmt.Printf("\033[33m error!\033[0m\n")
+			return err
+		}
+
+		fmt.Printf("\033[32m ok!\033[0m (%s)\n", machineInfo.ExitReason)
+		return nil
+	}
+
+	method, err = qemuctl_qemu.StopMachine(machine, action.timeout, action.force)
 	if err != nil {
 		fmt.Printf("\033[33m error!\033[0m\n")
-		machine.UpdateStatus(runtime.MachineStatusDegraded)
 		return err
 	}
 
-	// Now, update machine status
-	machine.QemuPid = 0
-	machine.SSHLocalPort = 0
-	machine.UpdateStatus(runtime.MachineStatusStopped)
-	fmt.Printf("\033[32m ok!\033[0m\n")
-
+	fmt.Printf("\033[32m ok!\033[0m (%s)\n", method)
 	return nil
 }
+
+// KillAction is "stop --force": QEMU is made to quit, then signaled
+type KillAction struct {
+}
+
+func (action *KillAction) Run(arguments []string) (err error) {
+	stopAction := &StopAction{
+		force: true,
+	}
+
+	stopAction.machineName, _, err = parseMachineArguments(flag.NewFlagSet("kill", flag.ContinueOnError), arguments)
+	if err != nil {
+		return err
+	}
+
+	return stopAction.stop()
+}
@@ -0,0 +1,51 @@
+package qemuctl_actions
+
+import (
+	"flag"
+	"fmt"
+
+	client "luizpuglisi.com/qemuctl/client"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// SuspendAction saves the machine state to its runtime directory and stops
+// QEMU; the next start restores it.
+type SuspendAction struct {
+	machineName string
+}
+
+func (action *SuspendAction) Run(arguments []string) (err error) {
+	var machine *runtime.Machine
+
+	action.machineName, _, err = parseMachineArguments(flag.NewFlagSet("suspend", flag.ContinueOnError), arguments)
+	if err != nil {
+		return err
+	}
+
+	machine = runtime.NewMachine(action.machineName)
+	if machine == nil || !machine.Exists() {
+		return fmt.Errorf("machine '%s' does not exist", action.machineName)
+	}
+
+	if !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", action.machineName)
+	}
+
+	fmt.Printf("[qemuctl] suspending machine '%s'... ", action.machineName)
+
+	/* Supervised machines are suspended by the daemon so it won't restart them */
+	if daemonClient := client.NewClient(); machine.Supervised && daemonClient.IsRunning() {
+		_, err = daemonClient.SuspendMachine(action.machineName)
+	} else {
+		err = qemuctl_qemu.SuspendMachine(machine)
+	}
+
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
@@ -0,0 +1,137 @@
+package qemuctl_actions
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type TemplateAction struct {
+	templateName string
+}
+
+func (action *TemplateAction) usage() {
+	fmt.Println("usage:")
+	fmt.Println("    qemuctl template add <name> <file>")
+	fmt.Println("    qemuctl template rm <name>")
+	fmt.Println("    qemuctl template list")
+}
+
+func (action *TemplateAction) Run(arguments []string) (err error) {
+	if len(arguments) < 1 {
+		action.usage()
+		return fmt.Errorf("template command is mandatory")
+	}
+
+	if arguments[0] == "list" {
+		return action.handleList()
+	}
+
+	if len(arguments) < 2 || len(arguments[1]) == 0 {
+		action.usage()
+		return fmt.Errorf("template name is mandatory")
+	}
+	action.templateName = arguments[1]
+
+	if !helpers.IsValidName(action.templateName) {
+		return fmt.Errorf("invalid template name '%s'", action.templateName)
+	}
+
+	switch arguments[0] {
+	case "add":
+		{
+			if len(arguments) < 3 {
+				action.usage()
+				return fmt.Errorf("template file is mandatory")
+			}
+			err = action.handleAdd(arguments[2])
+		}
+	case "rm":
+		err = action.handleRemove()
+	default:
+		{
+			action.usage()
+			err = fmt.Errorf("unknown template command '%s'", arguments[0])
+		}
+	}
+
+	return err
+}
+
+func (action *TemplateAction) handleAdd(templateFile string) (err error) {
+	var templateBytes []byte
+
+	fmt.Printf("[template] adding template '%s' (%s)... ", action.templateName, templateFile)
+
+	templateBytes, err = os.ReadFile(templateFile)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	err = helpers.ValidateTemplateData(templateBytes)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	if runtime.TemplateExists(action.templateName) {
+		log.Printf("[template] replacing template '%s'", action.templateName)
+	}
+
+	err = runtime.WriteTemplate(action.templateName, templateBytes)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *TemplateAction) handleRemove() (err error) {
+	fmt.Printf("[template] removing template '%s'... ", action.templateName)
+
+	/* Machines keep a resolved copy of their config: removing is always safe for them */
+	err = runtime.RemoveTemplate(action.templateName)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
+
+func (action *TemplateAction) handleList() (err error) {
+	var templateNames []string
+
+	templateNames, err = runtime.ListTemplateNames()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-32s %-32s\n", "TEMPLATE", "EXTENDS")
+	fmt.Printf("%s\n", strings.Repeat("-", 65))
+	for _, templateName := range templateNames {
+		var header struct {
+			Extends string `yaml:"extends"`
+		}
+
+		extends := "N/A"
+		templateBytes, err := runtime.ReadTemplate(templateName)
+		if err == nil && yaml.Unmarshal(templateBytes, &header) == nil && len(header.Extends) > 0 {
+			extends = header.Extends
+		}
+
+		fmt.Printf("%-32s %-32s\n", templateName, extends)
+	}
+
+	fmt.Println("")
+	return nil
+}
@@ -0,0 +1,49 @@
+package qemuctl_actions
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+/* terminalState is what makeRaw saves, for restoreTerminal */
+type terminalState = syscall.Termios
+
+func ioctlTermios(fd uintptr, request uintptr, termios *syscall.Termios) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, fd, request, uintptr(unsafe.Pointer(termios)))
+	if errno != 0 {
+		return errno
+	}
+
+	return nil
+}
+
+/* makeRaw puts the terminal in raw mode (as cfmakeraw does) and returns the previous state */
+func makeRaw(fd uintptr) (previous *terminalState, err error) {
+	var termios syscall.Termios
+
+	err = ioctlTermios(fd, syscall.TCGETS, &termios)
+	if err != nil {
+		return nil, err
+	}
+
+	saved := termios
+	termios.Iflag &^= syscall.IGNBRK | syscall.BRKINT | syscall.PARMRK | syscall.ISTRIP |
+		syscall.INLCR | syscall.IGNCR | syscall.ICRNL | syscall.IXON
+	termios.Oflag &^= syscall.OPOST
+	termios.Lflag &^= syscall.ECHO | syscall.ECHONL | syscall.ICANON | syscall.ISIG | syscall.IEXTEN
+	termios.Cflag &^= syscall.CSIZE | syscall.PARENB
+	termios.Cflag |= syscall.CS8
+	termios.Cc[syscall.VMIN] = 1
+	termios.Cc[syscall.VTIME] = 0
+
+	err = ioctlTermios(fd, syscall.TCSETS, &termios)
+	if err != nil {
+		return nil, err
+	}
+
+	return &saved, nil
+}
+
+func restoreTerminal(fd uintptr, previous *terminalState) error {
+	return ioctlTermios(fd, syscall.TCSETS, previous)
+}
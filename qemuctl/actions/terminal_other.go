@@ -0,0 +1,19 @@
+//go:build !linux
+
+package qemuctl_actions
+
+import (
+	"fmt"
+	"runtime"
+)
+
+/* Raw mode is only implemented on Linux: elsewhere the console stays line buffered */
+type terminalState struct{}
+
+func makeRaw(fd uintptr) (previous *terminalState, err error) {
+	return nil, fmt.Errorf("raw terminal mode is not supported on %s", runtime.GOOS)
+}
+
+func restoreTerminal(fd uintptr, previous *terminalState) error {
+	return nil
+}
@@ -0,0 +1,181 @@
+package qemuctl_actions
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	TopDefaultInterval time.Duration = 2 * time.Second
+)
+
+// TopAction shows what every started machine takes from the host, refreshed
+// on an interval, or once for scripts.
+type TopAction struct {
+	machineNames []string
+	interval     time.Duration
+	once         bool
+	jsonOutput   bool
+}
+
+func (action *TopAction) Run(arguments []string) (err error) {
+	var flagSet *flag.FlagSet = flag.NewFlagSet("qemuctl top", flag.ContinueOnError)
+	var previous map[string]*qemuctl_qemu.MachineStats
+
+	flagSet.DurationVar(&action.interval, "interval", TopDefaultInterval, "time between two refreshes")
+	flagSet.BoolVar(&action.once, "once", false, "print a single sample and exit")
+	flagSet.BoolVar(&action.jsonOutput, "json", false, "print samples as JSON, one line each")
+
+	err = flagSet.Parse(arguments)
+	if err != nil {
+		return err
+	}
+
+	/* Optional machine names narrow the list */
+	action.machineNames = flagSet.Args()
+
+	if action.interval <= 0 {
+		return fmt.Errorf("invalid interval '%s'", action.interval)
+	}
+
+	/* Percentages and rates need a first sample to compare with */
+	previous = action.indexStats(action.collectStats())
+
+	for {
+		time.Sleep(action.interval)
+
+		current := action.collectStats()
+		for _, stats := range current {
+			stats.ComputeRates(previous[stats.Name])
+		}
+
+		err = action.printStats(current)
+		if err != nil || action.once {
+			return err
+		}
+
+		previous = action.indexStats(current)
+	}
+}
+
+/* collectStats samples every started machine, skipping those that cannot be queried */
+func (action *TopAction) collectStats() (samples []*qemuctl_qemu.MachineStats) {
+	var machineNames []string = action.machineNames
+
+	samples = []*qemuctl_qemu.MachineStats{}
+
+	if len(machineNames) == 0 {
+		names, err := runtime.ListMachineNames()
+		if err != nil {
+			log.Printf("[top] could not list machines: %s", err.Error())
+			return samples
+		}
+		machineNames = names
+	}
+
+	for _, machineName := range machineNames {
+		machine := runtime.NewMachine(machineName)
+		if machine == nil || !machine.Exists() || !machine.IsStarted() {
+			continue
+		}
+
+		stats, err := qemuctl_qemu.CollectStats(machine)
+		if err != nil {
+			log.Printf("[top] could not sample '%s': %s", machineName, err.Error())
+			continue
+		}
+
+		samples = append(samples, stats)
+	}
+
+	return samples
+}
+
+func (action *TopAction) indexStats(samples []*qemuctl_qemu.MachineStats) (index map[string]*qemuctl_qemu.MachineStats) {
+	index = make(map[string]*qemuctl_qemu.MachineStats)
+	for _, stats := range samples {
+		index[stats.Name] = stats
+	}
+
+	return index
+}
+
+func (action *TopAction) printStats(samples []*qemuctl_qemu.MachineStats) (err error) {
+	if action.jsonOutput {
+		jsonBytes, err := json.Marshal(samples)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(jsonBytes))
+
+		return nil
+	}
+
+	/* Redraw in place, like top does */
+	if !action.once {
+		fmt.Print("\033[H\033[2J")
+		fmt.Printf("qemuctl top - %s, every %s\n\n", time.Now().Format("15:04:05"), action.interval)
+	}
+
+	fmt.Printf("%-24s %-10s %-8s %6s %-16s %7s %7s %9s %9s %9s %9s\n",
+		"MACHINE", "STATUS", "PID", "CPU%", "VCPU%", "RSS", "BALLOON", "DISK R/s", "DISK W/s", "NET RX/s", "NET TX/s")
+	fmt.Printf("%s\n", strings.Repeat("-", 131))
+
+	for _, stats := range samples {
+		readRate, writeRate := stats.GetDiskRates()
+
+		fmt.Printf("%-24s %-10s %-8d %6.1f %-16s %7s %7s %9s %9s %9s %9s\n",
+			stats.Name, stats.Status, stats.Pid, stats.CPUPercent, formatVCPUs(stats),
+			helpers.FormatSize(stats.RSS), formatBalloon(stats),
+			helpers.FormatSize(int64(readRate)), helpers.FormatSize(int64(writeRate)),
+			formatNetworkRate(stats, true), formatNetworkRate(stats, false))
+	}
+
+	fmt.Println("")
+	return nil
+}
+
+/* formatVCPUs returns the CPU% of every vCPU thread, as "87/3" */
+func formatVCPUs(stats *qemuctl_qemu.MachineStats) string {
+	var percents []string
+
+	for _, vcpu := range stats.VCPUs {
+		percents = append(percents, fmt.Sprintf("%.0f", vcpu.CPUPercent))
+	}
+
+	if len(percents) == 0 {
+		return "N/A"
+	}
+
+	return strings.Join(percents, "/")
+}
+
+func formatBalloon(stats *qemuctl_qemu.MachineStats) string {
+	if stats.BalloonActual <= 0 {
+		return "N/A"
+	}
+
+	return helpers.FormatSize(stats.BalloonActual)
+}
+
+/* formatNetworkRate is N/A without a tap: user mode networking cannot be counted */
+func formatNetworkRate(stats *qemuctl_qemu.MachineStats, receive bool) string {
+	if len(stats.Networks) == 0 {
+		return "N/A"
+	}
+
+	rxRate, txRate := stats.GetNetworkRates()
+	if receive {
+		return helpers.FormatSize(int64(rxRate))
+	}
+
+	return helpers.FormatSize(int64(txRate))
+}
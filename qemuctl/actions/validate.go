@@ -0,0 +1,62 @@
+package qemuctl_actions
+
+import (
+	"fmt"
+	"os"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// ValidateAction checks a configuration file, or the one of an existing machine
+type ValidateAction struct {
+	configFile string
+}
+
+func (action *ValidateAction) Run(arguments []string) (err error) {
+	if len(arguments) < 1 {
+		return fmt.Errorf("usage: qemuctl validate <file|machine>")
+	}
+
+	/* A path wins over a machine with the same name */
+	action.configFile = arguments[0]
+	if _, statErr := os.Stat(action.configFile); statErr != nil {
+		machine := runtime.NewMachine(arguments[0])
+		if machine == nil || !machine.Exists() {
+			return fmt.Errorf("'%s' is neither a file nor a machine", arguments[0])
+		}
+		action.configFile = machine.ConfigFile
+	}
+
+	fmt.Printf("[validate] checking '%s'... ", action.configFile)
+
+	configData, err := helpers.NewConfigHandler(action.configFile).ValidateConfigFile()
+	if validationErrors, ok := err.(helpers.ValidationErrors); ok {
+		fmt.Println("\033[31merror!\033[0m")
+		fmt.Println()
+
+		for _, validationError := range validationErrors {
+			fmt.Printf("%s:%d: ", action.configFile, validationError.Line)
+			if len(validationError.Field) > 0 {
+				fmt.Printf("\033[1m%s\033[0m: ", validationError.Field)
+			}
+			fmt.Println(validationError.Message)
+		}
+
+		fmt.Println()
+		return fmt.Errorf("%d problem(s) found", len(validationErrors))
+	} else if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	/* Other machines count too: MACs must be unique on the segment */
+	err = helpers.CheckMacAddresses(configData, configData.Machine.MachineName)
+	if err != nil {
+		fmt.Println("\033[31merror!\033[0m")
+		return err
+	}
+
+	fmt.Println("\033[32mok!\033[0m")
+	return nil
+}
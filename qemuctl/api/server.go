@@ -0,0 +1,507 @@
+package qemuctl_api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+	supervisor "luizpuglisi.com/qemuctl/supervisor"
+)
+
+/* apiError carries the HTTP status that goes with an error */
+type apiError struct {
+	status  int
+	message string
+}
+
+func (e *apiError) Error() string {
+	return e.message
+}
+
+func newAPIError(status int, format string, args ...interface{}) *apiError {
+	return &apiError{status: status, message: fmt.Sprintf(format, args...)}
+}
+
+// Server exposes qemuctl actions over HTTP on a unix socket. Machines it
+// starts are children of its Supervisor.
+type Server struct {
+	SocketPath string
+	Supervisor *supervisor.Supervisor
+	httpServer *http.Server
+}
+
+func NewServer(daemon *supervisor.Supervisor) *Server {
+	return &Server{
+		SocketPath: runtime.GetControlSocketPath(),
+		Supervisor: daemon,
+	}
+}
+
+// Serve listens on the control socket until Close is called
+func (server *Server) Serve() (err error) {
+	var listener net.Listener
+
+	if isSocketAlive(server.SocketPath) {
+		return fmt.Errorf("a qemuctl daemon is already running on '%s'", server.SocketPath)
+	}
+	os.Remove(server.SocketPath)
+
+	listener, err = net.Listen("unix", server.SocketPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(server.SocketPath)
+
+	/* The socket gives full control over the machines: owner only */
+	os.Chmod(server.SocketPath, 0600)
+
+	server.httpServer = &http.Server{Handler: server}
+
+	log.Printf("[api] listening on '%s'", server.SocketPath)
+	server.Supervisor.AdoptMachines()
+
+	err = server.httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (server *Server) Close() {
+	if server.httpServer != nil {
+		server.httpServer.Shutdown(context.Background())
+	}
+}
+
+/*
+ * isSocketAlive tells whether something already answers on
+ * socketPath, so that a second daemon does not steal the socket.
+ */
+func isSocketAlive(socketPath string) bool {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+
+	return true
+}
+
+func (server *Server) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	var result interface{}
+	var err error
+
+	log.Printf("[api] %s %s", request.Method, request.URL.Path)
+
+	path := strings.TrimSuffix(request.URL.Path, "/")
+
+	switch {
+	case path == APIPingPath && request.Method == http.MethodGet:
+		result = &PingResponse{Version: APIVersion}
+	case path == APIMachinesPath:
+		{
+			switch request.Method {
+			case http.MethodGet:
+				result, err = server.listMachines()
+			case http.MethodPost:
+				{
+					result, err = server.createMachine(request.Body)
+					if err == nil {
+						writer.Header().Set("Content-Type", ContentTypeJSON)
+						writer.WriteHeader(http.StatusCreated)
+						json.NewEncoder(writer).Encode(result)
+						return
+					}
+				}
+			default:
+				err = newAPIError(http.StatusMethodNotAllowed, "method %s not allowed", request.Method)
+			}
+		}
+	case strings.HasPrefix(path, APIMachinesPath+"/"):
+		{
+			parts := strings.Split(strings.TrimPrefix(path, APIMachinesPath+"/"), "/")
+			result, err = server.handleMachine(writer, request, parts)
+			if err == nil && result == nil {
+				/* The handler wrote the response itself */
+				return
+			}
+		}
+	default:
+		err = newAPIError(http.StatusNotFound, "no such endpoint '%s'", request.URL.Path)
+	}
+
+	server.writeResponse(writer, result, err)
+}
+
+func (server *Server) writeResponse(writer http.ResponseWriter, result interface{}, err error) {
+	writer.Header().Set("Content-Type", ContentTypeJSON)
+
+	if err != nil {
+		status := http.StatusInternalServerError
+		if apiErr, ok := err.(*apiError); ok {
+			status = apiErr.status
+		}
+
+		log.Printf("[api] error %d: %s", status, err.Error())
+		writer.WriteHeader(status)
+		json.NewEncoder(writer).Encode(&ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	json.NewEncoder(writer).Encode(result)
+}
+
+func (server *Server) handleMachine(writer http.ResponseWriter, request *http.Request, parts []string) (result interface{}, err error) {
+	var machineName string = parts[0]
+	var operation string
+
+	if len(parts) > 2 || len(machineName) == 0 {
+		return nil, newAPIError(http.StatusNotFound, "no such endpoint '%s'", request.URL.Path)
+	}
+
+	/* Names end up in paths under ~/.qemuctl: "..", escaped or not, must not get through */
+	if !helpers.IsValidName(machineName) {
+		return nil, newAPIError(http.StatusBadRequest, "invalid machine name '%s'", machineName)
+	}
+
+	if len(parts) == 2 {
+		operation = parts[1]
+	}
+
+	switch {
+	case operation == "" && request.Method == http.MethodGet:
+		return server.getMachine(machineName)
+	case operation == "" && request.Method == http.MethodDelete:
+		return server.destroyMachine(machineName)
+	case operation == "start" && request.Method == http.MethodPost:
+		return server.startMachine(machineName)
+	case operation == "stop" && request.Method == http.MethodPost:
+		return server.stopMachine(machineName, request.Body)
+	case (operation == "pause" || operation == "resume" || operation == "reset") && request.Method == http.MethodPost:
+		return server.controlMachine(machineName, operation)
+	case operation == "suspend" && request.Method == http.MethodPost:
+		return server.suspendMachine(machineName)
+	case operation == "config" && request.Method == http.MethodGet:
+		{
+			configBytes, err := server.getConfig(machineName)
+			if err != nil {
+				return nil, err
+			}
+
+			writer.Header().Set("Content-Type", ContentTypeYAML)
+			writer.Write(configBytes)
+			return nil, nil
+		}
+	case operation == "config" && request.Method == http.MethodPut:
+		return server.setConfig(machineName, request.Body)
+	}
+
+	return nil, newAPIError(http.StatusNotFound, "no such endpoint %s '%s'", request.Method, request.URL.Path)
+}
+
+func (server *Server) loadMachine(machineName string) (machine *runtime.Machine, err error) {
+	machine = runtime.NewMachine(machineName)
+	if machine == nil {
+		return nil, newAPIError(http.StatusInternalServerError, "could not load machine '%s'", machineName)
+	}
+
+	if !machine.Exists() {
+		return nil, newAPIError(http.StatusNotFound, "machine '%s' does not exist", machineName)
+	}
+
+	return machine, nil
+}
+
+func (server *Server) listMachines() (machines []*MachineInfo, err error) {
+	var machineNames []string
+
+	machineNames, err = runtime.ListMachineNames()
+	if err != nil {
+		return nil, err
+	}
+
+	machines = make([]*MachineInfo, 0)
+	for _, machineName := range machineNames {
+		if machine := runtime.NewMachine(machineName); machine != nil {
+			machines = append(machines, NewMachineInfo(machine))
+		}
+	}
+
+	return machines, nil
+}
+
+func (server *Server) getMachine(machineName string) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	info = NewMachineInfo(machine)
+	if machine.IsStarted() {
+		status, err := qemuctl_qemu.NewQemuMonitor(machine).QueryStatus()
+		if err != nil {
+			log.Printf("[api] could not query status of '%s': %s", machineName, err.Error())
+		} else {
+			info.RunState = status.Status
+		}
+	}
+
+	return info, nil
+}
+
+func (server *Server) createMachine(body io.Reader) (info *MachineInfo, err error) {
+	var configBytes []byte
+	var configData *helpers.ConfigurationData
+	var machine *runtime.Machine
+
+	configBytes, err = io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	configData, err = helpers.ValidateConfigData(configBytes)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	machine = runtime.NewMachine(configData.Machine.MachineName)
+	if machine.Exists() {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' exists", machine.Name)
+	}
+
+	err = helpers.CheckMacAddresses(configData, machine.Name)
+	if err != nil {
+		return nil, newAPIError(http.StatusConflict, "%s", err.Error())
+	}
+
+	machine.CreateRuntime()
+	configBytes, err = helpers.ResolveConfigData(configBytes)
+	if err == nil {
+		err = machine.WriteConfigFile(configBytes)
+	}
+
+	if err == nil {
+		_, err = server.Supervisor.StartMachine(machine.Name)
+	}
+
+	/* A half-created machine would make every retry fail with "machine exists" */
+	if err != nil {
+		log.Printf("[api] cleaning up '%s'", machine.RuntimeDirectory)
+		machine.Destroy()
+		return nil, err
+	}
+
+	return server.getMachine(machine.Name)
+}
+
+func (server *Server) startMachine(machineName string) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if machine.IsStarted() {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' is already started", machineName)
+	}
+
+	if machine.IsDegraded() {
+		return nil, newAPIError(http.StatusConflict, "cannot start a degraded machine")
+	}
+
+	_, err = helpers.NewConfigHandler(machine.ConfigFile).ValidateConfigFile()
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	_, err = server.Supervisor.StartMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	return server.getMachine(machineName)
+}
+
+func (server *Server) stopMachine(machineName string, body io.Reader) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+	var stopRequest StopRequest
+	var timeout time.Duration = qemuctl_qemu.QemuStopDefaultTimeout
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !machine.IsStarted() {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' is not started", machineName)
+	}
+
+	/* An empty body keeps the defaults */
+	err = json.NewDecoder(body).Decode(&stopRequest)
+	if err != nil && err != io.EOF {
+		return nil, newAPIError(http.StatusBadRequest, "invalid stop request: %s", err.Error())
+	}
+
+	if len(stopRequest.Timeout) > 0 {
+		timeout, err = time.ParseDuration(stopRequest.Timeout)
+		if err != nil {
+			return nil, newAPIError(http.StatusBadRequest, "invalid timeout '%s'", stopRequest.Timeout)
+		}
+	}
+
+	_, err = server.Supervisor.StopMachine(machineName, timeout, stopRequest.Force)
+	if err == supervisor.ErrNotSupervised {
+		/* Started without the daemon: stop it the way the CLI does */
+		_, err = qemuctl_qemu.StopMachine(machine, timeout, stopRequest.Force)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return server.getMachine(machineName)
+}
+
+/* controlMachine pauses, resumes or resets a started machine */
+func (server *Server) controlMachine(machineName string, operation string) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !machine.IsStarted() {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' is not started", machineName)
+	}
+
+	switch operation {
+	case "pause":
+		err = qemuctl_qemu.PauseMachine(machine)
+	case "resume":
+		err = qemuctl_qemu.ResumeMachine(machine)
+	default:
+		err = qemuctl_qemu.ResetMachine(machine)
+	}
+	if err != nil {
+		return nil, newAPIError(http.StatusConflict, "%s", err.Error())
+	}
+
+	return server.getMachine(machineName)
+}
+
+func (server *Server) suspendMachine(machineName string) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if !machine.IsStarted() {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' is not started", machineName)
+	}
+
+	err = server.Supervisor.SuspendMachine(machineName)
+	if err == supervisor.ErrNotSupervised {
+		err = qemuctl_qemu.SuspendMachine(machine)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return server.getMachine(machineName)
+}
+
+func (server *Server) destroyMachine(machineName string) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if machine.IsStarted() {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' is started, cannot destroy", machineName)
+	}
+
+	user, err := helpers.FindDiskUser(machine)
+	if err != nil {
+		return nil, err
+	}
+	if len(user) > 0 {
+		return nil, newAPIError(http.StatusConflict, "machine '%s' uses disks of '%s' as backing files", user, machineName)
+	}
+
+	info = NewMachineInfo(machine)
+	if !machine.Destroy() {
+		return nil, fmt.Errorf("could not destroy machine '%s'", machineName)
+	}
+
+	return info, nil
+}
+
+func (server *Server) getConfig(machineName string) (configBytes []byte, err error) {
+	var machine *runtime.Machine
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(machine.ConfigFile)
+}
+
+func (server *Server) setConfig(machineName string, body io.Reader) (info *MachineInfo, err error) {
+	var machine *runtime.Machine
+	var configBytes []byte
+	var configData *helpers.ConfigurationData
+
+	machine, err = server.loadMachine(machineName)
+	if err != nil {
+		return nil, err
+	}
+
+	if machine.IsStarted() {
+		return nil, newAPIError(http.StatusConflict, "cannot edit a running machine ('%s' is started)", machineName)
+	}
+
+	configBytes, err = io.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+
+	configData, err = helpers.ValidateConfigData(configBytes)
+	if err != nil {
+		return nil, newAPIError(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	if configData.Machine.MachineName != machineName {
+		return nil, newAPIError(http.StatusBadRequest, "machine.name must stay '%s'", machineName)
+	}
+
+	configBytes, err = helpers.ResolveConfigData(configBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = machine.WriteConfigFile(configBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMachineInfo(machine), nil
+}
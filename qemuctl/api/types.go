@@ -0,0 +1,86 @@
+package qemuctl_api
+
+import (
+	"time"
+
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+/*
+ * qemuctl daemon serves a small HTTP+JSON API on ~/.qemuctl/qemuctl.sock:
+ *
+ *   GET    /v1/ping
+ *   GET    /v1/machines
+ *   POST   /v1/machines                  (body: YAML configuration)
+ *   GET    /v1/machines/{name}
+ *   DELETE /v1/machines/{name}
+ *   POST   /v1/machines/{name}/start
+ *   POST   /v1/machines/{name}/stop      (body: optional StopRequest)
+ *   POST   /v1/machines/{name}/pause
+ *   POST   /v1/machines/{name}/resume
+ *   POST   /v1/machines/{name}/reset
+ *   POST   /v1/machines/{name}/suspend
+ *   GET    /v1/machines/{name}/config    (YAML)
+ *   PUT    /v1/machines/{name}/config    (body: YAML configuration)
+ *
+ * Errors come back as an ErrorResponse with a matching HTTP status.
+ */
+
+const (
+	APIVersion      string = "v1"
+	APIPathPrefix   string = "/v1"
+	APIMachinesPath string = "/v1/machines"
+	APIPingPath     string = "/v1/ping"
+
+	ContentTypeJSON string = "application/json"
+	ContentTypeYAML string = "application/yaml"
+)
+
+// StopRequest tunes a stop: how long the guest gets to power off, or none
+type StopRequest struct {
+	Timeout string `json:"timeout,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error string `json:"error"`
+}
+
+type PingResponse struct {
+	Version string `json:"version"`
+}
+
+type MachineInfo struct {
+	Name         string                `json:"name"`
+	Status       string                `json:"status"`
+	RunState     string                `json:"runState,omitempty"`
+	QemuPid      int                   `json:"qemuPid,omitempty"`
+	SSHLocalPort int                   `json:"sshLocalPort,omitempty"`
+	SSHAddress   string                `json:"sshAddress,omitempty"`
+	HostForwards []runtime.HostForward `json:"hostForwards,omitempty"`
+	Supervised   bool                  `json:"supervised"`
+	Restarts     int                   `json:"restarts,omitempty"`
+	ExitReason   string                `json:"exitReason,omitempty"`
+	ExitTime     *time.Time            `json:"exitTime,omitempty"`
+}
+
+func NewMachineInfo(machine *runtime.Machine) (info *MachineInfo) {
+	info = &MachineInfo{
+		Name:         machine.Name,
+		Status:       machine.Status,
+		QemuPid:      machine.QemuPid,
+		SSHLocalPort: machine.SSHLocalPort,
+		SSHAddress:   machine.SSHAddress,
+		HostForwards: machine.HostForwards,
+		Supervised:   machine.Supervised,
+		Restarts:     machine.Restarts,
+		ExitReason:   machine.ExitReason,
+	}
+
+	if !machine.ExitTime.IsZero() {
+		exitTime := machine.ExitTime
+		info.ExitTime = &exitTime
+	}
+
+	return info
+}
@@ -0,0 +1,197 @@
+package qemuctl_client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	api "luizpuglisi.com/qemuctl/api"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	ClientDialTimeout time.Duration = 2 * time.Second
+	/* Starting a machine may provision disk images; be generous */
+	ClientRequestTimeout time.Duration = 5 * time.Minute
+
+	/* Host part of the URLs; the transport always dials the unix socket */
+	clientBaseURL string = "http://qemuctl"
+)
+
+// Client talks to the qemuctl daemon API
+type Client struct {
+	SocketPath string
+	httpClient *http.Client
+}
+
+// NewClient returns a client for the daemon socket under ~/.qemuctl
+func NewClient() *Client {
+	return NewClientWithSocket(runtime.GetControlSocketPath())
+}
+
+func NewClientWithSocket(socketPath string) *Client {
+	dialer := &net.Dialer{Timeout: ClientDialTimeout}
+
+	return &Client{
+		SocketPath: socketPath,
+		httpClient: &http.Client{
+			Timeout: ClientRequestTimeout,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _ string, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+/* do sends a request; a JSON error body becomes the returned error */
+func (client *Client) do(method string, path string, contentType string, body []byte, result interface{}) (responseBody []byte, err error) {
+	var request *http.Request
+	var response *http.Response
+
+	request, err = http.NewRequest(method, clientBaseURL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(contentType) > 0 {
+		request.Header.Set("Content-Type", contentType)
+	}
+
+	response, err = client.httpClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	responseBody, err = io.ReadAll(response.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.StatusCode >= 400 {
+		var errorResponse api.ErrorResponse
+
+		if json.Unmarshal(responseBody, &errorResponse) == nil && len(errorResponse.Error) > 0 {
+			return nil, fmt.Errorf("%s", errorResponse.Error)
+		}
+
+		return nil, fmt.Errorf("qemuctl daemon: %s", response.Status)
+	}
+
+	if result != nil {
+		err = json.Unmarshal(responseBody, result)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return responseBody, nil
+}
+
+func machinePath(machineName string, operation string) string {
+	if len(operation) > 0 {
+		return fmt.Sprintf("%s/%s/%s", api.APIMachinesPath, machineName, operation)
+	}
+
+	return fmt.Sprintf("%s/%s", api.APIMachinesPath, machineName)
+}
+
+// IsRunning tells whether a daemon answers on the socket
+func (client *Client) IsRunning() bool {
+	return client.Ping() == nil
+}
+
+func (client *Client) Ping() (err error) {
+	_, err = client.do(http.MethodGet, api.APIPingPath, "", nil, &api.PingResponse{})
+	return err
+}
+
+func (client *Client) ListMachines() (machines []api.MachineInfo, err error) {
+	_, err = client.do(http.MethodGet, api.APIMachinesPath, "", nil, &machines)
+	return machines, err
+}
+
+func (client *Client) GetMachine(machineName string) (machine *api.MachineInfo, err error) {
+	machine = &api.MachineInfo{}
+	_, err = client.do(http.MethodGet, machinePath(machineName, ""), "", nil, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+// CreateMachine creates and starts a machine from a YAML configuration
+func (client *Client) CreateMachine(configBytes []byte) (machine *api.MachineInfo, err error) {
+	machine = &api.MachineInfo{}
+	_, err = client.do(http.MethodPost, api.APIMachinesPath, api.ContentTypeYAML, configBytes, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+func (client *Client) StartMachine(machineName string) (machine *api.MachineInfo, err error) {
+	machine = &api.MachineInfo{}
+	_, err = client.do(http.MethodPost, machinePath(machineName, "start"), "", nil, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+// StopMachine stops a machine; a zero timeout keeps the daemon default
+func (client *Client) StopMachine(machineName string, timeout time.Duration, force bool) (machine *api.MachineInfo, err error) {
+	var stopRequest api.StopRequest = api.StopRequest{Force: force}
+
+	if timeout > 0 {
+		stopRequest.Timeout = timeout.String()
+	}
+
+	body, err := json.Marshal(&stopRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	machine = &api.MachineInfo{}
+	_, err = client.do(http.MethodPost, machinePath(machineName, "stop"), api.ContentTypeJSON, body, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+// SuspendMachine saves the machine state to disk and stops it
+func (client *Client) SuspendMachine(machineName string) (machine *api.MachineInfo, err error) {
+	machine = &api.MachineInfo{}
+	_, err = client.do(http.MethodPost, machinePath(machineName, "suspend"), "", nil, machine)
+	if err != nil {
+		return nil, err
+	}
+
+	return machine, nil
+}
+
+func (client *Client) DestroyMachine(machineName string) (err error) {
+	_, err = client.do(http.MethodDelete, machinePath(machineName, ""), "", nil, nil)
+	return err
+}
+
+func (client *Client) GetConfig(machineName string) (configBytes []byte, err error) {
+	return client.do(http.MethodGet, machinePath(machineName, "config"), "", nil, nil)
+}
+
+func (client *Client) SetConfig(machineName string, configBytes []byte) (err error) {
+	_, err = client.do(http.MethodPut, machinePath(machineName, "config"), api.ContentTypeYAML, configBytes, nil)
+	return err
+}
@@ -0,0 +1,168 @@
+package qemuctl_cloudinit
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	config "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	CloudInitSeedFileName     string = "cidata.iso"
+	CloudInitChecksumFileName string = "cidata.sha256"
+	CloudInitVolumeID         string = "cidata"
+	CloudInitDiskID           string = "cidata"
+)
+
+type cloudConfigUser struct {
+	Name              string   `yaml:"name"`
+	Sudo              string   `yaml:"sudo"`
+	Shell             string   `yaml:"shell"`
+	SSHAuthorizedKeys []string `yaml:"ssh_authorized_keys,omitempty"`
+}
+
+type cloudConfig struct {
+	Hostname          string        `yaml:"hostname,omitempty"`
+	Users             []interface{} `yaml:"users,omitempty"`
+	SSHAuthorizedKeys []string      `yaml:"ssh_authorized_keys,omitempty"`
+	Packages          []string      `yaml:"packages,omitempty"`
+}
+
+func GetSeedPath(machine *runtime.Machine) string {
+	return fmt.Sprintf("%s/%s", machine.RuntimeDirectory, CloudInitSeedFileName)
+}
+
+func getChecksumPath(machine *runtime.Machine) string {
+	return fmt.Sprintf("%s/%s", machine.RuntimeDirectory, CloudInitChecksumFileName)
+}
+
+/*
+ * GenerateUserData returns the raw userData when given, otherwise a
+ * #cloud-config document built from the other cloudInit fields.
+ */
+func GenerateUserData(cd *config.ConfigurationData) (userData []byte, err error) {
+	var document cloudConfig
+
+	if len(cd.CloudInit.UserData) > 0 {
+		return []byte(cd.CloudInit.UserData), nil
+	}
+
+	document.Hostname = cd.CloudInit.Hostname
+	document.Packages = cd.CloudInit.Packages
+
+	if len(cd.CloudInit.User) > 0 {
+		/* "default" keeps the distro user around */
+		document.Users = []interface{}{
+			"default",
+			cloudConfigUser{
+				Name:              cd.CloudInit.User,
+				Sudo:              "ALL=(ALL) NOPASSWD:ALL",
+				Shell:             "/bin/bash",
+				SSHAuthorizedKeys: cd.CloudInit.SSHAuthorizedKeys,
+			},
+		}
+	} else {
+		document.SSHAuthorizedKeys = cd.CloudInit.SSHAuthorizedKeys
+	}
+
+	userData, err = yaml.Marshal(&document)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte("#cloud-config\n"), userData...), nil
+}
+
+func getSeedFiles(cd *config.ConfigurationData) (files []IsoFile, err error) {
+	var userData []byte
+	var metaData string
+	var hostname string = cd.CloudInit.Hostname
+
+	userData, err = GenerateUserData(cd)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(hostname) == 0 {
+		hostname = cd.Machine.MachineName
+	}
+
+	/* A new instance-id makes cloud-init run again when the seed changes */
+	checksum := sha256.Sum256(append(userData, []byte(cd.CloudInit.NetworkConfig)...))
+	metaData = fmt.Sprintf("instance-id: %s-%s\nlocal-hostname: %s\n",
+		cd.Machine.MachineName, hex.EncodeToString(checksum[:4]), hostname)
+
+	files = []IsoFile{
+		{Name: "meta-data", Data: []byte(metaData)},
+		{Name: "user-data", Data: userData},
+	}
+
+	if len(cd.CloudInit.NetworkConfig) > 0 {
+		files = append(files, IsoFile{Name: "network-config", Data: []byte(cd.CloudInit.NetworkConfig)})
+	}
+
+	return files, nil
+}
+
+func getSeedChecksum(files []IsoFile) string {
+	hash := sha256.New()
+
+	for _, file := range files {
+		hash.Write([]byte(file.Name))
+		hash.Write([]byte{0})
+		hash.Write(file.Data)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// EnsureSeed (re)generates the NoCloud seed image of machine when cloudInit
+// is enabled and the image is missing or out of date.
+func EnsureSeed(cd *config.ConfigurationData, machine *runtime.Machine) (err error) {
+	var files []IsoFile
+	var checksum string
+
+	if !cd.CloudInit.Enabled {
+		return nil
+	}
+
+	files, err = getSeedFiles(cd)
+	if err != nil {
+		return err
+	}
+
+	checksum = getSeedChecksum(files)
+
+	if _, err = os.Stat(GetSeedPath(machine)); err == nil {
+		previous, _ := os.ReadFile(getChecksumPath(machine))
+		if strings.TrimSpace(string(previous)) == checksum {
+			log.Printf("[cloud-init] seed for '%s' is up to date", machine.Name)
+			return nil
+		}
+	}
+
+	log.Printf("[cloud-init] generating seed '%s'", GetSeedPath(machine))
+	err = WriteISO(GetSeedPath(machine), CloudInitVolumeID, files)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(getChecksumPath(machine), []byte(checksum+"\n"), 0644)
+}
+
+// GetSeedDisk returns the read-only drive that attaches the seed image
+func GetSeedDisk(machine *runtime.Machine) config.Disk {
+	return config.Disk{
+		ID:        CloudInitDiskID,
+		File:      GetSeedPath(machine),
+		Format:    config.DiskFormatRaw,
+		Interface: config.DiskInterfaceVirtioBlk,
+		ReadOnly:  true,
+	}
+}
@@ -0,0 +1,276 @@
+package qemuctl_cloudinit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+/*
+ * A minimal ISO9660 writer: a single root directory holding a few small
+ * files, with a Joliet supplementary descriptor so that the original (lower
+ * case, dashed) file names survive. That is all a NoCloud seed needs.
+ */
+
+const (
+	isoSectorSize int = 2048
+
+	/* Fixed layout; files start right after the root directories */
+	isoPrimaryDescriptorSector int = 16
+	isoJolietDescriptorSector  int = 17
+	isoTerminatorSector        int = 18
+	isoPrimaryPathTableL       int = 19
+	isoPrimaryPathTableM       int = 20
+	isoJolietPathTableL        int = 21
+	isoJolietPathTableM        int = 22
+	isoPrimaryRootSector       int = 23
+	isoJolietRootSector        int = 24
+	isoFirstFileSector         int = 25
+
+	isoPathTableSize int = 10
+)
+
+type IsoFile struct {
+	Name string
+	Data []byte
+}
+
+type isoFileExtent struct {
+	file   IsoFile
+	sector int
+}
+
+func putBothEndian32(buffer []byte, value uint32) {
+	binary.LittleEndian.PutUint32(buffer[0:4], value)
+	binary.BigEndian.PutUint32(buffer[4:8], value)
+}
+
+func putBothEndian16(buffer []byte, value uint16) {
+	binary.LittleEndian.PutUint16(buffer[0:2], value)
+	binary.BigEndian.PutUint16(buffer[2:4], value)
+}
+
+func sectorsFor(size int) int {
+	return (size + isoSectorSize - 1) / isoSectorSize
+}
+
+/* putString writes value into field, padding with spaces (or UCS-2 spaces for Joliet) */
+func putString(field []byte, value string, joliet bool) {
+	if !joliet {
+		copy(field, []byte(value+strings.Repeat(" ", len(field))))
+		return
+	}
+
+	encoded := ucs2(value)
+	for index := 0; index+1 < len(field); index += 2 {
+		if index < len(encoded) {
+			field[index] = encoded[index]
+			field[index+1] = encoded[index+1]
+		} else {
+			field[index] = 0x00
+			field[index+1] = 0x20
+		}
+	}
+}
+
+func ucs2(value string) []byte {
+	var encoded []byte
+
+	for _, unit := range utf16.Encode([]rune(value)) {
+		encoded = append(encoded, byte(unit>>8), byte(unit))
+	}
+
+	return encoded
+}
+
+/* primaryName maps a file name to an ISO9660 level 2 identifier: FILE_NAME.;1 */
+func primaryName(name string) string {
+	var mapped []rune
+
+	for _, char := range strings.ToUpper(name) {
+		if (char >= 'A' && char <= 'Z') || (char >= '0' && char <= '9') || char == '_' || char == '.' {
+			mapped = append(mapped, char)
+		} else {
+			mapped = append(mapped, '_')
+		}
+	}
+
+	if !strings.ContainsRune(string(mapped), '.') {
+		mapped = append(mapped, '.')
+	}
+
+	return string(mapped) + ";1"
+}
+
+func recordingDate(now time.Time) []byte {
+	return []byte{
+		byte(now.Year() - 1900), byte(now.Month()), byte(now.Day()),
+		byte(now.Hour()), byte(now.Minute()), byte(now.Second()), 0,
+	}
+}
+
+func volumeDate(now time.Time) []byte {
+	return append([]byte(now.Format("20060102150405")+"00"), 0)
+}
+
+func directoryRecord(identifier []byte, sector int, size int, directory bool, now time.Time) []byte {
+	var length int = 33 + len(identifier)
+
+	if len(identifier)%2 == 0 {
+		length++
+	}
+
+	record := make([]byte, length)
+	record[0] = byte(length)
+	putBothEndian32(record[2:10], uint32(sector))
+	putBothEndian32(record[10:18], uint32(size))
+	copy(record[18:25], recordingDate(now))
+	if directory {
+		record[25] = 0x02
+	}
+	putBothEndian16(record[28:32], 1)
+	record[32] = byte(len(identifier))
+	copy(record[33:], identifier)
+
+	return record
+}
+
+func pathTable(rootSector int, bigEndian bool) []byte {
+	table := make([]byte, isoPathTableSize)
+
+	table[0] = 1
+	if bigEndian {
+		binary.BigEndian.PutUint32(table[2:6], uint32(rootSector))
+		binary.BigEndian.PutUint16(table[6:8], 1)
+	} else {
+		binary.LittleEndian.PutUint32(table[2:6], uint32(rootSector))
+		binary.LittleEndian.PutUint16(table[6:8], 1)
+	}
+
+	return table
+}
+
+func rootDirectory(rootSector int, extents []isoFileExtent, joliet bool, now time.Time) (sector []byte, err error) {
+	sector = make([]byte, 0, isoSectorSize)
+
+	sector = append(sector, directoryRecord([]byte{0x00}, rootSector, isoSectorSize, true, now)...)
+	sector = append(sector, directoryRecord([]byte{0x01}, rootSector, isoSectorSize, true, now)...)
+
+	for _, extent := range extents {
+		var identifier []byte
+
+		if joliet {
+			identifier = ucs2(extent.file.Name)
+		} else {
+			identifier = []byte(primaryName(extent.file.Name))
+		}
+
+		sector = append(sector, directoryRecord(identifier, extent.sector, len(extent.file.Data), false, now)...)
+	}
+
+	if len(sector) > isoSectorSize {
+		return nil, fmt.Errorf("too many files for a single directory sector")
+	}
+
+	return sector, nil
+}
+
+func volumeDescriptor(volumeID string, totalSectors int, joliet bool, now time.Time) []byte {
+	var descriptor []byte = make([]byte, isoSectorSize)
+	var rootSector int = isoPrimaryRootSector
+	var pathTableL int = isoPrimaryPathTableL
+	var pathTableM int = isoPrimaryPathTableM
+
+	descriptor[0] = 1
+	if joliet {
+		descriptor[0] = 2
+		rootSector = isoJolietRootSector
+		pathTableL = isoJolietPathTableL
+		pathTableM = isoJolietPathTableM
+
+		/* UCS-2 level 3 escape sequence */
+		copy(descriptor[88:91], []byte("%/E"))
+	}
+
+	copy(descriptor[1:6], []byte("CD001"))
+	descriptor[6] = 1
+
+	putString(descriptor[8:40], "", joliet)
+	putString(descriptor[40:72], volumeID, joliet)
+	putBothEndian32(descriptor[80:88], uint32(totalSectors))
+	putBothEndian16(descriptor[120:124], 1)
+	putBothEndian16(descriptor[124:128], 1)
+	putBothEndian16(descriptor[128:132], uint16(isoSectorSize))
+	putBothEndian32(descriptor[132:140], uint32(isoPathTableSize))
+	binary.LittleEndian.PutUint32(descriptor[140:144], uint32(pathTableL))
+	binary.BigEndian.PutUint32(descriptor[148:152], uint32(pathTableM))
+	copy(descriptor[156:190], directoryRecord([]byte{0x00}, rootSector, isoSectorSize, true, now))
+
+	putString(descriptor[190:318], "", joliet)
+	putString(descriptor[318:446], "", joliet)
+	putString(descriptor[446:574], "", joliet)
+	putString(descriptor[574:702], "QEMUCTL", joliet)
+	putString(descriptor[702:813], "", joliet)
+
+	copy(descriptor[813:830], volumeDate(now))
+	copy(descriptor[830:847], volumeDate(now))
+	copy(descriptor[847:864], append([]byte(strings.Repeat("0", 16)), 0))
+	copy(descriptor[864:881], volumeDate(now))
+	descriptor[881] = 1
+
+	return descriptor
+}
+
+// WriteISO writes an ISO9660 image with Joliet names holding files in its
+// root directory.
+func WriteISO(filePath string, volumeID string, files []IsoFile) (err error) {
+	var extents []isoFileExtent
+	var nextSector int = isoFirstFileSector
+	var image []byte
+	var now time.Time = time.Now().UTC()
+
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+
+	for _, file := range files {
+		extents = append(extents, isoFileExtent{file: file, sector: nextSector})
+		nextSector += sectorsFor(len(file.Data))
+	}
+
+	image = make([]byte, nextSector*isoSectorSize)
+
+	copy(image[isoPrimaryDescriptorSector*isoSectorSize:], volumeDescriptor(volumeID, nextSector, false, now))
+	copy(image[isoJolietDescriptorSector*isoSectorSize:], volumeDescriptor(volumeID, nextSector, true, now))
+
+	terminator := image[isoTerminatorSector*isoSectorSize:]
+	terminator[0] = 255
+	copy(terminator[1:6], []byte("CD001"))
+	terminator[6] = 1
+
+	copy(image[isoPrimaryPathTableL*isoSectorSize:], pathTable(isoPrimaryRootSector, false))
+	copy(image[isoPrimaryPathTableM*isoSectorSize:], pathTable(isoPrimaryRootSector, true))
+	copy(image[isoJolietPathTableL*isoSectorSize:], pathTable(isoJolietRootSector, false))
+	copy(image[isoJolietPathTableM*isoSectorSize:], pathTable(isoJolietRootSector, true))
+
+	for _, joliet := range []bool{false, true} {
+		rootSector := isoPrimaryRootSector
+		if joliet {
+			rootSector = isoJolietRootSector
+		}
+
+		directory, err := rootDirectory(rootSector, extents, joliet, now)
+		if err != nil {
+			return err
+		}
+		copy(image[rootSector*isoSectorSize:], directory)
+	}
+
+	for _, extent := range extents {
+		copy(image[extent.sector*isoSectorSize:], extent.file.Data)
+	}
+
+	return os.WriteFile(filePath, image, 0644)
+}
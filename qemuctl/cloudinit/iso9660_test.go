@@ -0,0 +1,200 @@
+package qemuctl_cloudinit
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"unicode/utf16"
+)
+
+const testVolumeID string = "cidata"
+
+/* testFiles is a NoCloud seed; network-config spans several sectors */
+func testFiles() []IsoFile {
+	return []IsoFile{
+		{Name: "user-data", Data: []byte("#cloud-config\nhostname: vm0\n")},
+		{Name: "meta-data", Data: []byte("instance-id: vm0\nlocal-hostname: vm0\n")},
+		{Name: "network-config", Data: []byte("version: 2\n" + strings.Repeat("# padding\n", 500))},
+	}
+}
+
+type testRecord struct {
+	sector int
+	size   int
+	flags  byte
+}
+
+/* readBothEndian32 decodes a both-endian field, failing when its halves differ */
+func readBothEndian32(t *testing.T, field []byte, what string) int {
+	little := binary.LittleEndian.Uint32(field[0:4])
+	big := binary.BigEndian.Uint32(field[4:8])
+	if little != big {
+		t.Fatalf("%s: little endian %d, big endian %d", what, little, big)
+	}
+
+	return int(little)
+}
+
+func decodeUCS2(encoded []byte) string {
+	var units []uint16
+
+	for index := 0; index+1 < len(encoded); index += 2 {
+		units = append(units, binary.BigEndian.Uint16(encoded[index:index+2]))
+	}
+
+	return string(utf16.Decode(units))
+}
+
+func readSector(t *testing.T, image []byte, sector int) []byte {
+	if (sector+1)*isoSectorSize > len(image) {
+		t.Fatalf("sector %d is past the end of the image (%d bytes)", sector, len(image))
+	}
+
+	return image[sector*isoSectorSize : (sector+1)*isoSectorSize]
+}
+
+/* readDirectory returns the records of a directory extent by name, '.' and '..' left out */
+func readDirectory(t *testing.T, image []byte, root testRecord, joliet bool) map[string]testRecord {
+	var records map[string]testRecord = make(map[string]testRecord)
+	var directory []byte = readSector(t, image, root.sector)[:root.size]
+
+	for offset := 0; offset < len(directory) && directory[offset] > 0; {
+		record := directory[offset : offset+int(directory[offset])]
+		identifier := record[33 : 33+int(record[32])]
+		offset += len(record)
+
+		if len(identifier) == 1 && identifier[0] <= 0x01 {
+			continue
+		}
+
+		name := string(identifier)
+		if joliet {
+			name = decodeUCS2(identifier)
+		}
+
+		records[name] = testRecord{
+			sector: readBothEndian32(t, record[2:10], name+" extent"),
+			size:   readBothEndian32(t, record[10:18], name+" size"),
+			flags:  record[25],
+		}
+	}
+
+	return records
+}
+
+/* checkDescriptor checks a volume descriptor and returns the root directory record it points to */
+func checkDescriptor(t *testing.T, image []byte, sector int, descriptorType byte, joliet bool) testRecord {
+	descriptor := readSector(t, image, sector)
+
+	if descriptor[0] != descriptorType || string(descriptor[1:6]) != "CD001" || descriptor[6] != 1 {
+		t.Fatalf("sector %d: got type %d '%s' version %d, want type %d 'CD001' version 1",
+			sector, descriptor[0], descriptor[1:6], descriptor[6], descriptorType)
+	}
+
+	volumeID := strings.TrimRight(string(descriptor[40:72]), " ")
+	if joliet {
+		volumeID = strings.TrimRight(decodeUCS2(descriptor[40:72]), " ")
+		if string(descriptor[88:91]) != "%/E" {
+			t.Errorf("sector %d: got escape sequence '%s', want '%%/E'", sector, descriptor[88:91])
+		}
+	}
+	if volumeID != testVolumeID {
+		t.Errorf("sector %d: got volume id '%s', want '%s'", sector, volumeID, testVolumeID)
+	}
+
+	totalSectors := readBothEndian32(t, descriptor[80:88], "volume space size")
+	if totalSectors*isoSectorSize != len(image) {
+		t.Errorf("sector %d: volume space size is %d sectors, the image holds %d bytes", sector, totalSectors, len(image))
+	}
+
+	blockSize := binary.LittleEndian.Uint16(descriptor[128:130])
+	if int(blockSize) != isoSectorSize {
+		t.Errorf("sector %d: got logical block size %d, want %d", sector, blockSize, isoSectorSize)
+	}
+
+	root := descriptor[156:190]
+	if root[0] != 34 || root[32] != 1 || root[33] != 0x00 {
+		t.Fatalf("sector %d: malformed root directory record % x", sector, root)
+	}
+
+	return testRecord{
+		sector: readBothEndian32(t, root[2:10], "root extent"),
+		size:   readBothEndian32(t, root[10:18], "root size"),
+		flags:  root[25],
+	}
+}
+
+func TestWriteISO(t *testing.T) {
+	var isoPath string = filepath.Join(t.TempDir(), "seed.iso")
+
+	err := WriteISO(isoPath, testVolumeID, testFiles())
+	if err != nil {
+		t.Fatalf("could not write image: %s", err.Error())
+	}
+
+	image, err := os.ReadFile(isoPath)
+	if err != nil {
+		t.Fatalf("could not read image: %s", err.Error())
+	}
+
+	if len(image)%isoSectorSize != 0 {
+		t.Fatalf("image size %d is not a whole number of sectors", len(image))
+	}
+
+	terminator := readSector(t, image, isoTerminatorSector)
+	if terminator[0] != 255 || string(terminator[1:6]) != "CD001" {
+		t.Errorf("sector %d is not a volume descriptor set terminator", isoTerminatorSector)
+	}
+
+	/* Both trees must list every file, read back at its recorded extent */
+	for _, joliet := range []bool{false, true} {
+		var root testRecord
+
+		if joliet {
+			root = checkDescriptor(t, image, isoJolietDescriptorSector, 2, true)
+		} else {
+			root = checkDescriptor(t, image, isoPrimaryDescriptorSector, 1, false)
+		}
+
+		if root.flags&0x02 == 0 {
+			t.Errorf("root directory record (joliet %t) is not flagged as a directory", joliet)
+		}
+
+		records := readDirectory(t, image, root, joliet)
+		if len(records) != len(testFiles()) {
+			t.Errorf("got %d files in the root directory (joliet %t), want %d", len(records), joliet, len(testFiles()))
+		}
+
+		for _, file := range testFiles() {
+			/* Primary names are level 2 identifiers: meta-data is META_DATA.;1 */
+			name := file.Name
+			if !joliet {
+				name = strings.ToUpper(strings.ReplaceAll(file.Name, "-", "_")) + ".;1"
+			}
+
+			record, found := records[name]
+			if !found {
+				t.Errorf("no record for '%s' (joliet %t)", name, joliet)
+				continue
+			}
+
+			if record.flags&0x02 != 0 {
+				t.Errorf("'%s' (joliet %t) is flagged as a directory", name, joliet)
+			}
+
+			if record.size != len(file.Data) || (record.sector*isoSectorSize)+record.size > len(image) {
+				t.Errorf("'%s' (joliet %t): extent %d size %d does not fit %d bytes in the image",
+					name, joliet, record.sector, record.size, len(file.Data))
+				continue
+			}
+
+			data := image[record.sector*isoSectorSize : record.sector*isoSectorSize+record.size]
+			if !bytes.Equal(data, file.Data) {
+				t.Errorf("'%s' (joliet %t): content read back differs from what was written", name, joliet)
+			}
+		}
+	}
+}
@@ -0,0 +1,281 @@
+package qemuctl_exporter
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	ExporterDefaultListen string = ":9177"
+	ExporterMetricsPath   string = "/metrics"
+
+	/* Prometheus text exposition format, version 0.0.4 */
+	ContentTypeMetrics string = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+/* Every state a machine may be in, so that each gets a 0 or 1 series */
+var machineStates = []string{
+	runtime.MachineStatusStarted,
+	runtime.MachineStatusPaused,
+	runtime.MachineStatusSuspended,
+	runtime.MachineStatusStopped,
+	runtime.MachineStatusDegraded,
+	runtime.MachineStatusUnknown,
+}
+
+// Exporter serves the metrics of every machine over HTTP, for Prometheus to
+// scrape. Metrics are collected on each scrape: nothing runs in between.
+type Exporter struct {
+	Listen     string
+	httpServer *http.Server
+}
+
+func NewExporter(listen string) *Exporter {
+	return &Exporter{
+		Listen: listen,
+	}
+}
+
+// Serve listens on Listen until Close is called
+func (exporter *Exporter) Serve() (err error) {
+	var listener net.Listener
+	var mux *http.ServeMux = http.NewServeMux()
+
+	mux.HandleFunc(ExporterMetricsPath, exporter.serveMetrics)
+
+	listener, err = net.Listen("tcp", exporter.Listen)
+	if err != nil {
+		return err
+	}
+
+	exporter.httpServer = &http.Server{Handler: mux}
+
+	log.Printf("[exporter] listening on '%s'", listener.Addr().String())
+	err = exporter.httpServer.Serve(listener)
+	if err == http.ErrServerClosed {
+		return nil
+	}
+
+	return err
+}
+
+func (exporter *Exporter) Close() {
+	if exporter.httpServer != nil {
+		exporter.httpServer.Shutdown(context.Background())
+	}
+}
+
+func (exporter *Exporter) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	var metrics *metricSet = newMetricSet()
+	var start time.Time = time.Now()
+
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		http.Error(writer, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	machineNames, err := runtime.ListMachineNames()
+	if err != nil {
+		log.Printf("[exporter] could not list machines: %s", err.Error())
+	}
+
+	for _, machineName := range machineNames {
+		machine := runtime.NewMachine(machineName)
+		if machine == nil {
+			continue
+		}
+
+		collectMachine(metrics, machine)
+	}
+
+	metrics.add("qemuctl_machines", "gauge", "Number of machines managed by qemuctl.",
+		nil, float64(len(machineNames)))
+	metrics.add("qemuctl_scrape_duration_seconds", "gauge", "Time it took to collect these metrics.",
+		nil, time.Since(start).Seconds())
+
+	writer.Header().Set("Content-Type", ContentTypeMetrics)
+	metrics.write(writer)
+}
+
+/*
+ * collectMachine adds the metrics of machine. Stopped machines only have
+ * their state; started ones also get what QMP and /proc tell about them.
+ */
+func collectMachine(metrics *metricSet, machine *runtime.Machine) {
+	var labels []string = []string{"machine", machine.Name}
+	var qmpUp float64
+
+	for _, state := range machineStates {
+		value := 0.0
+		if machine.Status == state {
+			value = 1
+		}
+		metrics.add("qemuctl_machine_state", "gauge", "Current state of the machine, 1 for the state it is in.",
+			append(labels, "state", state), value)
+	}
+
+	metrics.add("qemuctl_machine_supervised", "gauge", "Whether qemuctl daemon supervises the machine.",
+		labels, boolValue(machine.Supervised))
+	metrics.add("qemuctl_machine_restarts_total", "counter", "Restarts of the machine by qemuctl daemon.",
+		labels, float64(machine.Restarts))
+
+	if configData, err := helpers.NewConfigHandler(machine.ConfigFile).ParseConfigFile(); err == nil {
+		if memory, err := helpers.ParseSize(configData.Memory); err == nil && memory > 0 {
+			metrics.add("qemuctl_machine_memory_configured_bytes", "gauge", "Guest memory in the machine configuration.",
+				labels, float64(memory))
+		}
+	}
+
+	if !machine.IsStarted() {
+		metrics.add("qemuctl_machine_qmp_up", "gauge", "Whether the QMP monitor of the machine answers.",
+			labels, 0)
+		return
+	}
+
+	if startTime, err := runtime.ReadStartTime(machine.QemuPid); err == nil {
+		metrics.add("qemuctl_machine_uptime_seconds", "gauge", "Time since QEMU started.",
+			labels, time.Since(startTime).Seconds())
+	}
+
+	stats, err := qemuctl_qemu.CollectStats(machine)
+	if err != nil {
+		log.Printf("[exporter] could not query '%s': %s", machine.Name, err.Error())
+	} else {
+		qmpUp = 1
+	}
+
+	metrics.add("qemuctl_machine_qmp_up", "gauge", "Whether the QMP monitor of the machine answers.",
+		labels, qmpUp)
+
+	/* Without QMP, /proc still tells what the process takes */
+	if stats == nil {
+		if ticks, err := runtime.ReadCPUTicks(machine.QemuPid, 0); err == nil {
+			metrics.add("qemuctl_machine_cpu_seconds_total", "counter", "CPU time used by QEMU, user and system.",
+				labels, float64(ticks)/float64(runtime.ProcClockTicksPerSecond))
+		}
+		if rss, err := runtime.ReadRSS(machine.QemuPid); err == nil {
+			metrics.add("qemuctl_machine_memory_rss_bytes", "gauge", "Resident memory of QEMU.",
+				labels, float64(rss))
+		}
+		return
+	}
+
+	metrics.add("qemuctl_machine_cpu_seconds_total", "counter", "CPU time used by QEMU, user and system.",
+		labels, stats.CPUSeconds)
+	metrics.add("qemuctl_machine_memory_rss_bytes", "gauge", "Resident memory of QEMU.",
+		labels, float64(stats.RSS))
+
+	if stats.BalloonActual > 0 {
+		metrics.add("qemuctl_machine_balloon_actual_bytes", "gauge", "Guest memory left by the balloon.",
+			labels, float64(stats.BalloonActual))
+	}
+
+	for _, vcpu := range stats.VCPUs {
+		metrics.add("qemuctl_machine_vcpu_seconds_total", "counter", "CPU time used by a vCPU thread.",
+			append(labels, "vcpu", fmt.Sprint(vcpu.Index)), vcpu.CPUSeconds)
+	}
+
+	for _, disk := range stats.Disks {
+		diskLabels := append(labels, "device", disk.Name)
+		metrics.add("qemuctl_machine_block_read_bytes_total", "counter", "Bytes read by the guest from a disk.",
+			diskLabels, float64(disk.ReadBytes))
+		metrics.add("qemuctl_machine_block_written_bytes_total", "counter", "Bytes written by the guest to a disk.",
+			diskLabels, float64(disk.WriteBytes))
+		metrics.add("qemuctl_machine_block_read_operations_total", "counter", "Read operations of the guest on a disk.",
+			diskLabels, float64(disk.ReadOperations))
+		metrics.add("qemuctl_machine_block_write_operations_total", "counter", "Write operations of the guest on a disk.",
+			diskLabels, float64(disk.WriteOperations))
+	}
+
+	for _, network := range stats.Networks {
+		networkLabels := append(labels, "interface", network.Interface)
+		metrics.add("qemuctl_machine_network_receive_bytes_total", "counter", "Bytes received by the guest on a tap interface.",
+			networkLabels, float64(network.RxBytes))
+		metrics.add("qemuctl_machine_network_transmit_bytes_total", "counter", "Bytes sent by the guest on a tap interface.",
+			networkLabels, float64(network.TxBytes))
+		metrics.add("qemuctl_machine_network_receive_packets_total", "counter", "Packets received by the guest on a tap interface.",
+			networkLabels, float64(network.RxPackets))
+		metrics.add("qemuctl_machine_network_transmit_packets_total", "counter", "Packets sent by the guest on a tap interface.",
+			networkLabels, float64(network.TxPackets))
+	}
+}
+
+func boolValue(value bool) float64 {
+	if value {
+		return 1
+	}
+
+	return 0
+}
+
+/* metricFamily is a metric with its samples, written together as the format wants */
+type metricFamily struct {
+	name    string
+	kind    string
+	help    string
+	samples []string
+}
+
+/* metricSet keeps families in the order they were first added */
+type metricSet struct {
+	families map[string]*metricFamily
+	order    []string
+}
+
+func newMetricSet() *metricSet {
+	return &metricSet{
+		families: make(map[string]*metricFamily),
+	}
+}
+
+/* add records a sample; labels are name, value pairs */
+func (metrics *metricSet) add(name string, kind string, help string, labels []string, value float64) {
+	family, found := metrics.families[name]
+	if !found {
+		family = &metricFamily{name: name, kind: kind, help: help}
+		metrics.families[name] = family
+		metrics.order = append(metrics.order, name)
+	}
+
+	family.samples = append(family.samples, fmt.Sprintf("%s%s %g", name, formatLabels(labels), value))
+}
+
+func (metrics *metricSet) write(writer io.Writer) {
+	for _, name := range metrics.order {
+		family := metrics.families[name]
+
+		fmt.Fprintf(writer, "# HELP %s %s\n", family.name, family.help)
+		fmt.Fprintf(writer, "# TYPE %s %s\n", family.name, family.kind)
+		for _, sample := range family.samples {
+			fmt.Fprintln(writer, sample)
+		}
+	}
+}
+
+/* labelEscaper escapes label values as the exposition format requires */
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+/* formatLabels returns {name="value",...}, or nothing without labels */
+func formatLabels(labels []string) string {
+	var pairs []string
+
+	for index := 0; index+1 < len(labels); index += 2 {
+		pairs = append(pairs, fmt.Sprintf(`%s="%s"`, labels[index], labelEscaper.Replace(labels[index+1])))
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
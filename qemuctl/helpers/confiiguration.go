@@ -5,17 +5,30 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"strings"
 
 	"gopkg.in/yaml.v2"
 )
 
 // ConfigurationData holds the power of the serominers
 type portForwards struct {
-	GuestPort int `yaml:"guestPort"`
-	HostPort  int `yaml:"hostPort"`
+	Protocol     string   `yaml:"protocol,omitempty"`
+	HostAddress  string   `yaml:"hostAddress,omitempty"`
+	HostPort     HostPort `yaml:"hostPort"`
+	GuestAddress string   `yaml:"guestAddress,omitempty"`
+	GuestPort    int      `yaml:"guestPort"`
+}
+
+/* guestForward sends guest connections to guestAddress:guestPort to a host chardev */
+type guestForward struct {
+	GuestAddress string `yaml:"guestAddress"`
+	GuestPort    int    `yaml:"guestPort"`
+	Target       string `yaml:"target"`
 }
 
 type ConfigurationData struct {
+	/* Template this config is based on; see ResolveConfigData */
+	Extends string `yaml:"extends,omitempty"`
 	Machine struct {
 		EnableKVM   bool   `yaml:"enableKVM"`
 		MachineName string `yaml:"name"`
@@ -34,33 +47,35 @@ type ConfigurationData struct {
 				ID         string `yaml:"id"`
 				CharDevice string `yaml:"charDevice"`
 			} `yaml:"emulator"`
-		} `yaml:"tmp"`
+		} `yaml:"tpm"`
+		/* Free PCIe root ports on q35, for "qemuctl attach" */
+		HotplugSlots int `yaml:"hotplugSlots"`
 	} `yaml:"machine"`
-	RunAsDaemon bool   `yaml:"runAsDaemon"`
-	Memory      string `yaml:"memory"`
-	CPUs        int64  `yaml:"cpus"`
-	Net         struct {
-		DeviceType string `yaml:"deviceType"`
-		User       struct {
-			ID           string         `yaml:"id"`
-			IPSubnet     string         `yaml:"ipSubnet"`
-			PortForwards []portForwards `yaml:"portForwards"`
-		} `yaml:"user"`
-		Bridge struct {
-			ID         string `yaml:"id"`
-			Interface  string `yaml:"interface"`
-			MacAddress string `yaml:"mac"`
-			Helper     string `yaml:"helper"`
-		}
-	} `yaml:"net"`
-	SSH struct {
-		LocalPort int `yaml:"localPort"`
+	RunAsDaemon   bool   `yaml:"runAsDaemon"`
+	RestartPolicy string `yaml:"restartPolicy"`
+	Memory        string `yaml:"memory"`
+	CPUs          int64  `yaml:"cpus"`
+	/* Network interfaces; see NetworkList for the older single NIC layout */
+	Net NetworkList `yaml:"net"`
+	/* Private networks, see "qemuctl network" */
+	Networks []NetworkAttachment `yaml:"networks"`
+	SSH      struct {
+		LocalPort    HostPort `yaml:"localPort"`
+		HostAddress  string   `yaml:"hostAddress"`
+		GuestAddress string   `yaml:"guestAddress"`
+		User         string   `yaml:"user"`
+		IdentityFile string   `yaml:"identityFile"`
 	} `yaml:"ssh"`
-	Disks struct {
-		BlockDevice string `yaml:"blockDevice"`
-		HardDisk    string `yaml:"hardDisk"`
-		ISOCDrom    string `yaml:"cdrom"`
-	} `yaml:"disks"`
+	Disks   DiskList `yaml:"disks"`
+	Console struct {
+		Log        bool   `yaml:"log"`
+		LogMaxSize string `yaml:"logMaxSize"`
+		LogKeep    int    `yaml:"logKeep"`
+	} `yaml:"console"`
+	/* virtio-serial channel for qemu-guest-agent, see "qemuctl guest" */
+	GuestAgent struct {
+		Enabled bool `yaml:"enabled"`
+	} `yaml:"guestAgent"`
 	Display struct {
 		EnableGraphics bool   `yaml:"enableGraphics"`
 		VGAType        string `yaml:"vgaType"`
@@ -86,6 +101,15 @@ type ConfigurationData struct {
 		EnableBootMenu bool   `yaml:"enableBootMenu"`
 		BootOrder      string `yaml:"bootOrder"`
 	} `yaml:"boot"`
+	CloudInit struct {
+		Enabled           bool     `yaml:"enabled"`
+		User              string   `yaml:"user"`
+		SSHAuthorizedKeys []string `yaml:"sshAuthorizedKeys"`
+		Hostname          string   `yaml:"hostname"`
+		Packages          []string `yaml:"packages"`
+		UserData          string   `yaml:"userData"`
+		NetworkConfig     string   `yaml:"networkConfig"`
+	} `yaml:"cloudInit"`
 	QemuBinary string `yaml:"qemuBinary"`
 }
 
@@ -108,13 +132,18 @@ func NewConfigData() (configData *ConfigurationData) {
 	configData.Machine.TPM.Passthrough.Enabled = false
 	configData.Machine.TPM.Emulator.Enabled = false
 
-	configData.Net.DeviceType = "e1000"
-
-	configData.Net.User.ID = "mynet0"
-
-	configData.Net.Bridge.ID = "mybr0"
+	/* One user NIC, unless told otherwise */
+	configData.Net = NetworkList{
+		{ID: "mynet0", Model: NetworkDefaultModel, Backend: NetworkBackendUser},
+	}
 
 	configData.RunAsDaemon = false
+	configData.RestartPolicy = "never"
+
+	/* Serial console log rotation */
+	configData.Console.Log = false
+	configData.Console.LogMaxSize = "10M"
+	configData.Console.LogKeep = 3
 
 	/* Display spec */
 	configData.Display.EnableGraphics = true
@@ -127,6 +156,12 @@ func NewConfigData() (configData *ConfigurationData) {
 	return configData
 }
 
+// HasPCIExpress tells whether the machine is a q35, where PCI devices can
+// only be hot-plugged into root ports.
+func (cd *ConfigurationData) HasPCIExpress() bool {
+	return cd.Machine.MachineType == "q35" || strings.HasPrefix(cd.Machine.MachineType, "pc-q35-")
+}
+
 /* ConfigurationHandler implementation */
 func NewConfigHandler(configFile string) (configHandler *ConfigurationHandler) {
 	return &ConfigurationHandler{
@@ -134,8 +169,7 @@ func NewConfigHandler(configFile string) (configHandler *ConfigurationHandler) {
 	}
 }
 
-func (ch *ConfigurationHandler) ParseConfigFile() (configData *ConfigurationData, err error) {
-	var configBytes []byte = nil
+func (ch *ConfigurationHandler) readConfigFile() (configBytes []byte, err error) {
 	var bufReader *bufio.Reader = nil
 
 	// Open file
@@ -149,10 +183,33 @@ func (ch *ConfigurationHandler) ParseConfigFile() (configData *ConfigurationData
 	// Read lines
 	bufReader = bufio.NewReader(fileHandle)
 
+	return io.ReadAll(bufReader)
+}
+
+func (ch *ConfigurationHandler) ParseConfigFile() (configData *ConfigurationData, err error) {
+	configBytes, err := ch.readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseConfigData(configBytes)
+}
+
+// ValidateConfigFile parses the file strictly; see ValidateConfigData
+func (ch *ConfigurationHandler) ValidateConfigFile() (configData *ConfigurationData, err error) {
+	configBytes, err := ch.readConfigFile()
+	if err != nil {
+		return nil, err
+	}
+
+	return ValidateConfigData(configBytes)
+}
+
+// ParseConfigData parses a YAML configuration on top of the defaults
+func ParseConfigData(configBytes []byte) (configData *ConfigurationData, err error) {
 	configData = NewConfigData()
-	osErr = nil
 
-	configBytes, err = io.ReadAll(bufReader)
+	configBytes, err = ResolveConfigData(configBytes)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,213 @@
+package qemuctl_helpers
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// Disk interfaces and media
+const (
+	DiskInterfaceVirtioBlk  string = "virtio-blk"
+	DiskInterfaceVirtioSCSI string = "virtio-scsi"
+	DiskInterfaceIDE        string = "ide"
+	DiskInterfaceNVMe       string = "nvme"
+	DiskInterfaceUSB        string = "usb"
+
+	DiskMediaDisk  string = "disk"
+	DiskMediaCDRom string = "cdrom"
+
+	DiskFormatRaw   string = "raw"
+	DiskFormatQcow2 string = "qcow2"
+)
+
+type DiskImage struct {
+	Size        string `yaml:"size,omitempty"`
+	BackingFile string `yaml:"backingFile,omitempty"`
+}
+
+// Disk is one drive attached to the machine. Exactly one of File or Device
+// is used; when both are empty and Image is set, qemuctl provisions the image
+// in the machine's runtime directory.
+type Disk struct {
+	ID        string    `yaml:"id,omitempty"`
+	File      string    `yaml:"file,omitempty"`
+	Device    string    `yaml:"device,omitempty"`
+	Format    string    `yaml:"format,omitempty"`
+	Interface string    `yaml:"interface,omitempty"`
+	Media     string    `yaml:"media,omitempty"`
+	Cache     string    `yaml:"cache,omitempty"`
+	AIO       string    `yaml:"aio,omitempty"`
+	Discard   bool      `yaml:"discard,omitempty"`
+	ReadOnly  bool      `yaml:"readOnly,omitempty"`
+	BootIndex *int      `yaml:"bootIndex,omitempty"`
+	Image     DiskImage `yaml:"image,omitempty"`
+}
+
+type DiskList []Disk
+
+/* legacyDisks is the single-disk layout used before disks became a list */
+type legacyDisks struct {
+	BlockDevice string `yaml:"blockDevice"`
+	HardDisk    string `yaml:"hardDisk"`
+	ISOCDrom    string `yaml:"cdrom"`
+	Image       struct {
+		Size        string `yaml:"size"`
+		Format      string `yaml:"format"`
+		BackingFile string `yaml:"backingFile"`
+	} `yaml:"image"`
+}
+
+func (disks *DiskList) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var diskList []Disk
+	var legacy legacyDisks
+	var raw interface{}
+
+	/* Look before decoding, see NetworkList.UnmarshalYAML */
+	if err = unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, isList := raw.([]interface{}); isList || raw == nil {
+		/* Type errors, unknown keys included, leave the rest decoded: keep it to validate */
+		err = unmarshal(&diskList)
+		if _, isTypeError := err.(*yaml.TypeError); err != nil && !isTypeError {
+			return err
+		}
+
+		*disks = diskList
+		return err
+	}
+
+	/* An older config file, with disks as a map */
+	if err = unmarshal(&legacy); err != nil {
+		return err
+	}
+
+	diskList = make([]Disk, 0)
+	if len(legacy.BlockDevice) > 0 {
+		diskList = append(diskList, Disk{
+			ID:     "xvda",
+			Device: legacy.BlockDevice,
+			Format: DiskFormatRaw,
+		})
+	} else if len(legacy.HardDisk) > 0 || len(legacy.Image.Size) > 0 || len(legacy.Image.BackingFile) > 0 {
+		diskList = append(diskList, Disk{
+			ID:     "disk",
+			File:   legacy.HardDisk,
+			Format: legacy.Image.Format,
+			Image: DiskImage{
+				Size:        legacy.Image.Size,
+				BackingFile: legacy.Image.BackingFile,
+			},
+		})
+	}
+
+	if len(legacy.ISOCDrom) > 0 {
+		diskList = append(diskList, Disk{
+			ID:    "cdrom",
+			File:  legacy.ISOCDrom,
+			Media: DiskMediaCDRom,
+		})
+	}
+
+	*disks = diskList
+	return nil
+}
+
+func (disk *Disk) IsCDRom() bool {
+	return disk.Media == DiskMediaCDRom
+}
+
+// HasMedium tells whether the disk has an image; a cdrom drive may be empty
+func (disk *Disk) HasMedium() bool {
+	return len(disk.File) > 0 || len(disk.Device) > 0 || disk.IsProvisioned()
+}
+
+// IsProvisioned tells whether qemuctl creates the disk image itself
+func (disk *Disk) IsProvisioned() bool {
+	return len(disk.File) == 0 && len(disk.Device) == 0 &&
+		(len(disk.Image.Size) > 0 || len(disk.Image.BackingFile) > 0)
+}
+
+/*
+ * GetFormat returns the configured format or guesses it: provisioned images
+ * are always qcow2, other files are qcow2 only if they say so.
+ */
+func (disk *Disk) GetFormat() string {
+	if len(disk.Format) > 0 {
+		return disk.Format
+	}
+
+	if disk.IsProvisioned() || strings.HasSuffix(disk.File, ".qcow2") {
+		return DiskFormatQcow2
+	}
+
+	return DiskFormatRaw
+}
+
+func (disk *Disk) GetInterface() string {
+	if len(disk.Interface) > 0 {
+		return disk.Interface
+	}
+
+	if disk.IsCDRom() {
+		return DiskInterfaceIDE
+	}
+
+	return DiskInterfaceVirtioBlk
+}
+
+// GetID returns the disk node name, defaulting to disk<index>
+func (disk *Disk) GetID(index int) string {
+	if len(disk.ID) > 0 {
+		return disk.ID
+	}
+
+	return fmt.Sprintf("disk%d", index)
+}
+
+/*
+ * FindDiskUser returns a machine whose disks live in the runtime directory
+ * of machine, overlays made by "qemuctl clone" included: they record the
+ * absolute path of their backing file. Writing to or removing those images
+ * would corrupt that machine.
+ */
+func FindDiskUser(machine *runtime.Machine) (machineName string, err error) {
+	var prefix string = machine.RuntimeDirectory + "/"
+
+	machineNames, err := runtime.ListMachineNames()
+	if err != nil {
+		return "", err
+	}
+
+	for _, otherName := range machineNames {
+		if otherName == machine.Name {
+			continue
+		}
+
+		other := runtime.NewMachine(otherName)
+		if other == nil {
+			continue
+		}
+
+		configData, err := NewConfigHandler(other.ConfigFile).ParseConfigFile()
+		if err != nil {
+			log.Printf("[disks] skipping '%s': %s", otherName, err.Error())
+			continue
+		}
+
+		for _, disk := range configData.Disks {
+			for _, path := range []string{disk.File, disk.Device, disk.Image.BackingFile} {
+				if strings.HasPrefix(path, prefix) {
+					return otherName, nil
+				}
+			}
+		}
+	}
+
+	return "", nil
+}
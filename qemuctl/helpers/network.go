@@ -0,0 +1,392 @@
+package qemuctl_helpers
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+/* Locally administered MACs in the range QEMU uses for its own defaults */
+const QemuMacPrefix string = "52:54:00"
+
+// Network interface backends and defaults
+const (
+	NetworkBackendUser      string = "user"
+	NetworkBackendBridge    string = "bridge"
+	NetworkBackendTap       string = "tap"
+	NetworkBackendSocket    string = "socket"
+	NetworkBackendVhostUser string = "vhost-user"
+
+	NetworkDefaultModel string = "e1000"
+)
+
+// UserNetwork is a SLIRP backend: NAT to the host, with port forwards
+type UserNetwork struct {
+	IPSubnet      string         `yaml:"ipSubnet,omitempty"`
+	PortForwards  []portForwards `yaml:"portForwards,omitempty"`
+	Hostname      string         `yaml:"hostname,omitempty"`
+	DNSSearch     []string       `yaml:"dnsSearch,omitempty"`
+	Restrict      bool           `yaml:"restrict,omitempty"`
+	GuestForwards []guestForward `yaml:"guestForwards,omitempty"`
+}
+
+// BridgeNetwork plugs the interface into a host bridge through the helper
+type BridgeNetwork struct {
+	Interface string `yaml:"interface,omitempty"`
+	Helper    string `yaml:"helper,omitempty"`
+}
+
+// TapNetwork uses a host tap device, set up by the ifup script if any
+type TapNetwork struct {
+	IfName     string `yaml:"ifname,omitempty"`
+	Script     string `yaml:"script,omitempty"`
+	DownScript string `yaml:"downScript,omitempty"`
+	VHost      bool   `yaml:"vhost,omitempty"`
+}
+
+// SocketNetwork links machines together: a multicast group or a UDP tunnel
+type SocketNetwork struct {
+	Mcast        string `yaml:"mcast,omitempty"`
+	UDP          string `yaml:"udp,omitempty"`
+	LocalAddress string `yaml:"localAddress,omitempty"`
+}
+
+// VhostUserNetwork hands the interface to a vhost-user switch (OVS-DPDK, ...)
+type VhostUserNetwork struct {
+	Socket string `yaml:"socket,omitempty"`
+	Server bool   `yaml:"server,omitempty"`
+}
+
+// NetworkInterface is one NIC of the machine: a device model and a backend
+type NetworkInterface struct {
+	ID         string           `yaml:"id,omitempty"`
+	Model      string           `yaml:"model,omitempty"`
+	MacAddress string           `yaml:"mac,omitempty"`
+	Backend    string           `yaml:"backend,omitempty"`
+	User       UserNetwork      `yaml:"user,omitempty"`
+	Bridge     BridgeNetwork    `yaml:"bridge,omitempty"`
+	Tap        TapNetwork       `yaml:"tap,omitempty"`
+	Socket     SocketNetwork    `yaml:"socket,omitempty"`
+	VhostUser  VhostUserNetwork `yaml:"vhostUser,omitempty"`
+}
+
+type NetworkList []NetworkInterface
+
+// NetworkAttachment joins the machine to a network made with "qemuctl network create"
+type NetworkAttachment struct {
+	Name  string `yaml:"name"`
+	Model string `yaml:"model,omitempty"`
+}
+
+/* Interfaces on a network are named after it */
+const NetworkAttachmentIDPrefix string = "vnet-"
+
+/* legacyNetwork is the user NIC plus optional bridge layout used before net became a list */
+type legacyNetwork struct {
+	DeviceType string `yaml:"deviceType"`
+	User       struct {
+		ID          string `yaml:"id"`
+		UserNetwork `yaml:",inline"`
+	} `yaml:"user"`
+	Bridge struct {
+		ID            string `yaml:"id"`
+		MacAddress    string `yaml:"mac"`
+		BridgeNetwork `yaml:",inline"`
+	} `yaml:"bridge"`
+}
+
+func (networks *NetworkList) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var networkList []NetworkInterface
+	var legacy legacyNetwork
+	var raw interface{}
+
+	/*
+	 * Look before decoding: yaml.v2 reuses the error slice of a failed
+	 * attempt, so trying both layouts would lose the first error.
+	 */
+	if err = unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if _, isList := raw.([]interface{}); isList || raw == nil {
+		/* Type errors, unknown keys included, leave the rest decoded: keep it to validate */
+		err = unmarshal(&networkList)
+		if _, isTypeError := err.(*yaml.TypeError); err != nil && !isTypeError {
+			return err
+		}
+
+		*networks = networkList
+		return err
+	}
+
+	/* An older config file, with net as a map */
+	if err = unmarshal(&legacy); err != nil {
+		return err
+	}
+
+	if len(legacy.DeviceType) == 0 {
+		legacy.DeviceType = NetworkDefaultModel
+	}
+	if len(legacy.User.ID) == 0 {
+		legacy.User.ID = "mynet0"
+	}
+
+	networkList = []NetworkInterface{{
+		ID:      legacy.User.ID,
+		Model:   legacy.DeviceType,
+		Backend: NetworkBackendUser,
+		User:    legacy.User.UserNetwork,
+	}}
+
+	if len(legacy.Bridge.Interface) > 0 {
+		if len(legacy.Bridge.ID) == 0 {
+			legacy.Bridge.ID = "mybr0"
+		}
+
+		networkList = append(networkList, NetworkInterface{
+			ID:         legacy.Bridge.ID,
+			Model:      legacy.DeviceType,
+			MacAddress: legacy.Bridge.MacAddress,
+			Backend:    NetworkBackendBridge,
+			Bridge:     legacy.Bridge.BridgeNetwork,
+		})
+	}
+
+	*networks = networkList
+	return nil
+}
+
+/* UnmarshalYAML takes a plain network name as well as a mapping */
+func (attachment *NetworkAttachment) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	type plainAttachment NetworkAttachment
+	var raw interface{}
+
+	if err = unmarshal(&raw); err != nil {
+		return err
+	}
+
+	if name, isName := raw.(string); isName {
+		attachment.Name = name
+		return nil
+	}
+
+	return unmarshal((*plainAttachment)(attachment))
+}
+
+func (attachment *NetworkAttachment) GetID() string {
+	return NetworkAttachmentIDPrefix + attachment.Name
+}
+
+// GetNetworkMacAddress returns the MAC of machineName on networkName: the same
+// on every start, and different for every machine.
+func GetNetworkMacAddress(machineName string, networkName string) string {
+	sum := sha256.Sum256([]byte(machineName + "/" + networkName))
+
+	return fmt.Sprintf("%s:%02x:%02x:%02x", QemuMacPrefix, sum[0], sum[1], sum[2])
+}
+
+/*
+ * AttachNetworks adds an interface to cd for every network it joins, on the
+ * multicast group of that network. Call it on a freshly parsed config, before
+ * building the QEMU command line.
+ */
+func AttachNetworks(cd *ConfigurationData) (err error) {
+	for index := range cd.Networks {
+		nic, err := cd.Networks[index].GetInterface(cd.Machine.MachineName)
+		if err != nil {
+			return err
+		}
+
+		cd.Net = append(cd.Net, nic)
+	}
+
+	return nil
+}
+
+// GetInterface returns the interface machineName joins the network with
+func (attachment *NetworkAttachment) GetInterface(machineName string) (nic NetworkInterface, err error) {
+	network, err := runtime.ReadNetwork(attachment.Name)
+	if err != nil {
+		return nic, err
+	}
+
+	return NetworkInterface{
+		ID:         attachment.GetID(),
+		Model:      attachment.Model,
+		MacAddress: GetNetworkMacAddress(machineName, attachment.Name),
+		Backend:    NetworkBackendSocket,
+		Socket: SocketNetwork{
+			Mcast:        network.GetMcastAddress(),
+			LocalAddress: network.LocalAddress,
+		},
+	}, nil
+}
+
+// GetNetworkMachines maps every network to the machines joining it
+func GetNetworkMachines() (networkMachines map[string][]string) {
+	networkMachines = make(map[string][]string)
+
+	machineNames, err := runtime.ListMachineNames()
+	if err != nil {
+		log.Printf("[network] could not list machines: %s", err.Error())
+		return networkMachines
+	}
+
+	for _, machineName := range machineNames {
+		machine := runtime.NewMachine(machineName)
+		if machine == nil {
+			continue
+		}
+
+		configData, err := NewConfigHandler(machine.ConfigFile).ParseConfigFile()
+		if err != nil {
+			log.Printf("[network] skipping '%s': %s", machineName, err.Error())
+			continue
+		}
+
+		for _, attachment := range configData.Networks {
+			networkMachines[attachment.Name] = append(networkMachines[attachment.Name], machineName)
+		}
+	}
+
+	return networkMachines
+}
+
+// GetID returns the netdev id, defaulting to net<index>
+func (nic *NetworkInterface) GetID(index int) string {
+	if len(nic.ID) > 0 {
+		return nic.ID
+	}
+
+	return fmt.Sprintf("net%d", index)
+}
+
+func (nic *NetworkInterface) GetModel() string {
+	if len(nic.Model) > 0 {
+		return nic.Model
+	}
+
+	return NetworkDefaultModel
+}
+
+func (nic *NetworkInterface) GetBackend() string {
+	if len(nic.Backend) > 0 {
+		return nic.Backend
+	}
+
+	return NetworkBackendUser
+}
+
+func (nic *NetworkInterface) IsUser() bool {
+	return nic.GetBackend() == NetworkBackendUser
+}
+
+// GetSSHInterface returns the user NIC carrying the SSH forward: the first one
+func (networks NetworkList) GetSSHInterface() *NetworkInterface {
+	for index := range networks {
+		if networks[index].IsUser() {
+			return &networks[index]
+		}
+	}
+
+	return nil
+}
+
+// HasVhostUser tells whether guest memory must be shared with a vhost-user backend
+func (networks NetworkList) HasVhostUser() bool {
+	for index := range networks {
+		if networks[index].GetBackend() == NetworkBackendVhostUser {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RandomMacAddress returns a new 52:54:00:xx:xx:xx address
+func RandomMacAddress() (mac string, err error) {
+	var suffix []byte = make([]byte, 3)
+
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s:%02x:%02x:%02x", QemuMacPrefix, suffix[0], suffix[1], suffix[2]), nil
+}
+
+/* normalizeMacAddress makes "52:54:00:AB:..." and "52-54-00-ab-..." compare equal */
+func normalizeMacAddress(mac string) string {
+	if hardwareAddr, err := net.ParseMAC(mac); err == nil {
+		return hardwareAddr.String()
+	}
+
+	return strings.ToLower(mac)
+}
+
+/*
+ * CheckMacAddresses fails when a MAC of cd is already set on an interface of
+ * another machine: guests sharing a segment would fight over it.
+ */
+func CheckMacAddresses(cd *ConfigurationData, machineName string) (err error) {
+	var macUsers map[string]string = make(map[string]string)
+
+	machineNames, err := runtime.ListMachineNames()
+	if err != nil {
+		log.Printf("[network] could not list machines: %s", err.Error())
+		return nil
+	}
+
+	for _, otherName := range machineNames {
+		if otherName == machineName {
+			continue
+		}
+
+		other := runtime.NewMachine(otherName)
+		if other == nil {
+			continue
+		}
+
+		configData, err := NewConfigHandler(other.ConfigFile).ParseConfigFile()
+		if err != nil {
+			log.Printf("[network] skipping '%s': %s", otherName, err.Error())
+			continue
+		}
+
+		for mac := range getMacAddresses(configData) {
+			macUsers[mac] = otherName
+		}
+	}
+
+	for mac, netID := range getMacAddresses(cd) {
+		if otherName, found := macUsers[mac]; found {
+			return fmt.Errorf("mac address %s of interface '%s' is already used by machine '%s'",
+				mac, netID, otherName)
+		}
+	}
+
+	return nil
+}
+
+/* getMacAddresses maps the MACs set on cd, networks included, to their interface */
+func getMacAddresses(cd *ConfigurationData) (macAddresses map[string]string) {
+	macAddresses = make(map[string]string)
+
+	for index, nic := range cd.Net {
+		if len(nic.MacAddress) > 0 {
+			macAddresses[normalizeMacAddress(nic.MacAddress)] = nic.GetID(index)
+		}
+	}
+
+	for _, attachment := range cd.Networks {
+		macAddresses[GetNetworkMacAddress(cd.Machine.MachineName, attachment.Name)] = attachment.GetID()
+	}
+
+	return macAddresses
+}
@@ -0,0 +1,362 @@
+package qemuctl_helpers
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	HostPortAuto        HostPort = -1
+	HostPortAutoKeyword string   = "auto"
+
+	ForwardProtocolTCP string = "tcp"
+	ForwardProtocolUDP string = "udp"
+
+	/* Where "auto" ports are looked for: SSH from 2222, forwards from guest port + 10000 */
+	AutoSSHPortBase       int = 2222
+	AutoForwardPortOffset int = 10000
+	AutoForwardPortBase   int = 20000
+)
+
+// HostPort is a port number or "auto", resolved to a free port at start
+type HostPort int
+
+func (port HostPort) IsAuto() bool {
+	return port == HostPortAuto
+}
+
+func (port *HostPort) UnmarshalYAML(unmarshal func(interface{}) error) (err error) {
+	var keyword string
+	var number int
+
+	if unmarshal(&keyword) == nil && keyword == HostPortAutoKeyword {
+		*port = HostPortAuto
+		return nil
+	}
+
+	err = unmarshal(&number)
+	if err != nil {
+		return err
+	}
+
+	*port = HostPort(number)
+	return nil
+}
+
+func (port HostPort) MarshalYAML() (interface{}, error) {
+	if port.IsAuto() {
+		return HostPortAutoKeyword, nil
+	}
+
+	return int(port), nil
+}
+
+func (port HostPort) String() string {
+	if port.IsAuto() {
+		return HostPortAutoKeyword
+	}
+
+	return strconv.Itoa(int(port))
+}
+
+// GetProtocol returns the forward protocol, tcp unless told otherwise
+func (forward *portForwards) GetProtocol() string {
+	if len(forward.Protocol) > 0 {
+		return forward.Protocol
+	}
+
+	return ForwardProtocolTCP
+}
+
+// GetPortForwards returns the port forwards of every user NIC, ready to update
+func (networks NetworkList) GetPortForwards() (forwards []*portForwards) {
+	for index := range networks {
+		if !networks[index].IsUser() {
+			continue
+		}
+
+		for forwardIndex := range networks[index].User.PortForwards {
+			forwards = append(forwards, &networks[index].User.PortForwards[forwardIndex])
+		}
+	}
+
+	return forwards
+}
+
+// GetConnectAddress returns the address host clients use to reach a port
+// bound to hostAddress: loopback when it is bound to every interface.
+func GetConnectAddress(hostAddress string) string {
+	if ip := net.ParseIP(hostAddress); ip == nil || ip.IsUnspecified() {
+		return "127.0.0.1"
+	}
+
+	return hostAddress
+}
+
+// IsPortAvailable tells whether a port can be bound on the host right now.
+// An empty address means every interface.
+func IsPortAvailable(protocol string, address string, port int) bool {
+	var hostPort string = net.JoinHostPort(address, strconv.Itoa(port))
+
+	if protocol == ForwardProtocolUDP {
+		conn, err := net.ListenPacket("udp", hostPort)
+		if err != nil {
+			return false
+		}
+
+		conn.Close()
+		return true
+	}
+
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return false
+	}
+
+	listener.Close()
+	return true
+}
+
+// FindFreePort returns the first port from start on that is neither in used
+// nor bound on the host.
+func FindFreePort(protocol string, address string, start int, used map[int]bool) (port int, err error) {
+	if start < 1024 {
+		start = 1024
+	}
+
+	for port = start; port <= 65535; port++ {
+		if !used[port] && IsPortAvailable(protocol, address, port) {
+			return port, nil
+		}
+	}
+
+	return 0, fmt.Errorf("no free %s port from %d on", protocol, start)
+}
+
+// GetConfiguredHostPorts returns the fixed host ports cd forwards to the guest
+func GetConfiguredHostPorts(cd *ConfigurationData) (ports []int) {
+	if cd.SSH.LocalPort > 0 {
+		ports = append(ports, int(cd.SSH.LocalPort))
+	}
+
+	for _, forward := range cd.Net.GetPortForwards() {
+		if forward.HostPort > 0 {
+			ports = append(ports, int(forward.HostPort))
+		}
+	}
+
+	return ports
+}
+
+// GetHostForwards returns the port forwards of cd, once ports are allocated
+func GetHostForwards(cd *ConfigurationData) (forwards []runtime.HostForward) {
+	for _, forward := range cd.Net.GetPortForwards() {
+		forwards = append(forwards, runtime.HostForward{
+			Protocol:    forward.GetProtocol(),
+			HostAddress: forward.HostAddress,
+			HostPort:    int(forward.HostPort),
+			GuestPort:   forward.GuestPort,
+		})
+	}
+
+	return forwards
+}
+
+/* portKey tells tcp and udp ports apart: they do not conflict with each other */
+func portKey(protocol string, port int) string {
+	return fmt.Sprintf("%s/%d", protocol, port)
+}
+
+/*
+ * getHostPortUsers maps the host ports of every machine but machineName to
+ * that machine: the ports started machines actually use (by protocol), and
+ * the fixed ports stopped ones will want.
+ */
+func getHostPortUsers(machineName string) (started map[string]string, reserved map[int]string) {
+	started = make(map[string]string)
+	reserved = make(map[int]string)
+
+	machineNames, err := runtime.ListMachineNames()
+	if err != nil {
+		log.Printf("[ports] could not list machines: %s", err.Error())
+		return started, reserved
+	}
+
+	for _, otherName := range machineNames {
+		if otherName == machineName {
+			continue
+		}
+
+		other := runtime.NewMachine(otherName)
+		if other == nil {
+			continue
+		}
+
+		if other.IsStarted() {
+			if other.SSHLocalPort > 0 {
+				started[portKey(ForwardProtocolTCP, other.SSHLocalPort)] = otherName
+				reserved[other.SSHLocalPort] = otherName
+			}
+			for _, forward := range other.HostForwards {
+				started[portKey(forward.Protocol, forward.HostPort)] = otherName
+				reserved[forward.HostPort] = otherName
+			}
+			continue
+		}
+
+		configData, err := NewConfigHandler(other.ConfigFile).ParseConfigFile()
+		if err != nil {
+			log.Printf("[ports] skipping '%s': %s", otherName, err.Error())
+			continue
+		}
+
+		for _, port := range GetConfiguredHostPorts(configData) {
+			reserved[port] = otherName
+		}
+	}
+
+	return started, reserved
+}
+
+// GetUsedHostPorts returns the host ports taken or wanted by every machine
+// but machineName, whatever their protocol.
+func GetUsedHostPorts(machineName string) (used map[int]bool) {
+	used = make(map[int]bool)
+
+	_, reserved := getHostPortUsers(machineName)
+	for port := range reserved {
+		used[port] = true
+	}
+
+	return used
+}
+
+/*
+ * getOwnHostPorts returns the ports machineName holds while started, and
+ * resolves the "auto" ports of cd to them: the command line of a running
+ * machine is the one it got, and its ports are busy on the host because of it.
+ */
+func getOwnHostPorts(cd *ConfigurationData, machineName string) (owned map[string]bool) {
+	owned = make(map[string]bool)
+
+	machine := runtime.NewMachine(machineName)
+	if machine == nil || !machine.IsStarted() {
+		return owned
+	}
+
+	if machine.SSHLocalPort > 0 {
+		owned[portKey(ForwardProtocolTCP, machine.SSHLocalPort)] = true
+		if cd.SSH.LocalPort.IsAuto() {
+			cd.SSH.LocalPort = HostPort(machine.SSHLocalPort)
+		}
+	}
+
+	for _, recorded := range machine.HostForwards {
+		owned[portKey(recorded.Protocol, recorded.HostPort)] = true
+
+		for _, forward := range cd.Net.GetPortForwards() {
+			if forward.HostPort.IsAuto() && forward.GetProtocol() == recorded.Protocol &&
+				forward.GuestPort == recorded.GuestPort && forward.HostAddress == recorded.HostAddress {
+				forward.HostPort = HostPort(recorded.HostPort)
+				break
+			}
+		}
+	}
+
+	return owned
+}
+
+/* checkHostPort fails when port is used by another started machine or on the host, unless owned */
+func checkHostPort(protocol string, address string, port int, started map[string]string, owned map[string]bool) (err error) {
+	if otherName, found := started[portKey(protocol, port)]; found {
+		return fmt.Errorf("host port %s/%d is already used by machine '%s'", protocol, port, otherName)
+	}
+
+	if owned[portKey(protocol, port)] {
+		return nil
+	}
+
+	if !IsPortAvailable(protocol, address, port) {
+		return fmt.Errorf("host port %s/%d is already in use on the host", protocol, port)
+	}
+
+	return nil
+}
+
+/*
+ * AllocateHostPorts prepares the port forwards of machineName before QEMU
+ * runs: fixed ports must not be used by another started machine nor by the
+ * host, "auto" ones get a free port. cd is updated with the ports to use;
+ * a started machine keeps the ones it has.
+ */
+func AllocateHostPorts(cd *ConfigurationData, machineName string) (err error) {
+	var used map[int]bool = make(map[int]bool)
+
+	owned := getOwnHostPorts(cd, machineName)
+	started, reserved := getHostPortUsers(machineName)
+	for port := range reserved {
+		used[port] = true
+	}
+
+	/* Fixed ports first, so that "auto" ones keep away from them */
+	if cd.SSH.LocalPort > 0 {
+		err = checkHostPort(ForwardProtocolTCP, cd.SSH.HostAddress, int(cd.SSH.LocalPort), started, owned)
+		if err != nil {
+			return err
+		}
+		used[int(cd.SSH.LocalPort)] = true
+	}
+
+	for _, forward := range cd.Net.GetPortForwards() {
+		if forward.HostPort <= 0 {
+			continue
+		}
+
+		err = checkHostPort(forward.GetProtocol(), forward.HostAddress, int(forward.HostPort), started, owned)
+		if err != nil {
+			return err
+		}
+
+		if otherName, found := reserved[int(forward.HostPort)]; found {
+			log.Printf("[ports] host port %d is also configured for '%s'", forward.HostPort, otherName)
+		}
+		used[int(forward.HostPort)] = true
+	}
+
+	if cd.SSH.LocalPort.IsAuto() {
+		port, err := FindFreePort(ForwardProtocolTCP, cd.SSH.HostAddress, AutoSSHPortBase, used)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[ports] ssh: allocated host port %d", port)
+		cd.SSH.LocalPort = HostPort(port)
+		used[port] = true
+	}
+
+	for _, forward := range cd.Net.GetPortForwards() {
+		if !forward.HostPort.IsAuto() {
+			continue
+		}
+
+		start := forward.GuestPort + AutoForwardPortOffset
+		if start > 65535 {
+			start = AutoForwardPortBase
+		}
+
+		port, err := FindFreePort(forward.GetProtocol(), forward.HostAddress, start, used)
+		if err != nil {
+			return err
+		}
+
+		log.Printf("[ports] %s guest port %d: allocated host port %d", forward.GetProtocol(), forward.GuestPort, port)
+		forward.HostPort = HostPort(port)
+		used[port] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,28 @@
+package qemuctl_helpers
+
+import (
+	"strings"
+)
+
+/* Characters that never need quoting in a POSIX shell word */
+const shellSafeCharacters string = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789@%+=:,./_-"
+
+// ShellQuote quotes word so that a POSIX shell reads it back unchanged
+func ShellQuote(word string) string {
+	if len(word) > 0 && strings.Trim(word, shellSafeCharacters) == "" {
+		return word
+	}
+
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// ShellJoin quotes every word and joins them into a single command line
+func ShellJoin(words []string) string {
+	var quoted []string = make([]string, 0, len(words))
+
+	for _, word := range words {
+		quoted = append(quoted, ShellQuote(word))
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -0,0 +1,249 @@
+package qemuctl_helpers
+
+import (
+	"fmt"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	ConfigExtendsKey string = "extends"
+	/* Protects against templates extending each other in a loop */
+	ConfigMaxTemplateDepth int = 8
+)
+
+/*
+ * ResolveConfigData follows the "extends" chain of a config: every template
+ * is deep merged under the keys of the document extending it. Mappings merge
+ * key by key, anything else (scalars, lists) is replaced. Documents without
+ * "extends" are returned untouched, comments included.
+ */
+func ResolveConfigData(configBytes []byte) (resolvedBytes []byte, err error) {
+	var configTree yaml.MapSlice
+
+	err = yaml.Unmarshal(configBytes, &configTree)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, found := getConfigTreeValue(configTree, ConfigExtendsKey); !found {
+		return configBytes, nil
+	}
+
+	configTree, err = resolveConfigTree(configTree, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(configTree)
+}
+
+func resolveConfigTree(configTree yaml.MapSlice, templateChain []string) (resolvedTree yaml.MapSlice, err error) {
+	var templateTree yaml.MapSlice
+	var templateBytes []byte
+
+	value, found := getConfigTreeValue(configTree, ConfigExtendsKey)
+	if !found {
+		return configTree, nil
+	}
+	configTree = deleteConfigTreeValue(configTree, ConfigExtendsKey)
+
+	templateName, ok := value.(string)
+	if !ok || len(templateName) == 0 {
+		return nil, fmt.Errorf("'%s' must be a template name", ConfigExtendsKey)
+	}
+
+	/* The name becomes a path in the templates directory */
+	if !IsValidName(templateName) {
+		return nil, fmt.Errorf("invalid template name '%s' in '%s'", templateName, ConfigExtendsKey)
+	}
+
+	for _, chained := range templateChain {
+		if chained == templateName {
+			return nil, fmt.Errorf("template loop: %s -> %s", strings.Join(templateChain, " -> "), templateName)
+		}
+	}
+
+	templateChain = append(templateChain, templateName)
+	if len(templateChain) > ConfigMaxTemplateDepth {
+		return nil, fmt.Errorf("templates nested deeper than %d levels", ConfigMaxTemplateDepth)
+	}
+
+	templateBytes, err = runtime.ReadTemplate(templateName)
+	if err != nil {
+		return nil, err
+	}
+
+	err = yaml.Unmarshal(templateBytes, &templateTree)
+	if err != nil {
+		return nil, fmt.Errorf("template '%s': %s", templateName, err.Error())
+	}
+
+	templateTree, err = resolveConfigTree(templateTree, templateChain)
+	if err != nil {
+		return nil, err
+	}
+
+	return mergeConfigTree(templateTree, configTree), nil
+}
+
+/* mergeConfigTree returns base with every key of override applied on top of it */
+func mergeConfigTree(base yaml.MapSlice, override yaml.MapSlice) (merged yaml.MapSlice) {
+	merged = append(yaml.MapSlice{}, base...)
+
+	for _, item := range override {
+		baseValue, found := getConfigTreeValue(merged, item.Key)
+		baseTree, baseIsTree := baseValue.(yaml.MapSlice)
+		overrideTree, overrideIsTree := item.Value.(yaml.MapSlice)
+
+		if found && baseIsTree && overrideIsTree {
+			merged = setConfigTreeValue(merged, item.Key, mergeConfigTree(baseTree, overrideTree))
+		} else {
+			merged = setConfigTreeValue(merged, item.Key, item.Value)
+		}
+	}
+
+	return merged
+}
+
+func getConfigTreeValue(configTree yaml.MapSlice, key interface{}) (value interface{}, found bool) {
+	for _, item := range configTree {
+		if item.Key == key {
+			return item.Value, true
+		}
+	}
+
+	return nil, false
+}
+
+func setConfigTreeValue(configTree yaml.MapSlice, key interface{}, value interface{}) yaml.MapSlice {
+	for index := range configTree {
+		if configTree[index].Key == key {
+			configTree[index].Value = value
+			return configTree
+		}
+	}
+
+	return append(configTree, yaml.MapItem{Key: key, Value: value})
+}
+
+func deleteConfigTreeValue(configTree yaml.MapSlice, key interface{}) (result yaml.MapSlice) {
+	for _, item := range configTree {
+		if item.Key != key {
+			result = append(result, item)
+		}
+	}
+
+	return result
+}
+
+/*
+ * SetConfigValues applies "path.to.key=value" assignments to a config, as
+ * given with --set. Values are read as YAML, so "cpus=4" sets a number and
+ * "display.vnc.enabled=true" a boolean.
+ */
+func SetConfigValues(configBytes []byte, assignments []string) (updatedBytes []byte, err error) {
+	var configTree yaml.MapSlice
+
+	err = yaml.Unmarshal(configBytes, &configTree)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, assignment := range assignments {
+		var value interface{}
+
+		separator := strings.Index(assignment, "=")
+		if separator <= 0 {
+			return nil, fmt.Errorf("invalid assignment '%s' (expected key=value)", assignment)
+		}
+
+		err = yaml.Unmarshal([]byte(assignment[separator+1:]), &value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid value in '%s': %s", assignment, err.Error())
+		}
+
+		configTree, err = setConfigTreePath(configTree, strings.Split(assignment[:separator], "."), value)
+		if err != nil {
+			return nil, fmt.Errorf("cannot set '%s': %s", assignment[:separator], err.Error())
+		}
+	}
+
+	return yaml.Marshal(configTree)
+}
+
+// SetConfigValue sets the dotted path of a config to value, keeping every
+// other key as it is.
+func SetConfigValue(configBytes []byte, path string, value interface{}) (updatedBytes []byte, err error) {
+	var configTree yaml.MapSlice
+
+	err = yaml.Unmarshal(configBytes, &configTree)
+	if err != nil {
+		return nil, err
+	}
+
+	configTree, err = setConfigTreePath(configTree, strings.Split(path, "."), value)
+	if err != nil {
+		return nil, fmt.Errorf("cannot set '%s': %s", path, err.Error())
+	}
+
+	return yaml.Marshal(configTree)
+}
+
+func setConfigTreePath(configTree yaml.MapSlice, path []string, value interface{}) (yaml.MapSlice, error) {
+	if len(path[0]) == 0 {
+		return nil, fmt.Errorf("empty key")
+	}
+
+	if len(path) == 1 {
+		return setConfigTreeValue(configTree, path[0], value), nil
+	}
+
+	var subTree yaml.MapSlice
+	if current, found := getConfigTreeValue(configTree, path[0]); found && current != nil {
+		var ok bool
+		if subTree, ok = current.(yaml.MapSlice); !ok {
+			return nil, fmt.Errorf("'%s' is not a mapping", path[0])
+		}
+	}
+
+	subTree, err := setConfigTreePath(subTree, path[1:], value)
+	if err != nil {
+		return nil, err
+	}
+
+	return setConfigTreeValue(configTree, path[0], subTree), nil
+}
+
+// ValidateTemplateData checks the keys of a template and the templates it
+// extends. Templates are partial configs: values are checked once a machine
+// uses them.
+func ValidateTemplateData(templateBytes []byte) (err error) {
+	var validator *configValidator = &configValidator{
+		locator: newYamlLocator(templateBytes),
+	}
+
+	err = yaml.UnmarshalStrict(templateBytes, NewConfigData())
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		for _, message := range typeError.Errors {
+			validator.addYamlError(message)
+		}
+	} else if err != nil {
+		validator.addYamlError(err.Error())
+	}
+
+	if len(validator.errors) == 0 {
+		_, err = ResolveConfigData(templateBytes)
+		if err != nil {
+			validator.add([]string{ConfigExtendsKey}, "%s", err.Error())
+		}
+	}
+
+	if len(validator.errors) > 0 {
+		return validator.errors
+	}
+
+	return nil
+}
@@ -0,0 +1,227 @@
+package qemuctl_helpers
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+/* normalizeYaml re-marshals document, so that expectations need not match indentation */
+func normalizeYaml(t *testing.T, document string) string {
+	var configTree yaml.MapSlice
+
+	err := yaml.Unmarshal([]byte(document), &configTree)
+	if err != nil {
+		t.Fatalf("could not parse '%s': %s", document, err.Error())
+	}
+
+	normalized, err := yaml.Marshal(configTree)
+	if err != nil {
+		t.Fatalf("could not marshal '%s': %s", document, err.Error())
+	}
+
+	return string(normalized)
+}
+
+func TestMergeConfigTree(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		base     string
+		override string
+		want     string
+	}{
+		{
+			name:     "mappings merge key by key",
+			base:     "display:\n  vnc:\n    enabled: false\n    display: 1\n",
+			override: "display:\n  vnc:\n    enabled: true\n",
+			want:     "display:\n  vnc:\n    enabled: true\n    display: 1\n",
+		},
+		{
+			name:     "lists are replaced",
+			base:     "disks:\n- id: a\n- id: b\n",
+			override: "disks:\n- id: c\n",
+			want:     "disks:\n- id: c\n",
+		},
+		{
+			name:     "scalars replace mappings",
+			base:     "display:\n  vnc:\n    enabled: true\n",
+			override: "display: null\n",
+			want:     "display: null\n",
+		},
+		{
+			name:     "new keys come after the base ones",
+			base:     "memory: 1G\ncpus: 1\n",
+			override: "cpus: 2\nenableKVM: true\n",
+			want:     "memory: 1G\ncpus: 2\nenableKVM: true\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var base, override yaml.MapSlice
+
+			if err := yaml.Unmarshal([]byte(testCase.base), &base); err != nil {
+				t.Fatalf("could not parse base: %s", err.Error())
+			}
+			if err := yaml.Unmarshal([]byte(testCase.override), &override); err != nil {
+				t.Fatalf("could not parse override: %s", err.Error())
+			}
+
+			merged, err := yaml.Marshal(mergeConfigTree(base, override))
+			if err != nil {
+				t.Fatalf("could not marshal merged tree: %s", err.Error())
+			}
+
+			if want := normalizeYaml(t, testCase.want); string(merged) != want {
+				t.Errorf("merged tree differs\n--- got\n%s--- want\n%s", merged, want)
+			}
+		})
+	}
+}
+
+func TestSetConfigValues(t *testing.T) {
+	var testCases = []struct {
+		name        string
+		config      string
+		assignments []string
+		want        string
+		/* Expected error, as a substring */
+		wantErr string
+	}{
+		{
+			name:        "values are read as YAML",
+			config:      "cpus: 1\n",
+			assignments: []string{"cpus=4", "enableKVM=true", "memory=2G"},
+			want:        "cpus: 4\nenableKVM: true\nmemory: 2G\n",
+		},
+		{
+			name:        "missing subtrees are created",
+			config:      "cpus: 1\n",
+			assignments: []string{"display.vnc.enabled=true"},
+			want:        "cpus: 1\ndisplay:\n  vnc:\n    enabled: true\n",
+		},
+		{
+			name:        "existing subtrees keep their other keys",
+			config:      "ssh:\n  localPort: 2222\n  user: root\n",
+			assignments: []string{"ssh.localPort=auto"},
+			want:        "ssh:\n  localPort: auto\n  user: root\n",
+		},
+		{
+			name:        "scalars cannot be gone through",
+			config:      "cpus: 1\n",
+			assignments: []string{"cpus.count=2"},
+			wantErr:     "cannot set 'cpus.count': 'cpus' is not a mapping",
+		},
+		{
+			name:        "lists cannot be gone through",
+			config:      "disks:\n- id: a\n",
+			assignments: []string{"disks.a.size=1G"},
+			wantErr:     "'disks' is not a mapping",
+		},
+		{
+			name:        "empty keys",
+			config:      "cpus: 1\n",
+			assignments: []string{"display..enabled=true"},
+			wantErr:     "empty key",
+		},
+		{
+			name:        "assignments need a key",
+			config:      "cpus: 1\n",
+			assignments: []string{"=1"},
+			wantErr:     "expected key=value",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			updated, err := SetConfigValues([]byte(testCase.config), testCase.assignments)
+
+			if len(testCase.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), testCase.wantErr) {
+					t.Fatalf("got error %v, want one containing '%s'", err, testCase.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("SetConfigValues failed: %s", err.Error())
+			}
+
+			if want := normalizeYaml(t, testCase.want); string(updated) != want {
+				t.Errorf("updated config differs\n--- got\n%s--- want\n%s", updated, want)
+			}
+		})
+	}
+}
+
+func TestResolveConfigData(t *testing.T) {
+	var testCases = []struct {
+		name      string
+		templates map[string]string
+		config    string
+		want      string
+		/* Expected error, as a substring */
+		wantErr string
+	}{
+		{
+			name: "templates are merged under the config",
+			templates: map[string]string{
+				"base":  "memory: 1G\ndisks:\n- id: root\n  image:\n    size: 10G\n",
+				"small": "extends: base\ncpus: 1\n",
+			},
+			config: "extends: small\nmachine:\n  name: vm0\ncpus: 2\n",
+			want:   "memory: 1G\ndisks:\n- id: root\n  image:\n    size: 10G\ncpus: 2\nmachine:\n  name: vm0\n",
+		},
+		{
+			name: "loops are detected",
+			templates: map[string]string{
+				"a": "extends: b\n",
+				"b": "extends: a\n",
+			},
+			config:  "extends: a\n",
+			wantErr: "template loop: a -> b -> a",
+		},
+		{
+			name:      "templates cannot extend themselves",
+			templates: map[string]string{"a": "extends: a\n"},
+			config:    "extends: a\n",
+			wantErr:   "template loop: a -> a",
+		},
+		{
+			name:    "template names cannot be paths",
+			config:  "extends: ../machines/vm0/config\n",
+			wantErr: "invalid template name",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			/* Templates live under ~/.qemuctl: use a scratch home */
+			t.Setenv("HOME", t.TempDir())
+			for templateName, template := range testCase.templates {
+				if err := runtime.WriteTemplate(templateName, []byte(template)); err != nil {
+					t.Fatalf("could not write template: %s", err.Error())
+				}
+			}
+
+			resolved, err := ResolveConfigData([]byte(testCase.config))
+
+			if len(testCase.wantErr) > 0 {
+				if err == nil || !strings.Contains(err.Error(), testCase.wantErr) {
+					t.Fatalf("got error %v, want one containing '%s'", err, testCase.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ResolveConfigData failed: %s", err.Error())
+			}
+
+			if want := normalizeYaml(t, testCase.want); string(resolved) != want {
+				t.Errorf("resolved config differs\n--- got\n%s--- want\n%s", resolved, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package qemuctl_helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+/* Binary multipliers, as QEMU understands them (1K = 1024) */
+var sizeSuffixes = map[string]int64{
+	"":  1,
+	"B": 1,
+	"K": 1 << 10,
+	"M": 1 << 20,
+	"G": 1 << 30,
+	"T": 1 << 40,
+}
+
+// ParseSize parses sizes like "512", "64K", "10M" or "2G" into bytes
+func ParseSize(size string) (bytes int64, err error) {
+	var number string = strings.TrimSpace(size)
+	var suffix string
+
+	if len(number) == 0 {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	if last := number[len(number)-1]; last < '0' || last > '9' {
+		suffix = strings.ToUpper(string(last))
+		number = number[:len(number)-1]
+	}
+
+	multiplier, found := sizeSuffixes[suffix]
+	if !found {
+		return 0, fmt.Errorf("invalid size suffix in '%s'", size)
+	}
+
+	value, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid size '%s'", size)
+	}
+
+	return value * multiplier, nil
+}
+
+// FormatSize formats bytes for humans, the way ParseSize reads them: "512",
+// "64K", "1.5G"
+func FormatSize(bytes int64) string {
+	var suffixes string = "KMGT"
+	var value float64 = float64(bytes)
+	var suffix string
+
+	for index := 0; value >= 1024 && index < len(suffixes); index++ {
+		value /= 1024
+		suffix = string(suffixes[index])
+	}
+
+	if len(suffix) == 0 || value >= 100 {
+		return fmt.Sprintf("%.0f%s", value, suffix)
+	}
+
+	return fmt.Sprintf("%.1f%s", value, suffix)
+}
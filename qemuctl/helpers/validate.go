@@ -0,0 +1,566 @@
+package qemuctl_helpers
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+/* yaml.v2 messages look like "line 12: field foo not found in type ..." */
+var yamlLineRegex = regexp.MustCompile(`line (\d+): (.*)$`)
+var yamlUnknownFieldRegex = regexp.MustCompile(`^field (\S+) not found in type`)
+
+/* Machine and template names end up as file names */
+var machineNameRegex = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+/* QEMU ids: a letter, then letters, digits, '-', '.' and '_' */
+var netIDRegex = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9._-]*$`)
+
+/* VNC listen spec, as getQemuArgs understands it: "<display>" or "<ipv4>:<display>" */
+var vncListenRegex = regexp.MustCompile(`^(?:([0-9.]+):)?(\d+)$`)
+
+var validRestartPolicies = []string{"never", "on-failure", "always"}
+var validDiskFormats = []string{DiskFormatRaw, DiskFormatQcow2}
+var validDiskInterfaces = []string{DiskInterfaceVirtioBlk, DiskInterfaceVirtioSCSI, DiskInterfaceIDE, DiskInterfaceNVMe, DiskInterfaceUSB}
+var validDiskMedia = []string{DiskMediaDisk, DiskMediaCDRom}
+var validDiskCaches = []string{"writeback", "none", "writethrough", "directsync", "unsafe"}
+var validDiskAIO = []string{"threads", "native", "io_uring"}
+
+// ValidationError is one problem found in a configuration file
+type ValidationError struct {
+	Line    int
+	Field   string
+	Message string
+}
+
+func (validationError *ValidationError) Error() string {
+	var message string = validationError.Message
+
+	if len(validationError.Field) > 0 {
+		message = fmt.Sprintf("%s: %s", validationError.Field, message)
+	}
+
+	if validationError.Line > 0 {
+		message = fmt.Sprintf("line %d: %s", validationError.Line, message)
+	}
+
+	return message
+}
+
+// ValidationErrors is returned when a configuration has one or more problems
+type ValidationErrors []*ValidationError
+
+func (validationErrors ValidationErrors) Error() string {
+	var messages []string
+
+	for _, validationError := range validationErrors {
+		messages = append(messages, validationError.Error())
+	}
+
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(messages, "\n  "))
+}
+
+/* configValidator collects errors, locating each field in the YAML source */
+type configValidator struct {
+	locator *yamlLocator
+	errors  ValidationErrors
+}
+
+func (validator *configValidator) add(path []string, format string, arguments ...interface{}) {
+	var field string
+
+	for _, element := range path {
+		if strings.HasPrefix(element, "[") || len(field) == 0 {
+			field += element
+		} else {
+			field += "." + element
+		}
+	}
+
+	validator.errors = append(validator.errors, &ValidationError{
+		Line:    validator.locator.Line(path...),
+		Field:   field,
+		Message: fmt.Sprintf(format, arguments...),
+	})
+}
+
+func (validator *configValidator) addYamlError(message string) {
+	var validationError *ValidationError = &ValidationError{
+		Message: strings.TrimPrefix(message, "yaml: "),
+	}
+
+	if match := yamlLineRegex.FindStringSubmatch(validationError.Message); match != nil {
+		validationError.Line, _ = strconv.Atoi(match[1])
+		validationError.Message = match[2]
+	}
+
+	if match := yamlUnknownFieldRegex.FindStringSubmatch(validationError.Message); match != nil {
+		validationError.Message = fmt.Sprintf("unknown key '%s'", match[1])
+	}
+
+	validator.errors = append(validator.errors, validationError)
+}
+
+// IsValidName tells whether name can be used for a machine or a template
+func IsValidName(name string) bool {
+	return machineNameRegex.MatchString(name)
+}
+
+func oneOf(value string, values []string) bool {
+	for _, valid := range values {
+		if value == valid {
+			return true
+		}
+	}
+
+	return false
+}
+
+func validPort(port int) bool {
+	return port > 0 && port <= 65535
+}
+
+func (validator *configValidator) checkPath(path []string, filePath string) {
+	if len(filePath) == 0 {
+		return
+	}
+
+	statPath := filePath
+	if strings.HasPrefix(statPath, "~/") {
+		statPath = os.ExpandEnv("$HOME") + statPath[1:]
+	}
+
+	if _, err := os.Stat(statPath); err != nil {
+		validator.add(path, "'%s' does not exist", filePath)
+	}
+}
+
+/* checkAddress complains about anything but an empty value or an IP address */
+func (validator *configValidator) checkAddress(path []string, address string) {
+	if len(address) > 0 && net.ParseIP(address) == nil {
+		validator.add(path, "invalid IP address '%s'", address)
+	}
+}
+
+func (validator *configValidator) checkChoice(path []string, value string, values []string) {
+	if len(value) > 0 && !oneOf(value, values) {
+		validator.add(path, "invalid value '%s' (expected one of: %s)", value, strings.Join(values, ", "))
+	}
+}
+
+// ValidateConfigData parses configBytes strictly and checks every value.
+// The configuration is returned even when it has problems; err is a
+// ValidationErrors listing all of them.
+func ValidateConfigData(configBytes []byte) (configData *ConfigurationData, err error) {
+	var validator *configValidator = &configValidator{
+		locator: newYamlLocator(configBytes),
+	}
+
+	configData = NewConfigData()
+
+	err = yaml.UnmarshalStrict(configBytes, configData)
+	if typeError, ok := err.(*yaml.TypeError); ok {
+		/* Type errors leave the offending fields alone: keep checking the rest */
+		for _, message := range typeError.Errors {
+			validator.addYamlError(message)
+		}
+	} else if err != nil {
+		validator.addYamlError(err.Error())
+		return nil, validator.errors
+	}
+
+	/* Keys are checked above, in this document; values once templates are merged in */
+	if len(configData.Extends) > 0 {
+		resolvedBytes, err := ResolveConfigData(configBytes)
+		if err != nil {
+			validator.add([]string{ConfigExtendsKey}, "%s", err.Error())
+			return nil, validator.errors
+		}
+
+		configData = NewConfigData()
+		err = yaml.Unmarshal(resolvedBytes, configData)
+		if err != nil {
+			validator.add([]string{ConfigExtendsKey}, "%s", err.Error())
+			return nil, validator.errors
+		}
+	}
+
+	validator.validate(configData)
+
+	if len(validator.errors) > 0 {
+		return configData, validator.errors
+	}
+
+	return configData, nil
+}
+
+func (validator *configValidator) validate(cd *ConfigurationData) {
+	/* Machine */
+	if len(cd.Machine.MachineName) == 0 {
+		validator.add([]string{"machine", "name"}, "is mandatory")
+	} else if !IsValidName(cd.Machine.MachineName) {
+		validator.add([]string{"machine", "name"},
+			"'%s' may only contain letters, digits, '.', '_' and '-'", cd.Machine.MachineName)
+	}
+
+	if len(cd.Machine.MachineType) == 0 {
+		validator.add([]string{"machine", "type"}, "is mandatory")
+	}
+
+	validator.validateTPM(cd)
+
+	if cd.Machine.HotplugSlots < 0 {
+		validator.add([]string{"machine", "hotplugSlots"}, "must not be negative")
+	} else if cd.Machine.HotplugSlots > 0 && !cd.HasPCIExpress() {
+		validator.add([]string{"machine", "hotplugSlots"}, "only q35 machines need hot-plug slots")
+	}
+
+	validator.checkChoice([]string{"restartPolicy"}, cd.RestartPolicy, validRestartPolicies)
+
+	/* Memory and CPUs */
+	if len(cd.Memory) == 0 {
+		validator.add([]string{"memory"}, "is mandatory")
+	} else if size, err := ParseSize(cd.Memory); err != nil || size == 0 {
+		validator.add([]string{"memory"}, "invalid size '%s' (use a number of MiB or a K, M, G or T suffix)", cd.Memory)
+	}
+
+	if cd.CPUs < 1 {
+		validator.add([]string{"cpus"}, "must be at least 1 (got %d)", cd.CPUs)
+	}
+
+	validator.validateNetwork(cd)
+	validator.validateDisplay(cd)
+	validator.validateDisks(cd)
+
+	/* Boot */
+	validator.checkPath([]string{"boot", "kernelPath"}, cd.Boot.KernelPath)
+	validator.checkPath([]string{"boot", "ramdiskPath"}, cd.Boot.RamdiskPath)
+	validator.checkPath([]string{"boot", "biosFile"}, cd.Boot.BiosFile)
+
+	if len(cd.Boot.KernelPath) > 0 && len(cd.Boot.RamdiskPath) == 0 {
+		validator.add([]string{"boot", "ramdiskPath"}, "is mandatory when kernelPath is set")
+	}
+
+	/* SSH */
+	if cd.SSH.LocalPort != 0 && !cd.SSH.LocalPort.IsAuto() && !validPort(int(cd.SSH.LocalPort)) {
+		validator.add([]string{"ssh", "localPort"}, "invalid port %d", cd.SSH.LocalPort)
+	}
+	validator.checkAddress([]string{"ssh", "hostAddress"}, cd.SSH.HostAddress)
+	validator.checkAddress([]string{"ssh", "guestAddress"}, cd.SSH.GuestAddress)
+	validator.checkPath([]string{"ssh", "identityFile"}, cd.SSH.IdentityFile)
+
+	/* Console */
+	if _, err := ParseSize(cd.Console.LogMaxSize); err != nil {
+		validator.add([]string{"console", "logMaxSize"}, "%s", err.Error())
+	}
+
+	if cd.Console.LogKeep < 0 {
+		validator.add([]string{"console", "logKeep"}, "must not be negative")
+	}
+
+	/* QEMU binary */
+	if len(cd.QemuBinary) > 0 {
+		if _, err := exec.LookPath(cd.QemuBinary); err != nil {
+			validator.add([]string{"qemuBinary"}, "'%s' not found", cd.QemuBinary)
+		}
+	}
+}
+
+func (validator *configValidator) validateTPM(cd *ConfigurationData) {
+	var tpmPath []string = []string{"machine", "tpm"}
+
+	if cd.Machine.TPM.Passthrough.Enabled && cd.Machine.TPM.Emulator.Enabled {
+		validator.add(tpmPath, "passthrough and emulator cannot be enabled at the same time")
+	}
+
+	if cd.Machine.TPM.Passthrough.Enabled {
+		if len(cd.Machine.TPM.Passthrough.ID) == 0 {
+			validator.add(append(tpmPath, "passthrough", "id"), "is mandatory")
+		}
+		validator.checkPath(append(tpmPath, "passthrough", "path"), cd.Machine.TPM.Passthrough.Path)
+		validator.checkPath(append(tpmPath, "passthrough", "cancelPath"), cd.Machine.TPM.Passthrough.CancelPath)
+	}
+
+	if cd.Machine.TPM.Emulator.Enabled {
+		if len(cd.Machine.TPM.Emulator.ID) == 0 {
+			validator.add(append(tpmPath, "emulator", "id"), "is mandatory")
+		}
+		if len(cd.Machine.TPM.Emulator.CharDevice) == 0 {
+			validator.add(append(tpmPath, "emulator", "charDevice"), "is mandatory")
+		}
+	}
+}
+
+func (validator *configValidator) validateNetwork(cd *ConfigurationData) {
+	/* tcp and udp ports do not clash: keyed as "tcp/8080" */
+	var hostPorts map[string]bool = map[string]bool{portKey(ForwardProtocolTCP, int(cd.SSH.LocalPort)): true}
+	var netIDs map[string]bool = make(map[string]bool)
+	var macAddresses map[string]bool = make(map[string]bool)
+
+	if cd.SSH.LocalPort != 0 && cd.Net.GetSSHInterface() == nil {
+		validator.add([]string{"ssh", "localPort"}, "needs an interface with the user backend")
+	}
+
+	for index := range cd.Net {
+		var nic *NetworkInterface = &cd.Net[index]
+		var nicPath []string = []string{"net", fmt.Sprintf("[%d]", index)}
+
+		netID := nic.GetID(index)
+		if !netIDRegex.MatchString(netID) {
+			validator.add(append(nicPath, "id"), "invalid id '%s'", netID)
+		} else if netIDs[netID] {
+			validator.add(append(nicPath, "id"), "duplicate interface id '%s'", netID)
+		}
+		netIDs[netID] = true
+
+		if len(nic.MacAddress) > 0 {
+			mac, err := net.ParseMAC(nic.MacAddress)
+			if err != nil || len(mac) != 6 {
+				validator.add(append(nicPath, "mac"), "invalid MAC address '%s'", nic.MacAddress)
+			} else if macAddresses[mac.String()] {
+				validator.add(append(nicPath, "mac"), "MAC address %s is used twice", nic.MacAddress)
+			} else {
+				macAddresses[mac.String()] = true
+			}
+		}
+
+		validator.checkChoice(append(nicPath, "backend"), nic.Backend, []string{
+			NetworkBackendUser, NetworkBackendBridge, NetworkBackendTap,
+			NetworkBackendSocket, NetworkBackendVhostUser,
+		})
+
+		switch nic.GetBackend() {
+		case NetworkBackendUser:
+			validator.validateUserNetwork(append(nicPath, "user"), &nic.User, hostPorts)
+
+		case NetworkBackendBridge:
+			if len(nic.Bridge.Interface) == 0 {
+				validator.add(append(nicPath, "bridge", "interface"), "is mandatory")
+			}
+
+		case NetworkBackendTap:
+			if len(nic.Tap.IfName) > 15 {
+				validator.add(append(nicPath, "tap", "ifname"), "'%s' is longer than 15 characters", nic.Tap.IfName)
+			}
+			validator.checkPath(append(nicPath, "tap", "script"), nic.Tap.Script)
+			validator.checkPath(append(nicPath, "tap", "downScript"), nic.Tap.DownScript)
+
+		case NetworkBackendSocket:
+			validator.validateSocketNetwork(append(nicPath, "socket"), &nic.Socket)
+
+		case NetworkBackendVhostUser:
+			if len(nic.VhostUser.Socket) == 0 {
+				validator.add(append(nicPath, "vhostUser", "socket"), "is mandatory")
+			}
+		}
+	}
+
+	for index, attachment := range cd.Networks {
+		var attachmentPath []string = []string{"networks", fmt.Sprintf("[%d]", index)}
+
+		if !IsValidName(attachment.Name) {
+			validator.add(attachmentPath, "invalid network name '%s'", attachment.Name)
+			continue
+		}
+
+		if netIDs[attachment.GetID()] {
+			validator.add(attachmentPath, "network '%s' is joined twice, or clashes with interface '%s'",
+				attachment.Name, attachment.GetID())
+		} else if !runtime.NetworkExists(attachment.Name) {
+			validator.add(attachmentPath, "network '%s' does not exist (see qemuctl network create)", attachment.Name)
+		}
+		netIDs[attachment.GetID()] = true
+	}
+}
+
+func (validator *configValidator) validateUserNetwork(userPath []string, user *UserNetwork, hostPorts map[string]bool) {
+	if len(user.IPSubnet) > 0 {
+		if _, _, err := net.ParseCIDR(user.IPSubnet); err != nil {
+			validator.add(append(userPath, "ipSubnet"), "invalid CIDR '%s'", user.IPSubnet)
+		}
+	}
+
+	for index, forward := range user.PortForwards {
+		var forwardPath []string = append(append([]string{}, userPath...), "portForwards", fmt.Sprintf("[%d]", index))
+
+		if len(forward.Protocol) > 0 {
+			validator.checkChoice(append(forwardPath, "protocol"), forward.Protocol,
+				[]string{ForwardProtocolTCP, ForwardProtocolUDP})
+		}
+		validator.checkAddress(append(forwardPath, "hostAddress"), forward.HostAddress)
+		validator.checkAddress(append(forwardPath, "guestAddress"), forward.GuestAddress)
+
+		if !validPort(forward.GuestPort) {
+			validator.add(append(forwardPath, "guestPort"), "invalid port %d", forward.GuestPort)
+		}
+
+		if forward.HostPort.IsAuto() {
+			continue
+		}
+
+		key := portKey(forward.GetProtocol(), int(forward.HostPort))
+		if !validPort(int(forward.HostPort)) {
+			validator.add(append(forwardPath, "hostPort"), "invalid port %d", forward.HostPort)
+		} else if hostPorts[key] {
+			validator.add(append(forwardPath, "hostPort"), "port %s is forwarded twice", key)
+		}
+		hostPorts[key] = true
+	}
+
+	for _, domain := range user.DNSSearch {
+		if len(domain) == 0 || strings.ContainsAny(domain, ", ") {
+			validator.add(append(userPath, "dnsSearch"), "invalid domain '%s'", domain)
+		}
+	}
+
+	if strings.ContainsAny(user.Hostname, ", ") {
+		validator.add(append(userPath, "hostname"), "invalid hostname '%s'", user.Hostname)
+	}
+
+	for index, forward := range user.GuestForwards {
+		var forwardPath []string = append(append([]string{}, userPath...), "guestForwards", fmt.Sprintf("[%d]", index))
+
+		if ip := net.ParseIP(forward.GuestAddress); ip == nil || ip.To4() == nil {
+			validator.add(append(forwardPath, "guestAddress"), "invalid IPv4 address '%s'", forward.GuestAddress)
+		}
+
+		if !validPort(forward.GuestPort) {
+			validator.add(append(forwardPath, "guestPort"), "invalid port %d", forward.GuestPort)
+		}
+
+		if len(forward.Target) == 0 {
+			validator.add(append(forwardPath, "target"), "is mandatory")
+		}
+	}
+}
+
+/* validateSocketNetwork wants exactly one of a multicast group or a UDP peer, as address:port */
+func (validator *configValidator) validateSocketNetwork(socketPath []string, socket *SocketNetwork) {
+	if (len(socket.Mcast) == 0) == (len(socket.UDP) == 0) {
+		validator.add(socketPath, "exactly one of mcast or udp must be set")
+		return
+	}
+
+	if len(socket.Mcast) > 0 {
+		ip, port, ok := splitAddressPort(socket.Mcast)
+		if !ok || !validPort(port) || !ip.IsMulticast() {
+			validator.add(append(socketPath, "mcast"), "invalid multicast group '%s' (expected address:port)", socket.Mcast)
+		}
+
+		validator.checkAddress(append(socketPath, "localAddress"), socket.LocalAddress)
+		return
+	}
+
+	if _, port, ok := splitAddressPort(socket.UDP); !ok || !validPort(port) {
+		validator.add(append(socketPath, "udp"), "invalid peer '%s' (expected address:port)", socket.UDP)
+	}
+
+	/* A UDP tunnel binds to localAddress, which is an address:port too */
+	if len(socket.LocalAddress) == 0 {
+		validator.add(append(socketPath, "localAddress"), "is mandatory with udp")
+	} else if _, port, ok := splitAddressPort(socket.LocalAddress); !ok || !validPort(port) {
+		validator.add(append(socketPath, "localAddress"), "invalid local address '%s' (expected address:port)", socket.LocalAddress)
+	}
+}
+
+func splitAddressPort(addressPort string) (ip net.IP, port int, ok bool) {
+	host, portString, err := net.SplitHostPort(addressPort)
+	if err != nil {
+		return nil, 0, false
+	}
+
+	ip = net.ParseIP(host)
+	port, err = strconv.Atoi(portString)
+
+	return ip, port, ip != nil && err == nil
+}
+
+func (validator *configValidator) validateDisplay(cd *ConfigurationData) {
+	if cd.Display.VNC.Enabled {
+		match := vncListenRegex.FindStringSubmatch(cd.Display.VNC.Listen)
+		if match == nil || (len(match[1]) > 0 && net.ParseIP(match[1]).To4() == nil) {
+			validator.add([]string{"display", "vnc", "listen"},
+				"invalid listen spec '%s' (expected '<display>' or '<ipv4>:<display>')", cd.Display.VNC.Listen)
+		} else if display, _ := strconv.Atoi(match[2]); !validPort(5900 + display) {
+			validator.add([]string{"display", "vnc", "listen"}, "display number %d out of range", display)
+		}
+	}
+
+	if cd.Display.Spice.Enabled {
+		if !validPort(cd.Display.Spice.Port) {
+			validator.add([]string{"display", "spice", "port"}, "invalid port %d", cd.Display.Spice.Port)
+		}
+
+		if cd.Display.Spice.TLSPort != 0 && !validPort(cd.Display.Spice.TLSPort) {
+			validator.add([]string{"display", "spice", "tlsPort"}, "invalid port %d", cd.Display.Spice.TLSPort)
+		}
+
+		if len(cd.Display.Spice.Address) > 0 && net.ParseIP(cd.Display.Spice.Address) == nil {
+			validator.add([]string{"display", "spice", "address"}, "invalid IP address '%s'", cd.Display.Spice.Address)
+		}
+	}
+}
+
+func (validator *configValidator) validateDisks(cd *ConfigurationData) {
+	var diskIDs map[string]bool = make(map[string]bool)
+
+	for index := range cd.Disks {
+		var disk *Disk = &cd.Disks[index]
+		var diskPath []string = []string{"disks", fmt.Sprintf("[%d]", index)}
+		var sources int = 0
+
+		for _, source := range []string{disk.File, disk.Device} {
+			if len(source) > 0 {
+				sources++
+			}
+		}
+
+		if sources > 1 {
+			validator.add(diskPath, "only one of file or device can be set")
+		} else if sources == 0 && !disk.IsProvisioned() && !disk.IsCDRom() {
+			/* A cdrom drive may start empty, see "qemuctl insert" */
+			validator.add(diskPath, "one of file, device or image is mandatory")
+		}
+
+		id := disk.GetID(index)
+		if diskIDs[id] {
+			validator.add(append(diskPath, "id"), "duplicate disk id '%s'", id)
+		}
+		diskIDs[id] = true
+
+		validator.checkChoice(append(diskPath, "format"), disk.Format, validDiskFormats)
+		validator.checkChoice(append(diskPath, "interface"), disk.Interface, validDiskInterfaces)
+		validator.checkChoice(append(diskPath, "media"), disk.Media, validDiskMedia)
+		validator.checkChoice(append(diskPath, "cache"), disk.Cache, validDiskCaches)
+		validator.checkChoice(append(diskPath, "aio"), disk.AIO, validDiskAIO)
+
+		if disk.IsCDRom() && !oneOf(disk.GetInterface(), []string{DiskInterfaceIDE, DiskInterfaceVirtioSCSI}) {
+			validator.add(append(diskPath, "interface"), "'%s' cannot hold a cdrom", disk.GetInterface())
+		}
+
+		if disk.BootIndex != nil && *disk.BootIndex < 0 {
+			validator.add(append(diskPath, "bootIndex"), "must not be negative")
+		}
+
+		validator.checkPath(append(diskPath, "file"), disk.File)
+		validator.checkPath(append(diskPath, "device"), disk.Device)
+		validator.checkPath(append(diskPath, "image", "backingFile"), disk.Image.BackingFile)
+
+		if len(disk.Image.Size) > 0 {
+			if _, err := ParseSize(disk.Image.Size); err != nil {
+				validator.add(append(diskPath, "image", "size"), "%s", err.Error())
+			}
+		}
+
+		if disk.IsProvisioned() && disk.GetFormat() != DiskFormatQcow2 {
+			validator.add(append(diskPath, "format"), "provisioned images must be qcow2")
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package qemuctl_helpers
+
+import (
+	"strings"
+	"testing"
+)
+
+/* testConfigHead is a valid config on lines 1 to 4; cases append their problems to it */
+const testConfigHead string = "machine:\n  name: vm0\nmemory: 1G\ncpus: 1\n"
+
+func TestValidateConfigData(t *testing.T) {
+	type wantError struct {
+		line  int
+		field string
+		/* Expected message, as a substring */
+		message string
+	}
+
+	var testCases = []struct {
+		name   string
+		config string
+		want   []wantError
+	}{
+		{
+			name:   "valid",
+			config: testConfigHead,
+		},
+		{
+			name:   "unknown key",
+			config: testConfigHead + "cpu: 2\n",
+			want:   []wantError{{line: 5, message: "unknown key 'cpu'"}},
+		},
+		{
+			name:   "bad enum",
+			config: testConfigHead + "restartPolicy: sometimes\n",
+			want:   []wantError{{line: 5, field: "restartPolicy", message: "invalid value 'sometimes'"}},
+		},
+		{
+			name:   "bad size",
+			config: strings.Replace(testConfigHead, "memory: 1G", "memory: 1X", 1),
+			want:   []wantError{{line: 3, field: "memory", message: "invalid size '1X'"}},
+		},
+		{
+			/* The other disks are still checked */
+			name: "unknown key in a disk",
+			config: testConfigHead +
+				"disks:\n" +
+				"- id: root\n" +
+				"  image:\n" +
+				"    size: 10G\n" +
+				"- id: data\n" +
+				"  image:\n" +
+				"    size: 1G\n" +
+				"  sise: 2G\n" +
+				"- id: scratch\n" +
+				"  interface: sata\n" +
+				"  image:\n" +
+				"    size: lots\n",
+			want: []wantError{
+				{line: 12, message: "unknown key 'sise'"},
+				{line: 14, field: "disks[2].interface", message: "invalid value 'sata'"},
+				{line: 16, field: "disks[2].image.size", message: "invalid size suffix in 'lots'"},
+			},
+		},
+		{
+			name: "unknown key in an interface",
+			config: testConfigHead +
+				"net:\n" +
+				"- id: n0\n" +
+				"  backend: user\n" +
+				"  bakend: tap\n" +
+				"- id: n1\n" +
+				"  backend: user\n" +
+				"  mac: zz\n",
+			want: []wantError{
+				{line: 8, message: "unknown key 'bakend'"},
+				{line: 11, field: "net[1].mac", message: "invalid MAC address 'zz'"},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			var got ValidationErrors
+
+			_, err := ValidateConfigData([]byte(testCase.config))
+			if err != nil {
+				var ok bool
+				if got, ok = err.(ValidationErrors); !ok {
+					t.Fatalf("got %T error, want ValidationErrors: %s", err, err.Error())
+				}
+			}
+
+			if len(got) != len(testCase.want) {
+				t.Fatalf("got %d errors, want %d: %v", len(got), len(testCase.want), err)
+			}
+
+			for index, want := range testCase.want {
+				if got[index].Line != want.line || got[index].Field != want.field ||
+					!strings.Contains(got[index].Message, want.message) {
+					t.Errorf("error %d: got line %d field '%s' message '%s', want line %d field '%s' message containing '%s'",
+						index, got[index].Line, got[index].Field, got[index].Message, want.line, want.field, want.message)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package qemuctl_helpers
+
+import (
+	"strconv"
+	"strings"
+)
+
+/*
+ * yamlLocator finds the line of a key path ("net", "bridge", "mac" or
+ * "disks", "[1]", "file") in a YAML document by following indentation.
+ * yaml.v2 keeps no positions once decoded, and block style YAML, which is
+ * what our configs use, is simple enough to walk by hand.
+ */
+type yamlLocator struct {
+	lines []string
+}
+
+type yamlLine struct {
+	rawIndent int
+	indent    int
+	text      string
+	isItem    bool
+}
+
+func newYamlLocator(document []byte) *yamlLocator {
+	return &yamlLocator{
+		lines: strings.Split(string(document), "\n"),
+	}
+}
+
+/* parse returns the indentation and content of a line; "- " counts as indentation */
+func (locator *yamlLocator) parse(index int) (line yamlLine, ok bool) {
+	raw := locator.lines[index]
+	trimmed := strings.TrimLeft(raw, " ")
+
+	if len(trimmed) == 0 || strings.HasPrefix(trimmed, "#") {
+		return line, false
+	}
+
+	line.rawIndent = len(raw) - len(trimmed)
+	line.indent = line.rawIndent
+	line.text = trimmed
+	line.isItem = trimmed == "-" || strings.HasPrefix(trimmed, "- ")
+
+	for strings.HasPrefix(line.text, "- ") {
+		line.text = strings.TrimLeft(line.text[2:], " ")
+		line.indent = len(raw) - len(line.text)
+	}
+
+	return line, true
+}
+
+// Line returns the 1-based line of path, or of its deepest ancestor found.
+// It returns 0 when not even the first key is there.
+func (locator *yamlLocator) Line(path ...string) int {
+	var start int = 0
+	var end int = len(locator.lines)
+	var parentIndent int = -1
+	var found int = -1
+
+	for _, element := range path {
+		if strings.HasPrefix(element, "[") {
+			itemIndex, err := strconv.Atoi(strings.Trim(element, "[]"))
+			if err != nil {
+				break
+			}
+
+			itemLine, itemEnd := locator.findItem(start, end, itemIndex)
+			if itemLine < 0 {
+				break
+			}
+
+			found, start, end = itemLine, itemLine, itemEnd
+			line, _ := locator.parse(itemLine)
+			parentIndent = line.rawIndent
+			continue
+		}
+
+		keyLine, keyEnd := locator.findKey(start, end, parentIndent, element)
+		if keyLine < 0 {
+			break
+		}
+
+		line, _ := locator.parse(keyLine)
+		found, start, end = keyLine, keyLine+1, keyEnd
+		parentIndent = line.indent
+	}
+
+	return found + 1
+}
+
+/* findKey looks for key among the direct children of parentIndent in [start, end) */
+func (locator *yamlLocator) findKey(start int, end int, parentIndent int, key string) (keyLine int, keyEnd int) {
+	var childIndent int = -1
+
+	keyLine = -1
+	for index := start; index < end; index++ {
+		line, ok := locator.parse(index)
+		if !ok || line.indent <= parentIndent {
+			continue
+		}
+
+		if childIndent < 0 {
+			childIndent = line.indent
+		}
+
+		if line.indent == childIndent && strings.HasPrefix(line.text, key+":") {
+			keyLine = index
+			break
+		}
+	}
+
+	if keyLine < 0 {
+		return -1, -1
+	}
+
+	/* The value ends at the next line indented like the key, unless it is a sequence item */
+	keyIndent := childIndent
+	for keyEnd = keyLine + 1; keyEnd < end; keyEnd++ {
+		line, ok := locator.parse(keyEnd)
+		if !ok {
+			continue
+		}
+
+		if line.rawIndent < keyIndent || (line.rawIndent == keyIndent && !line.isItem) {
+			break
+		}
+	}
+
+	return keyLine, keyEnd
+}
+
+/* findItem returns the line of the itemIndex-th sequence item in [start, end) */
+func (locator *yamlLocator) findItem(start int, end int, itemIndex int) (itemLine int, itemEnd int) {
+	var itemIndent int = -1
+	var items []int
+
+	for index := start; index < end; index++ {
+		line, ok := locator.parse(index)
+		if !ok || !line.isItem {
+			continue
+		}
+
+		if itemIndent < 0 {
+			itemIndent = line.rawIndent
+		}
+
+		if line.rawIndent == itemIndent {
+			items = append(items, index)
+		}
+	}
+
+	if itemIndex >= len(items) {
+		return -1, -1
+	}
+
+	itemLine = items[itemIndex]
+	itemEnd = end
+	if itemIndex+1 < len(items) {
+		itemEnd = items[itemIndex+1]
+	}
+
+	return itemLine, itemEnd
+}
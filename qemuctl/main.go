@@ -11,7 +11,7 @@ import (
 func usage() {
 	fmt.Println()
 	fmt.Println("usage:")
-	fmt.Println("    qemuctl {start|stop|seila} OPTIONS")
+	fmt.Println("    qemuctl {create|destroy|start|stop|kill|pause|resume|reset|suspend|status|top|edit|attach|detach|eject|insert|guest|list|events|snapshot|disk|ssh|cp|console|daemon|exporter|validate|show-command|template|clone|rename|network} OPTIONS")
 }
 
 func main() {
@@ -34,7 +34,8 @@ func main() {
 	action = execArgs[1]
 	execArgs = execArgs[2:]
 
-	fmt.Println("")
+	/* On stderr: "$(qemuctl ssh vm -- hostname)" and --json output get nothing but their own */
+	fmt.Fprintln(os.Stderr, "")
 
 	switch action {
 	case "create":
@@ -62,30 +63,161 @@ func main() {
 			err = action.Run(execArgs)
 			break
 		}
+	case "kill":
+		{
+			action := actions.KillAction{}
+			err = action.Run(execArgs)
+		}
+	case "pause":
+		{
+			action := actions.PauseAction{}
+			err = action.Run(execArgs)
+		}
+	case "resume":
+		{
+			action := actions.ResumeAction{}
+			err = action.Run(execArgs)
+		}
+	case "reset":
+		{
+			action := actions.ResetAction{}
+			err = action.Run(execArgs)
+		}
+	case "suspend":
+		{
+			action := actions.SuspendAction{}
+			err = action.Run(execArgs)
+		}
 	case "status":
 		{
 			action := actions.StatusAction{}
 			err = action.Run(execArgs)
 			break
 		}
+	case "top":
+		{
+			action := actions.TopAction{}
+			err = action.Run(execArgs)
+		}
 	case "edit":
 		{
 			action := actions.EditAction{}
 			err = action.Run(execArgs)
 		}
+	case "attach":
+		{
+			action := actions.AttachAction{}
+			err = action.Run(execArgs)
+		}
+	case "detach":
+		{
+			action := actions.DetachAction{}
+			err = action.Run(execArgs)
+		}
+	case "eject":
+		{
+			action := actions.EjectAction{}
+			err = action.Run(execArgs)
+		}
+	case "insert":
+		{
+			action := actions.InsertAction{}
+			err = action.Run(execArgs)
+		}
+	case "guest":
+		{
+			action := actions.GuestAction{}
+			err = action.Run(execArgs)
+		}
 	case "list":
 		{
 			action := actions.ListAction{}
 			err = action.Run(execArgs)
 		}
+	case "events":
+		{
+			action := actions.EventsAction{}
+			err = action.Run(execArgs)
+		}
+	case "snapshot":
+		{
+			action := actions.SnapshotAction{}
+			err = action.Run(execArgs)
+		}
+	case "disk":
+		{
+			action := actions.DiskAction{}
+			err = action.Run(execArgs)
+		}
+	case "ssh":
+		{
+			action := actions.SSHAction{}
+			err = action.Run(execArgs)
+		}
+	case "cp":
+		{
+			action := actions.CopyAction{}
+			err = action.Run(execArgs)
+		}
+	case "console":
+		{
+			action := actions.ConsoleAction{}
+			err = action.Run(execArgs)
+		}
+	case "daemon":
+		{
+			action := actions.DaemonAction{}
+			err = action.Run(execArgs)
+		}
+	case "exporter":
+		{
+			action := actions.ExporterAction{}
+			err = action.Run(execArgs)
+		}
+	case "validate":
+		{
+			action := actions.ValidateAction{}
+			err = action.Run(execArgs)
+		}
+	case "show-command":
+		{
+			action := actions.ShowCommandAction{}
+			err = action.Run(execArgs)
+		}
+	case "template":
+		{
+			action := actions.TemplateAction{}
+			err = action.Run(execArgs)
+		}
+	case "clone":
+		{
+			action := actions.CloneAction{}
+			err = action.Run(execArgs)
+		}
+	case "rename":
+		{
+			action := actions.RenameAction{}
+			err = action.Run(execArgs)
+		}
+	case "network":
+		{
+			action := actions.NetworkAction{}
+			err = action.Run(execArgs)
+		}
 	default:
 		{
 			fmt.Printf("[error] Unknown action '%s'\n", action)
+			usage()
+			os.Exit(1)
 		}
 	}
 
-	if err != nil {
+	/* Scripts rely on the exit status: the one of the command run for them, or 1 */
+	if exitStatusError, ok := err.(*actions.ExitStatusError); ok {
+		os.Exit(exitStatusError.Status)
+	} else if err != nil {
 		fmt.Printf("[\033[31merror\033[0m] %s\n", err.Error())
+		os.Exit(1)
 	}
 
 	os.Exit(0)
@@ -0,0 +1,422 @@
+package qemuctl_qemu
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	QemuAgentSocketFileName string = "qemu-ga.sock"
+	QemuAgentChardevID      string = "qga0"
+	QemuAgentSerialID       string = "virtio-serial0"
+	/* Port name qemu-guest-agent looks for in the guest */
+	QemuAgentPortName string = "org.qemu.guest_agent.0"
+
+	QgaSyncDelimitedCommand        string = "guest-sync-delimited"
+	QgaPingCommand                 string = "guest-ping"
+	QgaNetworkGetInterfacesCommand string = "guest-network-get-interfaces"
+	QgaExecCommand                 string = "guest-exec"
+	QgaExecStatusCommand           string = "guest-exec-status"
+	QgaFsfreezeFreezeCommand       string = "guest-fsfreeze-freeze"
+	QgaFsfreezeThawCommand         string = "guest-fsfreeze-thaw"
+	QgaShutdownCommand             string = "guest-shutdown"
+
+	/* Modes of guest-shutdown */
+	QgaShutdownPowerdown string = "powerdown"
+	QgaShutdownReboot    string = "reboot"
+
+	/*
+	 * QEMU accepts connections on the socket whether the agent runs in the
+	 * guest or not: an unanswered guest-sync is how its absence shows.
+	 */
+	QemuAgentSyncTimeout    time.Duration = 2 * time.Second
+	QemuAgentCommandTimeout time.Duration = 30 * time.Second
+	QemuAgentExecTimeout    time.Duration = 5 * time.Minute
+	QemuAgentPollInterval   time.Duration = 200 * time.Millisecond
+
+	/* Sent before guest-sync-delimited, and before its answer, to flush partial messages */
+	qgaDelimiter byte = 0xff
+)
+
+func (monitor *QemuMonitor) GetAgentSocketPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuAgentSocketFileName)
+}
+
+func (monitor *QemuMonitor) GetAgentChardevSpec() string {
+	return fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off",
+		QemuAgentChardevID, monitor.GetAgentSocketPath())
+}
+
+func (monitor *QemuMonitor) GetAgentSerialSpec() string {
+	return fmt.Sprintf("virtio-serial-pci,id=%s", QemuAgentSerialID)
+}
+
+func (monitor *QemuMonitor) GetAgentPortSpec() string {
+	return fmt.Sprintf("virtserialport,bus=%s.0,chardev=%s,name=%s",
+		QemuAgentSerialID, QemuAgentChardevID, QemuAgentPortName)
+}
+
+/* HasAgentChannel tells whether QEMU was started with a guest agent channel */
+func (monitor *QemuMonitor) HasAgentChannel() bool {
+	_, err := os.Stat(monitor.GetAgentSocketPath())
+	return err == nil
+}
+
+// ConnectAgent connects to the guest agent of the machine and makes sure it
+// answers, within QemuAgentSyncTimeout.
+func (monitor *QemuMonitor) ConnectAgent() (client *GuestAgentClient, err error) {
+	return monitor.connectAgent(QemuAgentSyncTimeout)
+}
+
+func (monitor *QemuMonitor) connectAgent(syncTimeout time.Duration) (client *GuestAgentClient, err error) {
+	if !monitor.HasAgentChannel() {
+		return nil, fmt.Errorf("machine '%s' has no guest agent channel (see guestAgent.enabled)", monitor.Machine.Name)
+	}
+
+	client, err = DialGuestAgent(monitor.GetAgentSocketPath(), syncTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("guest agent of '%s': %s", monitor.Machine.Name, err.Error())
+	}
+
+	return client, nil
+}
+
+type GuestAgentIPAddress struct {
+	Type    string `json:"ip-address-type"`
+	Address string `json:"ip-address"`
+	Prefix  int    `json:"prefix"`
+}
+
+type GuestAgentInterface struct {
+	Name            string                `json:"name"`
+	HardwareAddress string                `json:"hardware-address"`
+	IPAddresses     []GuestAgentIPAddress `json:"ip-addresses"`
+}
+
+// GuestExecResult is what guest-exec-status reports; the agent sends the
+// output base64 encoded, which encoding/json decodes into the byte slices.
+type GuestExecResult struct {
+	Exited       bool   `json:"exited"`
+	ExitCode     int    `json:"exitcode"`
+	Signal       int    `json:"signal"`
+	OutData      []byte `json:"out-data"`
+	ErrData      []byte `json:"err-data"`
+	OutTruncated bool   `json:"out-truncated"`
+	ErrTruncated bool   `json:"err-truncated"`
+}
+
+type qgaMessage struct {
+	Return json.RawMessage `json:"return"`
+	Error  *QmpError       `json:"error"`
+}
+
+type qgaRequest struct {
+	Command   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+}
+
+// GuestAgentClient talks to qemu-guest-agent through its virtio-serial
+// channel. The protocol is QMP without greeting, ids nor events: commands
+// are answered one at a time, in order.
+type GuestAgentClient struct {
+	CommandTimeout time.Duration
+
+	conn    net.Conn
+	reader  *bufio.Reader
+	decoder *json.Decoder
+}
+
+// DialGuestAgent connects to the agent socket at socketPath and syncs with
+// the agent within syncTimeout, discarding what an earlier client left unread.
+func DialGuestAgent(socketPath string, syncTimeout time.Duration) (client *GuestAgentClient, err error) {
+	var conn net.Conn
+
+	log.Printf("[agent] connecting to '%s'", socketPath)
+	conn, err = net.DialTimeout("unix", socketPath, syncTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	client = &GuestAgentClient{
+		CommandTimeout: QemuAgentCommandTimeout,
+		conn:           conn,
+		reader:         bufio.NewReader(conn),
+	}
+
+	err = client.sync(syncTimeout)
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		err = fmt.Errorf("no answer within %s, is qemu-guest-agent running in the guest?", syncTimeout)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (client *GuestAgentClient) Close() error {
+	return client.conn.Close()
+}
+
+/*
+ * sync runs guest-sync-delimited with a random id. The agent answers with
+ * a 0xff byte before the reply, so anything before it is stale and skipped,
+ * as are replies to other ids.
+ */
+func (client *GuestAgentClient) sync(timeout time.Duration) (err error) {
+	var id int64 = rand.New(rand.NewSource(time.Now().UnixNano())).Int63n(1 << 31)
+	var request []byte
+	var returned int64
+
+	request, err = json.Marshal(qgaRequest{
+		Command:   QgaSyncDelimitedCommand,
+		Arguments: map[string]int64{"id": id},
+	})
+	if err != nil {
+		return err
+	}
+
+	client.conn.SetDeadline(time.Now().Add(timeout))
+	defer client.conn.SetDeadline(time.Time{})
+
+	_, err = client.conn.Write(append([]byte{qgaDelimiter}, request...))
+	if err != nil {
+		return err
+	}
+
+	for {
+		/* Bytes the decoder read ahead go back in front of the rest */
+		if client.decoder != nil {
+			client.reader = bufio.NewReader(io.MultiReader(client.decoder.Buffered(), client.reader))
+		}
+
+		_, err = client.reader.ReadBytes(qgaDelimiter)
+		if err != nil {
+			return err
+		}
+
+		var message qgaMessage
+		client.decoder = json.NewDecoder(client.reader)
+		err = client.decoder.Decode(&message)
+		if err != nil {
+			return err
+		}
+
+		if json.Unmarshal(message.Return, &returned) == nil && returned == id {
+			return nil
+		}
+	}
+}
+
+/* receive reads one reply and decodes its return value into result, if any */
+func (client *GuestAgentClient) receive(result interface{}) (err error) {
+	var message qgaMessage
+
+	err = client.decoder.Decode(&message)
+	if err != nil {
+		return err
+	}
+
+	if message.Error != nil {
+		return message.Error
+	}
+
+	if result != nil && len(message.Return) > 0 {
+		return json.Unmarshal(message.Return, result)
+	}
+
+	return nil
+}
+
+func (client *GuestAgentClient) send(command string, arguments interface{}) (err error) {
+	var request []byte
+
+	request, err = json.Marshal(qgaRequest{Command: command, Arguments: arguments})
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[agent] sending %s", command)
+	_, err = client.conn.Write(request)
+	return err
+}
+
+// Execute runs command with arguments and decodes its return value into
+// result, which may be nil.
+func (client *GuestAgentClient) Execute(command string, arguments interface{}, result interface{}) (err error) {
+	client.conn.SetDeadline(time.Now().Add(client.CommandTimeout))
+	defer client.conn.SetDeadline(time.Time{})
+
+	err = client.send(command, arguments)
+	if err != nil {
+		return err
+	}
+
+	err = client.receive(result)
+	if netError, ok := err.(net.Error); ok && netError.Timeout() {
+		return fmt.Errorf("guest agent did not answer %s within %s", command, client.CommandTimeout)
+	}
+
+	return err
+}
+
+func (client *GuestAgentClient) Ping() error {
+	return client.Execute(QgaPingCommand, nil, nil)
+}
+
+func (client *GuestAgentClient) GetInterfaces() (interfaces []GuestAgentInterface, err error) {
+	err = client.Execute(QgaNetworkGetInterfacesCommand, nil, &interfaces)
+	return interfaces, err
+}
+
+/*
+ * Exec runs path with args in the guest and waits up to timeout for it to
+ * exit. The agent keeps the output in memory, so this suits short commands.
+ */
+func (client *GuestAgentClient) Exec(path string, args []string, timeout time.Duration) (result *GuestExecResult, err error) {
+	var started struct {
+		PID int `json:"pid"`
+	}
+	var deadline time.Time = time.Now().Add(timeout)
+
+	err = client.Execute(QgaExecCommand, map[string]interface{}{
+		"path":           path,
+		"arg":            args,
+		"capture-output": true,
+	}, &started)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[agent] '%s' runs as process %d in the guest", path, started.PID)
+	for {
+		result = &GuestExecResult{}
+		err = client.Execute(QgaExecStatusCommand, map[string]int{"pid": started.PID}, result)
+		if err != nil {
+			return nil, err
+		}
+
+		if result.Exited {
+			return result, nil
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("'%s' (guest process %d) still running after %s", path, started.PID, timeout)
+		}
+		time.Sleep(QemuAgentPollInterval)
+	}
+}
+
+/* FreezeFilesystems flushes and freezes the guest filesystems, returning how many */
+func (client *GuestAgentClient) FreezeFilesystems() (count int, err error) {
+	err = client.Execute(QgaFsfreezeFreezeCommand, nil, &count)
+	return count, err
+}
+
+/* ThawFilesystems undoes FreezeFilesystems; thawing nothing is not an error */
+func (client *GuestAgentClient) ThawFilesystems() (count int, err error) {
+	err = client.Execute(QgaFsfreezeThawCommand, nil, &count)
+	return count, err
+}
+
+/*
+ * Shutdown asks the guest to power off or reboot. The agent does not answer
+ * guest-shutdown when it succeeds, so only the request is sent.
+ */
+func (client *GuestAgentClient) Shutdown(mode string) (err error) {
+	client.conn.SetWriteDeadline(time.Now().Add(client.CommandTimeout))
+	defer client.conn.SetWriteDeadline(time.Time{})
+
+	return client.send(QgaShutdownCommand, map[string]string{"mode": mode})
+}
+
+/*
+ * freezeGuest freezes the guest filesystems when the agent answers, and
+ * returns the connection to thaw them with; nil when nothing got frozen.
+ */
+func (monitor *QemuMonitor) freezeGuest() (agent *GuestAgentClient) {
+	/* A paused guest cannot answer */
+	if monitor.Machine.IsPaused() || !monitor.HasAgentChannel() {
+		return nil
+	}
+
+	agent, err := monitor.ConnectAgent()
+	if err != nil {
+		log.Printf("[agent] %s, not freezing filesystems", err.Error())
+		return nil
+	}
+
+	count, err := agent.FreezeFilesystems()
+	if err != nil {
+		/* Some filesystems may be frozen already: thaw them all */
+		log.Printf("[agent] could not freeze filesystems of '%s': %s", monitor.Machine.Name, err.Error())
+		monitor.thawGuest(agent)
+		return nil
+	}
+
+	log.Printf("[agent] froze %d filesystems of '%s'", count, monitor.Machine.Name)
+	return agent
+}
+
+/* thawGuest thaws the guest filesystems and closes agent */
+func (monitor *QemuMonitor) thawGuest(agent *GuestAgentClient) (err error) {
+	defer agent.Close()
+
+	count, err := agent.ThawFilesystems()
+	if err != nil {
+		return fmt.Errorf("could not thaw filesystems of '%s': %s", monitor.Machine.Name, err.Error())
+	}
+
+	log.Printf("[agent] thawed %d filesystems of '%s'", count, monitor.Machine.Name)
+	return nil
+}
+
+/* GetGuestAddresses returns the addresses of interfaces, without loopback and link-local ones */
+func GetGuestAddresses(interfaces []GuestAgentInterface) (addresses []string) {
+	for _, guestInterface := range interfaces {
+		for _, address := range guestInterface.IPAddresses {
+			ip := net.ParseIP(address.Address)
+			if ip == nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() {
+				continue
+			}
+
+			addresses = append(addresses, address.Address)
+		}
+	}
+
+	return addresses
+}
+
+/*
+ * GetGuestIPs asks the agent of a started machine for the guest addresses,
+ * as "10.0.2.15,192.168.1.4", giving it timeout for each answer. Machines
+ * without agent get an error.
+ */
+func (monitor *QemuMonitor) GetGuestIPs(timeout time.Duration) (ips string, err error) {
+	var client *GuestAgentClient
+	var interfaces []GuestAgentInterface
+
+	client, err = monitor.connectAgent(timeout)
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+
+	client.CommandTimeout = timeout
+
+	interfaces, err = client.GetInterfaces()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(GetGuestAddresses(interfaces), ","), nil
+}
@@ -0,0 +1,75 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	config "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+/*
+ * CloneDiskImages gives target its own copy of every writable disk of
+ * source: a qcow2 overlay backed by the source image, or a full flattened
+ * copy when fullCopy is set. The returned list replaces the disks of the
+ * target config; read-only disks and cdroms are shared as they are.
+ */
+func CloneDiskImages(cd *config.ConfigurationData, source *runtime.Machine, target *runtime.Machine, fullCopy bool) (disks config.DiskList, err error) {
+	var img *QemuImg = NewQemuImg()
+
+	disks = make(config.DiskList, 0, len(cd.Disks))
+	for index := range cd.Disks {
+		var disk *config.Disk = &cd.Disks[index]
+		var cloned config.Disk = *disk
+
+		if disk.IsCDRom() || disk.ReadOnly {
+			disks = append(disks, cloned)
+			continue
+		}
+
+		if len(disk.Device) > 0 {
+			return nil, fmt.Errorf("disk '%s' is block device '%s' and cannot be cloned", disk.GetID(index), disk.Device)
+		}
+
+		sourcePath := GetDiskImagePath(disk, index, source)
+		if _, err = os.Stat(sourcePath); os.IsNotExist(err) && disk.IsProvisioned() {
+			/* Never started: target provisions its own image from the same spec */
+			disks = append(disks, cloned)
+			continue
+		}
+
+		/* Clones always get a provisioned qcow2 in their own runtime directory */
+		cloned.ID = disk.GetID(index)
+		cloned.File = ""
+		cloned.Device = ""
+		cloned.Format = config.DiskFormatQcow2
+		cloned.Image = config.DiskImage{BackingFile: sourcePath}
+		targetPath := GetDiskImagePath(&cloned, index, target)
+
+		if fullCopy {
+			log.Printf("[clone] copying '%s' to '%s'", sourcePath, targetPath)
+			err = img.Convert(sourcePath, targetPath, config.DiskFormatQcow2)
+			if err != nil {
+				return nil, err
+			}
+
+			info, err := img.Info(targetPath)
+			if err != nil {
+				return nil, err
+			}
+			/* A full copy stands on its own */
+			cloned.Image = config.DiskImage{Size: fmt.Sprintf("%d", info.VirtualSize)}
+		} else {
+			log.Printf("[clone] creating overlay '%s' on '%s'", targetPath, sourcePath)
+			err = img.CreateOverlay(targetPath, sourcePath, "")
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		disks = append(disks, cloned)
+	}
+
+	return disks, nil
+}
@@ -0,0 +1,128 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	config "luizpuglisi.com/qemuctl/helpers"
+)
+
+const (
+	QemuSerialSocketFileName string = "serial.sock"
+	QemuSerialDefaultID      string = "serial0"
+	QemuConsoleLogFileName   string = "console.log"
+)
+
+func (monitor *QemuMonitor) GetSerialSocketPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuSerialSocketFileName)
+}
+
+func (monitor *QemuMonitor) GetConsoleLogPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuConsoleLogFileName)
+}
+
+func (monitor *QemuMonitor) GetSerialChardevSpec(logEnabled bool) string {
+	var chardevSpec string = fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off",
+		QemuSerialDefaultID, monitor.GetSerialSocketPath())
+
+	if logEnabled {
+		chardevSpec = fmt.Sprintf("%s,logfile=%s,logappend=on", chardevSpec, monitor.GetConsoleLogPath())
+	}
+
+	return chardevSpec
+}
+
+func (monitor *QemuMonitor) GetSerialSpec() string {
+	return fmt.Sprintf("chardev:%s", QemuSerialDefaultID)
+}
+
+/*
+ * RotateConsoleLog shifts console.log to console.log.1 (and so on, keeping
+ * LogKeep files) once it grows past LogMaxSize. This is done before the
+ * machine starts; while it runs, only the daemon rotates the log, see
+ * RotateRunningConsoleLog.
+ */
+func (monitor *QemuMonitor) RotateConsoleLog(cd *config.ConfigurationData) (err error) {
+	return monitor.rotateConsoleLog(cd, false)
+}
+
+/*
+ * RotateRunningConsoleLog rotates the log of a running machine. QEMU keeps
+ * it open, appending, so it is copied to console.log.1 and truncated in
+ * place: output written in between is lost.
+ */
+func (monitor *QemuMonitor) RotateRunningConsoleLog(cd *config.ConfigurationData) (err error) {
+	return monitor.rotateConsoleLog(cd, true)
+}
+
+func (monitor *QemuMonitor) rotateConsoleLog(cd *config.ConfigurationData, running bool) (err error) {
+	var logPath string = monitor.GetConsoleLogPath()
+	var maxSize int64
+
+	if !cd.Console.Log {
+		return nil
+	}
+
+	maxSize, err = config.ParseSize(cd.Console.LogMaxSize)
+	if err != nil {
+		return fmt.Errorf("console.logMaxSize: %s", err.Error())
+	}
+
+	fileInfo, err := os.Stat(logPath)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fileInfo.Size() < maxSize {
+		return nil
+	}
+
+	log.Printf("[console] rotating '%s' (%d bytes)", logPath, fileInfo.Size())
+
+	if cd.Console.LogKeep > 0 {
+		os.Remove(fmt.Sprintf("%s.%d", logPath, cd.Console.LogKeep))
+		for index := cd.Console.LogKeep - 1; index > 0; index-- {
+			os.Rename(fmt.Sprintf("%s.%d", logPath, index), fmt.Sprintf("%s.%d", logPath, index+1))
+		}
+
+		if !running {
+			return os.Rename(logPath, logPath+".1")
+		}
+
+		err = copyFile(logPath, logPath+".1")
+		if err != nil {
+			return err
+		}
+	}
+
+	if running {
+		return os.Truncate(logPath, 0)
+	}
+
+	return os.Remove(logPath)
+}
+
+func copyFile(sourcePath string, destinationPath string) (err error) {
+	source, err := os.Open(sourcePath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	destination, err := os.OpenFile(destinationPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(destination, source)
+	if err != nil {
+		destination.Close()
+		return err
+	}
+
+	return destination.Close()
+}
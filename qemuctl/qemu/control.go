@@ -0,0 +1,63 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// Pause freezes the guest CPUs; QEMU keeps running
+func (monitor *QemuMonitor) Pause() error {
+	return monitor.executeCommand(QmpStopCommand, nil)
+}
+
+// Resume lets a paused guest run again
+func (monitor *QemuMonitor) Resume() error {
+	return monitor.executeCommand(QmpContCommand, nil)
+}
+
+// Reset is a hard reset of the guest, like pressing the reset button
+func (monitor *QemuMonitor) Reset() error {
+	return monitor.executeCommand(QmpSystemResetCommand, nil)
+}
+
+// PauseMachine pauses a running machine and records it as paused
+func PauseMachine(machine *runtime.Machine) (err error) {
+	if machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is already paused", machine.Name)
+	}
+
+	if !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", machine.Name)
+	}
+
+	err = NewQemuMonitor(machine).Pause()
+	if err != nil {
+		return err
+	}
+
+	return machine.UpdateStatus(runtime.MachineStatusPaused)
+}
+
+// ResumeMachine resumes a paused machine and records it as started
+func ResumeMachine(machine *runtime.Machine) (err error) {
+	if !machine.IsPaused() {
+		return fmt.Errorf("machine '%s' is not paused", machine.Name)
+	}
+
+	err = NewQemuMonitor(machine).Resume()
+	if err != nil {
+		return err
+	}
+
+	return machine.UpdateStatus(runtime.MachineStatusStarted)
+}
+
+// ResetMachine resets a started machine; a paused one stays paused
+func ResetMachine(machine *runtime.Machine) (err error) {
+	if !machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", machine.Name)
+	}
+
+	return NewQemuMonitor(machine).Reset()
+}
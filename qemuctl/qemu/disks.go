@@ -0,0 +1,225 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+	"strings"
+
+	cloudinit "luizpuglisi.com/qemuctl/cloudinit"
+	config "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	QemuSCSIControllerID string = "scsi0"
+	QemuUSBControllerID  string = "usb0"
+)
+
+type diskCacheMode struct {
+	direct     bool
+	noFlush    bool
+	writeCache bool
+}
+
+/* Cache modes as described in qemu(1), -drive cache= */
+var diskCacheModes = map[string]diskCacheMode{
+	"writeback":    {direct: false, noFlush: false, writeCache: true},
+	"none":         {direct: true, noFlush: false, writeCache: true},
+	"writethrough": {direct: false, noFlush: false, writeCache: false},
+	"directsync":   {direct: true, noFlush: false, writeCache: false},
+	"unsafe":       {direct: false, noFlush: true, writeCache: true},
+}
+
+/* Drivers of the controllers disks may sit on, by id */
+var diskControllers = map[string]string{
+	QemuSCSIControllerID: "virtio-scsi-pci",
+	QemuUSBControllerID:  "qemu-xhci",
+}
+
+/* getDiskCacheMode returns the cache mode of disk, writeback unless told otherwise */
+func getDiskCacheMode(disk *config.Disk, nodeName string) (cacheMode diskCacheMode, err error) {
+	if len(disk.Cache) == 0 {
+		return diskCacheModes["writeback"], nil
+	}
+
+	cacheMode, found := diskCacheModes[disk.Cache]
+	if !found {
+		return cacheMode, fmt.Errorf("disk '%s': invalid cache mode '%s'", nodeName, disk.Cache)
+	}
+
+	return cacheMode, nil
+}
+
+func onOff(flag bool) string {
+	if flag {
+		return "on"
+	}
+
+	return "off"
+}
+
+/*
+ * getDiskArgs returns the -blockdev/-device pairs for every configured disk.
+ * Each disk gets a protocol node "<id>-file", a format node "<id>" and a
+ * device "<id>-dev"; an empty cdrom drive only gets the device.
+ */
+func getDiskArgs(cd *config.ConfigurationData, machine *runtime.Machine) (diskArgs []string, err error) {
+	var nodeNames map[string]bool = make(map[string]bool)
+	var controllers map[string]bool = make(map[string]bool)
+	var disks config.DiskList = cd.Disks
+
+	/* The cloud-init seed goes last, after the configured disks */
+	if cd.CloudInit.Enabled {
+		disks = append(append(config.DiskList{}, cd.Disks...), cloudinit.GetSeedDisk(machine))
+	}
+
+	for index := range disks {
+		var disk *config.Disk = &disks[index]
+		var nodeName string = disk.GetID(index)
+		var cacheMode diskCacheMode
+		var commonSpec string
+		var protocolSpec string
+		var formatSpec string
+		var deviceSpec string
+		var device diskDevice
+
+		if nodeNames[nodeName] {
+			return nil, fmt.Errorf("duplicate disk id '%s'", nodeName)
+		}
+		nodeNames[nodeName] = true
+
+		imagePath := GetDiskImagePath(disk, index, machine)
+		if len(imagePath) == 0 && !disk.IsCDRom() {
+			return nil, fmt.Errorf("disk '%s' has no file or device", nodeName)
+		}
+
+		cacheMode, err = getDiskCacheMode(disk, nodeName)
+		if err != nil {
+			return nil, err
+		}
+
+		readOnly := disk.ReadOnly || disk.IsCDRom()
+
+		/* Options shared by the protocol and format nodes */
+		commonSpec = ""
+		if len(disk.Cache) > 0 {
+			commonSpec = fmt.Sprintf("%s,cache.direct=%s,cache.no-flush=%s",
+				commonSpec, onOff(cacheMode.direct), onOff(cacheMode.noFlush))
+		}
+		if readOnly {
+			commonSpec = fmt.Sprintf("%s,read-only=on", commonSpec)
+		}
+		if disk.Discard {
+			commonSpec = fmt.Sprintf("%s,discard=unmap", commonSpec)
+		}
+
+		// -- Protocol node
+		protocolDriver := "file"
+		if len(disk.Device) > 0 {
+			protocolDriver = "host_device"
+		}
+		protocolSpec = fmt.Sprintf("driver=%s,node-name=%s-file,filename=%s%s",
+			protocolDriver, nodeName, imagePath, commonSpec)
+		if len(disk.AIO) > 0 {
+			protocolSpec = fmt.Sprintf("%s,aio=%s", protocolSpec, disk.AIO)
+		}
+
+		// -- Format node
+		formatSpec = fmt.Sprintf("driver=%s,node-name=%s,file=%s-file%s",
+			disk.GetFormat(), nodeName, nodeName, commonSpec)
+
+		// -- Guest device
+		device, err = getDiskDevice(disk, nodeName)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(device.controller) > 0 && !controllers[device.controller] {
+			diskArgs = append(diskArgs, "-device",
+				fmt.Sprintf("%s,id=%s", diskControllers[device.controller], device.controller))
+			controllers[device.controller] = true
+		}
+
+		deviceSpec = device.driver
+		for _, property := range device.properties {
+			deviceSpec = fmt.Sprintf("%s,%s=%s", deviceSpec, property[0], property[1])
+		}
+		if disk.HasMedium() {
+			deviceSpec = fmt.Sprintf("%s,drive=%s", deviceSpec, nodeName)
+		}
+		deviceSpec = fmt.Sprintf("%s,id=%s", deviceSpec, GetDeviceID(nodeName))
+		if !cacheMode.writeCache {
+			deviceSpec = fmt.Sprintf("%s,write-cache=off", deviceSpec)
+		}
+		if disk.BootIndex != nil {
+			deviceSpec = fmt.Sprintf("%s,bootindex=%d", deviceSpec, *disk.BootIndex)
+		}
+
+		/* An empty cdrom drive has no nodes, only the device */
+		if !disk.HasMedium() {
+			diskArgs = append(diskArgs, "-device", deviceSpec)
+			continue
+		}
+
+		diskArgs = append(diskArgs,
+			"-blockdev", protocolSpec,
+			"-blockdev", formatSpec,
+			"-device", deviceSpec)
+	}
+
+	return diskArgs, nil
+}
+
+// GetDeviceID returns the id of the guest device of a disk or interface
+func GetDeviceID(id string) string {
+	return id + "-dev"
+}
+
+/* diskDevice is the guest side of a disk, without its drive and id */
+type diskDevice struct {
+	driver     string
+	controller string
+	properties [][2]string
+}
+
+/* getDiskDevice picks the guest device of disk from its interface and media */
+func getDiskDevice(disk *config.Disk, nodeName string) (device diskDevice, err error) {
+	switch disk.GetInterface() {
+	case config.DiskInterfaceVirtioBlk:
+		device.driver = "virtio-blk-pci"
+	case config.DiskInterfaceVirtioSCSI:
+		{
+			device.driver = "scsi-hd"
+			if disk.IsCDRom() {
+				device.driver = "scsi-cd"
+			}
+			device.controller = QemuSCSIControllerID
+			device.properties = [][2]string{{"bus", QemuSCSIControllerID + ".0"}}
+		}
+	case config.DiskInterfaceIDE:
+		{
+			device.driver = "ide-hd"
+			if disk.IsCDRom() {
+				device.driver = "ide-cd"
+			}
+		}
+	case config.DiskInterfaceNVMe:
+		{
+			device.driver = "nvme"
+			device.properties = [][2]string{{"serial", nodeName}}
+		}
+	case config.DiskInterfaceUSB:
+		{
+			device.driver = "usb-storage"
+			device.controller = QemuUSBControllerID
+			device.properties = [][2]string{{"bus", QemuUSBControllerID + ".0"}}
+		}
+	default:
+		return device, fmt.Errorf("disk '%s': invalid interface '%s'", nodeName, disk.GetInterface())
+	}
+
+	if disk.IsCDRom() && !strings.HasSuffix(device.driver, "-cd") {
+		return device, fmt.Errorf("disk '%s': cdrom media needs an ide or virtio-scsi interface", nodeName)
+	}
+
+	return device, nil
+}
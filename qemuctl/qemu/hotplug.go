@@ -0,0 +1,556 @@
+package qemuctl_qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	config "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	/* Root ports made for machine.hotplugSlots are hotplug0, hotplug1... */
+	QemuHotplugPortPrefix string = "hotplug"
+	/* Where QOM keeps the devices that have an id */
+	QemuPeripheralPath string = "/machine/peripheral"
+
+	QemuDeviceReleaseTimeout time.Duration = 30 * time.Second
+)
+
+type qmpObjectProperty struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+}
+
+type qmpPciDevice struct {
+	QdevID    string `json:"qdev_id"`
+	PciBridge *struct {
+		Devices []qmpPciDevice `json:"devices"`
+	} `json:"pci_bridge"`
+}
+
+type qmpPciBus struct {
+	Devices []qmpPciDevice `json:"devices"`
+}
+
+type qmpDeviceDeletedData struct {
+	Device string `json:"device"`
+	Path   string `json:"path"`
+}
+
+// Hotplug adds and removes devices of a started machine over QMP. Devices
+// get the ids getQemuArgs gives them, so that configured ones can be removed
+// as well as added ones.
+type Hotplug struct {
+	Machine       *runtime.Machine
+	Configuration *config.ConfigurationData
+	/* How long the guest has to release a device on detach */
+	Timeout time.Duration
+
+	client *QmpClient
+}
+
+func NewHotplug(machine *runtime.Machine, configData *config.ConfigurationData) *Hotplug {
+	return &Hotplug{
+		Machine:       machine,
+		Configuration: configData,
+		Timeout:       QemuDeviceReleaseTimeout,
+	}
+}
+
+/* connect opens the connection a whole operation runs on, events included */
+func (hotplug *Hotplug) connect() (err error) {
+	if !hotplug.Machine.IsStarted() {
+		return fmt.Errorf("machine '%s' is not started", hotplug.Machine.Name)
+	}
+
+	hotplug.client, err = NewQemuMonitor(hotplug.Machine).Connect()
+	return err
+}
+
+func (hotplug *Hotplug) close() {
+	hotplug.client.Close()
+	hotplug.client = nil
+}
+
+// AttachDisk adds disk, whose ID must be set: its nodes, its controller if
+// the machine has none yet, then the guest device.
+func (hotplug *Hotplug) AttachDisk(disk *config.Disk) (err error) {
+	var nodeName string = disk.ID
+	var deviceArguments map[string]interface{}
+
+	/* The IDE bus has no hot-plug; its cdroms can still change medium */
+	if disk.GetInterface() == config.DiskInterfaceIDE {
+		return fmt.Errorf("disk '%s': ide disks cannot be hot-plugged", nodeName)
+	}
+
+	device, err := getDiskDevice(disk, nodeName)
+	if err != nil {
+		return err
+	}
+
+	cacheMode, err := getDiskCacheMode(disk, nodeName)
+	if err != nil {
+		return err
+	}
+
+	err = hotplug.connect()
+	if err != nil {
+		return err
+	}
+	defer hotplug.close()
+
+	if disk.HasMedium() {
+		err = hotplug.addBlockdev(disk, nodeName)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(device.controller) > 0 {
+		err = hotplug.addController(device.controller)
+	}
+
+	if err == nil {
+		deviceArguments = getDeviceArguments(device.driver, GetDeviceID(nodeName), device.properties)
+		if disk.HasMedium() {
+			deviceArguments["drive"] = nodeName
+		}
+		if !cacheMode.writeCache {
+			deviceArguments["write-cache"] = "off"
+		}
+
+		/* Disks on a controller go on its bus; the others are PCI devices */
+		err = hotplug.addDevice(deviceArguments, len(device.controller) == 0)
+	}
+
+	if err != nil && disk.HasMedium() {
+		hotplug.deleteBlockdev(nodeName)
+	}
+
+	return err
+}
+
+// DetachDisk removes the disk diskID once the guest has released it
+func (hotplug *Hotplug) DetachDisk(diskID string) (err error) {
+	err = hotplug.connect()
+	if err != nil {
+		return err
+	}
+	defer hotplug.close()
+
+	err = hotplug.removeDevice(GetDeviceID(diskID))
+	if err != nil {
+		return err
+	}
+
+	/* An empty cdrom drive has no nodes: failing to delete them is not an error */
+	if err = hotplug.deleteBlockdev(diskID); err != nil {
+		log.Printf("[hotplug] '%s' left nodes behind: %s", diskID, err.Error())
+	}
+
+	return nil
+}
+
+// AttachNIC adds nic, whose ID must be set: its backend, then the guest device
+func (hotplug *Hotplug) AttachNIC(nic *config.NetworkInterface) (err error) {
+	var deviceArguments map[string]interface{}
+
+	netdevArguments, err := getNetdevArguments(nic, nic.ID)
+	if err != nil {
+		return err
+	}
+
+	err = hotplug.connect()
+	if err != nil {
+		return err
+	}
+	defer hotplug.close()
+
+	err = hotplug.client.Execute(QmpNetdevAddCommand, netdevArguments, nil)
+	if err != nil {
+		return err
+	}
+
+	deviceArguments = getDeviceArguments(nic.GetModel(), GetDeviceID(nic.ID), nil)
+	deviceArguments["netdev"] = nic.ID
+	if len(nic.MacAddress) > 0 {
+		deviceArguments["mac"] = nic.MacAddress
+	}
+
+	err = hotplug.addDevice(deviceArguments, true)
+	if err != nil {
+		hotplug.client.Execute(QmpNetdevDelCommand, map[string]interface{}{"id": nic.ID}, nil)
+	}
+
+	return err
+}
+
+// DetachNIC removes the interface netID once the guest has released it
+func (hotplug *Hotplug) DetachNIC(netID string) (err error) {
+	err = hotplug.connect()
+	if err != nil {
+		return err
+	}
+	defer hotplug.close()
+
+	err = hotplug.removeDevice(GetDeviceID(netID))
+	if err != nil {
+		return err
+	}
+
+	return hotplug.client.Execute(QmpNetdevDelCommand, map[string]interface{}{"id": netID}, nil)
+}
+
+// EjectMedium opens the tray of the cdrom drive diskID and removes its medium
+func (hotplug *Hotplug) EjectMedium(diskID string) (err error) {
+	err = hotplug.connect()
+	if err != nil {
+		return err
+	}
+	defer hotplug.close()
+
+	return hotplug.eject(diskID)
+}
+
+// InsertMedium puts the file of disk, a cdrom drive, in it and closes the
+// tray. The medium it held, if any, is ejected first.
+func (hotplug *Hotplug) InsertMedium(disk *config.Disk) (err error) {
+	var deviceID string = GetDeviceID(disk.ID)
+
+	err = hotplug.connect()
+	if err != nil {
+		return err
+	}
+	defer hotplug.close()
+
+	err = hotplug.eject(disk.ID)
+	if err != nil {
+		return err
+	}
+
+	err = hotplug.addBlockdev(disk, disk.ID)
+	if err != nil {
+		return err
+	}
+
+	err = hotplug.client.Execute(QmpBlockdevInsertMediumCommand, map[string]interface{}{
+		"id":        deviceID,
+		"node-name": disk.ID,
+	}, nil)
+	if err != nil {
+		hotplug.deleteBlockdev(disk.ID)
+		return err
+	}
+
+	return hotplug.client.Execute(QmpBlockdevCloseTrayCommand, map[string]interface{}{"id": deviceID}, nil)
+}
+
+/* eject forces the tray open, even if the guest locked it, and drops the medium nodes */
+func (hotplug *Hotplug) eject(diskID string) (err error) {
+	var deviceID string = GetDeviceID(diskID)
+
+	err = hotplug.client.Execute(QmpBlockdevOpenTrayCommand, map[string]interface{}{
+		"id":    deviceID,
+		"force": true,
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	/* Nothing happens if the drive is empty */
+	err = hotplug.client.Execute(QmpBlockdevRemoveMediumCommand, map[string]interface{}{"id": deviceID}, nil)
+	if err != nil {
+		return err
+	}
+
+	if err = hotplug.deleteBlockdev(diskID); err != nil {
+		log.Printf("[hotplug] no medium nodes to delete for '%s': %s", diskID, err.Error())
+	}
+
+	return nil
+}
+
+/* addBlockdev adds the protocol and format nodes of disk, named as getDiskArgs names them */
+func (hotplug *Hotplug) addBlockdev(disk *config.Disk, nodeName string) (err error) {
+	var imagePath string = GetDiskImagePath(disk, len(hotplug.Configuration.Disks), hotplug.Machine)
+
+	protocolArguments, formatArguments, err := getBlockdevArguments(disk, nodeName, imagePath)
+	if err != nil {
+		return err
+	}
+
+	err = hotplug.client.Execute(QmpBlockdevAddCommand, protocolArguments, nil)
+	if err != nil {
+		return err
+	}
+
+	err = hotplug.client.Execute(QmpBlockdevAddCommand, formatArguments, nil)
+	if err != nil {
+		hotplug.client.Execute(QmpBlockdevDelCommand, map[string]interface{}{"node-name": nodeName + "-file"}, nil)
+		return err
+	}
+
+	return nil
+}
+
+/* deleteBlockdev deletes the format node of a disk, then its protocol node */
+func (hotplug *Hotplug) deleteBlockdev(nodeName string) (err error) {
+	for _, name := range []string{nodeName, nodeName + "-file"} {
+		deleteErr := hotplug.client.Execute(QmpBlockdevDelCommand, map[string]interface{}{"node-name": name}, nil)
+		if deleteErr != nil && err == nil {
+			err = deleteErr
+		}
+	}
+
+	return err
+}
+
+// ListDeviceIDs returns the ids of the devices the machine has now,
+// configured or attached since it started.
+func (hotplug *Hotplug) ListDeviceIDs() (deviceIDs []string, err error) {
+	err = hotplug.connect()
+	if err != nil {
+		return nil, err
+	}
+	defer hotplug.close()
+
+	return hotplug.listDeviceIDs()
+}
+
+func (hotplug *Hotplug) listDeviceIDs() (deviceIDs []string, err error) {
+	var properties []qmpObjectProperty
+
+	err = hotplug.client.Execute(QmpQomListCommand, map[string]interface{}{"path": QemuPeripheralPath}, &properties)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Devices are children, the other properties are "type" and such */
+	for _, property := range properties {
+		if strings.HasPrefix(property.Type, "child<") {
+			deviceIDs = append(deviceIDs, property.Name)
+		}
+	}
+
+	return deviceIDs, nil
+}
+
+/* addController adds the disk controller controllerID unless the machine has it */
+func (hotplug *Hotplug) addController(controllerID string) (err error) {
+	deviceIDs, err := hotplug.listDeviceIDs()
+	if err != nil {
+		return err
+	}
+
+	for _, deviceID := range deviceIDs {
+		if deviceID == controllerID {
+			return nil
+		}
+	}
+
+	log.Printf("[hotplug] adding controller '%s' to '%s'", controllerID, hotplug.Machine.Name)
+	return hotplug.addDevice(getDeviceArguments(diskControllers[controllerID], controllerID, nil), true)
+}
+
+/*
+ * addDevice runs device_add. On q35, PCI devices cannot go on the root bus:
+ * they take a free root port, see machine.hotplugSlots.
+ */
+func (hotplug *Hotplug) addDevice(arguments map[string]interface{}, pci bool) (err error) {
+	if pci && hotplug.Configuration.HasPCIExpress() {
+		port, err := hotplug.findFreePort()
+		if err != nil {
+			return err
+		}
+		arguments["bus"] = port
+	}
+
+	return hotplug.client.Execute(QmpDeviceAddCommand, arguments, nil)
+}
+
+/* findFreePort returns the first hot-plug root port with nothing behind it */
+func (hotplug *Hotplug) findFreePort() (port string, err error) {
+	var buses []qmpPciBus
+
+	err = hotplug.client.Execute(QmpQueryPciCommand, nil, &buses)
+	if err != nil {
+		return "", err
+	}
+
+	for _, bus := range buses {
+		for _, device := range bus.Devices {
+			if strings.HasPrefix(device.QdevID, QemuHotplugPortPrefix) &&
+				device.PciBridge != nil && len(device.PciBridge.Devices) == 0 {
+				return device.QdevID, nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("machine '%s' has no free hot-plug slot (raise machine.hotplugSlots and restart it)",
+		hotplug.Machine.Name)
+}
+
+/*
+ * removeDevice asks for deviceID to go away and waits until it has. PCI
+ * devices need the guest to release them, which it may never do.
+ */
+func (hotplug *Hotplug) removeDevice(deviceID string) (err error) {
+	var deadline time.Time = time.Now().Add(hotplug.Timeout)
+
+	err = hotplug.client.Execute(QmpDeviceDelCommand, map[string]interface{}{"id": deviceID}, nil)
+	if err != nil {
+		return err
+	}
+
+	for {
+		var data qmpDeviceDeletedData
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("the guest did not release '%s' within %s", deviceID, hotplug.Timeout)
+		}
+
+		event, err := hotplug.client.WaitEvent(QmpEventDeviceDeleted, remaining)
+		if err != nil {
+			return fmt.Errorf("the guest did not release '%s': %s", deviceID, err.Error())
+		}
+
+		/* Devices with a backend send a first event for it, without an id */
+		if json.Unmarshal(event.Data, &data) == nil && data.Device == deviceID {
+			return nil
+		}
+	}
+}
+
+func getDeviceArguments(driver string, deviceID string, properties [][2]string) (arguments map[string]interface{}) {
+	arguments = map[string]interface{}{
+		"driver": driver,
+		"id":     deviceID,
+	}
+
+	for _, property := range properties {
+		arguments[property[0]] = property[1]
+	}
+
+	return arguments
+}
+
+/* getBlockdevArguments returns the blockdev-add arguments of the two nodes of disk */
+func getBlockdevArguments(disk *config.Disk, nodeName string, imagePath string) (protocol map[string]interface{}, format map[string]interface{}, err error) {
+	var common map[string]interface{} = make(map[string]interface{})
+
+	cacheMode, err := getDiskCacheMode(disk, nodeName)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	/* Options shared by the protocol and format nodes */
+	if len(disk.Cache) > 0 {
+		common["cache"] = map[string]interface{}{
+			"direct":   cacheMode.direct,
+			"no-flush": cacheMode.noFlush,
+		}
+	}
+	if disk.ReadOnly || disk.IsCDRom() {
+		common["read-only"] = true
+	}
+	if disk.Discard {
+		common["discard"] = "unmap"
+	}
+
+	protocol = map[string]interface{}{
+		"driver":    "file",
+		"node-name": nodeName + "-file",
+		"filename":  imagePath,
+	}
+	if len(disk.Device) > 0 {
+		protocol["driver"] = "host_device"
+	}
+	if len(disk.AIO) > 0 {
+		protocol["aio"] = disk.AIO
+	}
+
+	format = map[string]interface{}{
+		"driver":    disk.GetFormat(),
+		"node-name": nodeName,
+		"file":      nodeName + "-file",
+	}
+
+	for key, value := range common {
+		protocol[key] = value
+		format[key] = value
+	}
+
+	return protocol, format, nil
+}
+
+/*
+ * getNetdevArguments returns the netdev_add arguments of nic. Backends that
+ * need more than a netdev (vhost-user and its chardev) cannot be hot-plugged.
+ */
+func getNetdevArguments(nic *config.NetworkInterface, netID string) (arguments map[string]interface{}, err error) {
+	arguments = map[string]interface{}{
+		"type": nic.GetBackend(),
+		"id":   netID,
+	}
+
+	switch nic.GetBackend() {
+	case config.NetworkBackendUser:
+		{
+			if len(nic.User.PortForwards) > 0 || len(nic.User.GuestForwards) > 0 {
+				return nil, fmt.Errorf("interface '%s': forwards cannot be hot-plugged", netID)
+			}
+
+			if len(nic.User.IPSubnet) > 0 {
+				arguments["net"] = nic.User.IPSubnet
+			}
+			if len(nic.User.Hostname) > 0 {
+				arguments["hostname"] = nic.User.Hostname
+			}
+			if nic.User.Restrict {
+				arguments["restrict"] = true
+			}
+		}
+
+	case config.NetworkBackendBridge:
+		{
+			arguments["br"] = nic.Bridge.Interface
+			if len(nic.Bridge.Helper) > 0 {
+				arguments["helper"] = nic.Bridge.Helper
+			}
+		}
+
+	case config.NetworkBackendTap:
+		{
+			if len(nic.Tap.IfName) > 0 {
+				arguments["ifname"] = nic.Tap.IfName
+			}
+			arguments["script"] = getScriptOrNo(nic.Tap.Script)
+			arguments["downscript"] = getScriptOrNo(nic.Tap.DownScript)
+			if nic.Tap.VHost {
+				arguments["vhost"] = true
+			}
+		}
+
+	case config.NetworkBackendSocket:
+		{
+			if len(nic.Socket.Mcast) > 0 {
+				arguments["mcast"] = nic.Socket.Mcast
+			} else {
+				arguments["udp"] = nic.Socket.UDP
+			}
+			if len(nic.Socket.LocalAddress) > 0 {
+				arguments["localaddr"] = nic.Socket.LocalAddress
+			}
+		}
+
+	default:
+		return nil, fmt.Errorf("interface '%s': backend '%s' cannot be hot-plugged", netID, nic.GetBackend())
+	}
+
+	return arguments, nil
+}
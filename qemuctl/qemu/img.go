@@ -0,0 +1,211 @@
+package qemuctl_qemu
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+
+	config "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	QemuImgDefaultBin       string = "qemu-img"
+	QemuImgDefaultFormat    string = "qcow2"
+	QemuImgProvisionedImage string = "disk"
+)
+
+type QemuImgSnapshot struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	VMStateSize int64  `json:"vm-state-size"`
+	DateSeconds int64  `json:"date-sec"`
+}
+
+type QemuImgInfo struct {
+	Filename        string            `json:"filename"`
+	Format          string            `json:"format"`
+	VirtualSize     int64             `json:"virtual-size"`
+	ActualSize      int64             `json:"actual-size"`
+	BackingFilename string            `json:"backing-filename"`
+	Snapshots       []QemuImgSnapshot `json:"snapshots"`
+}
+
+// QemuImg wraps the qemu-img binary
+type QemuImg struct {
+	QemuImgPath string
+}
+
+func NewQemuImg() *QemuImg {
+	qemuImgPath, err := exec.LookPath(QemuImgDefaultBin)
+	if err != nil {
+		qemuImgPath = QemuImgDefaultBin
+	}
+
+	return &QemuImg{
+		QemuImgPath: qemuImgPath,
+	}
+}
+
+func (img *QemuImg) run(args ...string) (output []byte, err error) {
+	log.Printf("[qemu-img] running '%s %s'", img.QemuImgPath, strings.Join(args, " "))
+
+	command := exec.Command(img.QemuImgPath, args...)
+	output, err = command.Output()
+	if err != nil {
+		if exitError, ok := err.(*exec.ExitError); ok && len(exitError.Stderr) > 0 {
+			return nil, fmt.Errorf("qemu-img %s: %s", args[0], strings.TrimSpace(string(exitError.Stderr)))
+		}
+		return nil, err
+	}
+
+	return output, nil
+}
+
+func (img *QemuImg) Info(imagePath string) (info *QemuImgInfo, err error) {
+	var output []byte
+
+	output, err = img.run("info", "--output=json", imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	info = &QemuImgInfo{}
+	err = json.Unmarshal(output, info)
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (img *QemuImg) Create(imagePath string, format string, size string) (err error) {
+	_, err = img.run("create", "-f", format, imagePath, size)
+	return err
+}
+
+/* CreateOverlay creates a qcow2 copy-on-write image on top of backingFile */
+func (img *QemuImg) CreateOverlay(imagePath string, backingFile string, size string) (err error) {
+	var backingInfo *QemuImgInfo
+	var args []string
+
+	backingInfo, err = img.Info(backingFile)
+	if err != nil {
+		return err
+	}
+
+	args = []string{"create", "-f", QemuImgDefaultFormat, "-b", backingFile, "-F", backingInfo.Format, imagePath}
+	if len(size) > 0 {
+		args = append(args, size)
+	}
+
+	_, err = img.run(args...)
+	return err
+}
+
+func (img *QemuImg) Resize(imagePath string, size string) (err error) {
+	_, err = img.run("resize", imagePath, size)
+	return err
+}
+
+func (img *QemuImg) Convert(imagePath string, outputPath string, outputFormat string) (err error) {
+	_, err = img.run("convert", "-p", "-O", outputFormat, imagePath, outputPath)
+	return err
+}
+
+func (img *QemuImg) SnapshotCreate(imagePath string, tag string) (err error) {
+	_, err = img.run("snapshot", "-c", tag, imagePath)
+	return err
+}
+
+func (img *QemuImg) SnapshotApply(imagePath string, tag string) (err error) {
+	_, err = img.run("snapshot", "-a", tag, imagePath)
+	return err
+}
+
+func (img *QemuImg) SnapshotDelete(imagePath string, tag string) (err error) {
+	_, err = img.run("snapshot", "-d", tag, imagePath)
+	return err
+}
+
+func (img *QemuImg) SnapshotList(imagePath string) (snapshots []QemuImgSnapshot, err error) {
+	var info *QemuImgInfo
+
+	info, err = img.Info(imagePath)
+	if err != nil {
+		return nil, err
+	}
+
+	return info.Snapshots, nil
+}
+
+// GetDiskImagePath returns the file or device backing disk; provisioned
+// images live in the machine's runtime directory as <id>.<format>.
+func GetDiskImagePath(disk *config.Disk, index int, machine *runtime.Machine) string {
+	if disk.IsProvisioned() {
+		return fmt.Sprintf("%s/%s.%s", machine.RuntimeDirectory, disk.GetID(index), disk.GetFormat())
+	}
+
+	if len(disk.Device) > 0 {
+		return disk.Device
+	}
+
+	return disk.File
+}
+
+// GetSnapshotImages returns the writable qcow2 images of machine, the ones
+// that hold internal snapshots.
+func GetSnapshotImages(cd *config.ConfigurationData, machine *runtime.Machine) (images []string) {
+	for index := range cd.Disks {
+		disk := &cd.Disks[index]
+
+		if disk.IsCDRom() || disk.ReadOnly || disk.GetFormat() != config.DiskFormatQcow2 {
+			continue
+		}
+
+		images = append(images, GetDiskImagePath(disk, index, machine))
+	}
+
+	return images
+}
+
+// ProvisionDiskImages creates the images of every disk with an image spec,
+// unless they already exist.
+func ProvisionDiskImages(cd *config.ConfigurationData, machine *runtime.Machine) (err error) {
+	var img *QemuImg = NewQemuImg()
+
+	for index := range cd.Disks {
+		disk := &cd.Disks[index]
+
+		if !disk.IsProvisioned() {
+			continue
+		}
+
+		imagePath := GetDiskImagePath(disk, index, machine)
+		if _, err = os.Stat(imagePath); err == nil {
+			log.Printf("[provision] disk image '%s' already exists", imagePath)
+			continue
+		}
+
+		if len(disk.Image.BackingFile) > 0 {
+			if disk.GetFormat() != config.DiskFormatQcow2 {
+				return fmt.Errorf("disk '%s': overlays must be qcow2", disk.GetID(index))
+			}
+
+			log.Printf("[provision] creating overlay '%s' on '%s'", imagePath, disk.Image.BackingFile)
+			err = img.CreateOverlay(imagePath, disk.Image.BackingFile, disk.Image.Size)
+		} else {
+			log.Printf("[provision] creating image '%s' (%s)", imagePath, disk.Image.Size)
+			err = img.Create(imagePath, disk.GetFormat(), disk.Image.Size)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
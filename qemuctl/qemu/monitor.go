@@ -1,14 +1,13 @@
 package qemuctl_qemu
 
 import (
-	"encoding/json"
 	"fmt"
-	"io"
 	"log"
-	"net"
 	"os"
 	"strings"
+	"time"
 
+	config "luizpuglisi.com/qemuctl/helpers"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
 
@@ -19,6 +18,11 @@ func init() {
 const (
 	QemuMonitorSocketFileName string = "qemu-monitor.sock"
 	QemuMonitorDefaultID      string = "qemu-mon-qmp"
+	/* QEMU serves one client per QMP socket: the daemon keeps its own for events */
+	QemuEventsSocketFileName string = "qemu-events.sock"
+	QemuEventsMonitorID      string = "qemu-events-qmp"
+
+	QemuMonitorSnapshotTimeout time.Duration = 10 * time.Minute
 )
 
 type QemuMonitor struct {
@@ -31,36 +35,6 @@ func NewQemuMonitor(machine *runtime.Machine) *QemuMonitor {
 	}
 }
 
-func (monitor *QemuMonitor) ReadQmpHeader(unix net.Conn) (qmpHeader *QmpHeader, err error) {
-	const BufferSize = 1024
-
-	var dataBytes []byte = make([]byte, 0)
-	var buffer []byte = make([]byte, BufferSize)
-	var nBytes int = 0
-
-	qmpHeader = &QmpHeader{}
-
-	dataBytes = make([]byte, 0)
-	for nBytes, err = unix.Read(buffer); err == nil && nBytes > 0; {
-		dataBytes = append(dataBytes, buffer[:nBytes]...)
-		if nBytes < BufferSize {
-			break
-		}
-	}
-
-	if err != nil {
-		return nil, err
-	}
-
-	/* Now that we have dataBytes, Unmarshal it to QmpHeader */
-	err = json.Unmarshal(dataBytes, qmpHeader)
-	if err != nil {
-		return nil, fmt.Errorf("json error: %s", err.Error())
-	}
-
-	return qmpHeader, nil
-}
-
 func (monitor *QemuMonitor) GetUnixSocketPath() string {
 	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuMonitorSocketFileName)
 }
@@ -74,6 +48,19 @@ func (monitor *QemuMonitor) GetMonitorSpec() string {
 	return fmt.Sprintf("chardev:%s", QemuMonitorDefaultID)
 }
 
+func (monitor *QemuMonitor) GetEventsSocketPath() string {
+	return fmt.Sprintf("%s/%s", monitor.Machine.RuntimeDirectory, QemuEventsSocketFileName)
+}
+
+func (monitor *QemuMonitor) GetEventsChardevSpec() string {
+	return fmt.Sprintf("socket,id=%s,path=%s,server=on,wait=off",
+		QemuEventsMonitorID, monitor.GetEventsSocketPath())
+}
+
+func (monitor *QemuMonitor) GetEventsMonitorSpec() string {
+	return fmt.Sprintf("chardev:%s", QemuEventsMonitorID)
+}
+
 func (monitor *QemuMonitor) GetPidFilePath() string {
 	return fmt.Sprintf("%s/%s",
 		monitor.Machine.RuntimeDirectory, runtime.RuntimeQemuPIDFileName)
@@ -95,50 +82,36 @@ func (monitor *QemuMonitor) GetPidFileData() (pidString string, err error) {
 	return pidString, nil
 }
 
-func (monitor *QemuMonitor) GetControlSocket() (unix net.Conn, err error) {
-	var qmpCommand QmpBasicCommand
-
-	log.Printf("[InitializeSocket] opening socket '%s'\n", monitor.GetUnixSocketPath())
-	{
-		unix, err = net.Dial("unix", monitor.GetUnixSocketPath())
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	log.Printf("[InitializeSocket] Reading QMP header")
-	{
-		_, err = monitor.ReadQmpHeader(unix)
-		if err != nil {
-			return nil, err
-		}
-	}
+func (monitor *QemuMonitor) Connect() (client *QmpClient, err error) {
+	log.Printf("[monitor] connecting to '%s'", monitor.GetUnixSocketPath())
 
-	log.Printf("[initialize] enabling QMP capabilities")
-	qmpCommand.Command = QmpCapabilitiesCommand
-	_, err = qmpCommand.Execute(unix)
+	client, err = DialQmp(monitor.GetUnixSocketPath())
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("[InitializeSocket] socket initialized")
-	return unix, nil
+	log.Printf("[monitor] QMP connection initialized")
+	return client, nil
+}
+
+// ConnectEvents connects to the monitor qemuctl daemon keeps open on the
+// machines it supervises, leaving the main one to commands.
+func (monitor *QemuMonitor) ConnectEvents() (client *QmpClient, err error) {
+	return DialQmp(monitor.GetEventsSocketPath())
 }
 
 func (monitor *QemuMonitor) QueryStatus() (result *QmpQueryStatusResult, err error) {
-	var unix net.Conn
-	var qmpCommand QmpCommandQueryStatus
+	var client *QmpClient
 
-	/* Initialize socket */
-	log.Printf("[QueryStatus] initializing socket\n")
-	unix, err = monitor.GetControlSocket()
+	log.Printf("[QueryStatus] connecting to monitor")
+	client, err = monitor.Connect()
 	if err != nil {
 		return nil, err
 	}
+	defer client.Close()
 
-	/* Create QueryStatus command and send it */
-	log.Printf("[QueryStatus] create query-status command\n")
-	result, err = qmpCommand.Execute(unix)
+	result = &QmpQueryStatusResult{}
+	err = client.Execute(QmpQueryStatusCommand, nil, result)
 	if err != nil {
 		return nil, err
 	}
@@ -146,42 +119,91 @@ func (monitor *QemuMonitor) QueryStatus() (result *QmpQueryStatusResult, err err
 	return result, nil
 }
 
-func (monitor *QemuMonitor) SendShutdownCommand() (err error) {
-	var unix net.Conn
-	var shutdownCommand QmpBasicCommand
+/* executeCommand runs a QMP command that returns nothing on a new connection */
+func (monitor *QemuMonitor) executeCommand(command string, arguments interface{}) (err error) {
+	var client *QmpClient
 
-	log.Printf("[SendShutdownCommand] initializing socket")
-	unix, err = monitor.GetControlSocket()
+	client, err = monitor.Connect()
 	if err != nil {
 		return err
 	}
-	defer unix.Close()
+	defer client.Close()
 
-	log.Printf("[SendShutdownCommand] sending shutdown command")
-	shutdownCommand = QmpBasicCommand{
-		Command: QmpSystemPowerdownCommand,
+	log.Printf("[monitor] sending %s to '%s'", command, monitor.Machine.Name)
+	return client.Execute(command, arguments, nil)
+}
+
+/*
+ * snapshotCommand runs one of the HMP snapshot commands (savevm, loadvm,
+ * delvm). These commands print nothing on success, so any output is an error.
+ * The tag goes unquoted into the command line, so only plain names pass.
+ */
+func (monitor *QemuMonitor) snapshotCommand(command string, tag string) (err error) {
+	var client *QmpClient
+	var output string
+
+	if !config.IsValidName(tag) {
+		return fmt.Errorf("invalid snapshot tag '%s' (letters, digits, '.', '_' and '-' only)", tag)
 	}
-	_, err = shutdownCommand.Execute(unix)
+
+	client, err = monitor.Connect()
 	if err != nil {
 		return err
 	}
+	defer client.Close()
 
-	/* Now read incoming events */
-	err = nil
-	log.Printf("[SendShutdownCommand] reading incoming events")
-	qmpEvent := QmpEventResult{}
-	for {
-		err = qmpEvent.ReadEvent(unix)
-		if err != nil {
-			break
-		}
-		log.Printf("[SendShutdownCommand] event received: %v", qmpEvent)
+	client.CommandTimeout = QemuMonitorSnapshotTimeout
+
+	log.Printf("[monitor] running '%s %s'", command, tag)
+	output, err = client.HumanMonitorCommand(fmt.Sprintf("%s %s", command, tag))
+	if err != nil {
+		return err
 	}
 
-	if err != nil && err == io.EOF {
-		log.Printf("[monitor] ReadEvent returned err == EOF; ignoring")
-		err = nil
+	if output = strings.TrimSpace(output); len(output) > 0 {
+		return fmt.Errorf("%s: %s", command, output)
+	}
+
+	return nil
+}
+
+/*
+ * SaveSnapshot saves the machine state as tag. When the guest agent answers,
+ * the guest filesystems are frozen meanwhile, so the disks are consistent.
+ */
+func (monitor *QemuMonitor) SaveSnapshot(tag string) (err error) {
+	var agent *GuestAgentClient = monitor.freezeGuest()
+
+	err = monitor.snapshotCommand("savevm", tag)
+	if agent != nil {
+		if thawErr := monitor.thawGuest(agent); err == nil {
+			err = thawErr
+		}
 	}
 
 	return err
 }
+
+/* LoadSnapshot restores tag; states saved with frozen filesystems come back frozen, so they are thawed */
+func (monitor *QemuMonitor) LoadSnapshot(tag string) (err error) {
+	err = monitor.snapshotCommand("loadvm", tag)
+	if err != nil {
+		return err
+	}
+
+	if monitor.Machine.IsPaused() || !monitor.HasAgentChannel() {
+		return nil
+	}
+
+	agent, err := monitor.ConnectAgent()
+	if err != nil {
+		log.Printf("[monitor] %s, not thawing filesystems", err.Error())
+		return nil
+	}
+
+	return monitor.thawGuest(agent)
+}
+
+func (monitor *QemuMonitor) DeleteSnapshot(tag string) error {
+	return monitor.snapshotCommand("delvm", tag)
+}
@@ -7,19 +7,31 @@ import (
 	"os/exec"
 	"regexp"
 	"strings"
+	"syscall"
 
+	cloudinit "luizpuglisi.com/qemuctl/cloudinit"
 	config "luizpuglisi.com/qemuctl/helpers"
 	runtime "luizpuglisi.com/qemuctl/runtime"
 )
 
 const (
 	QemuDefaultSystemBin string = "qemu-system-x86_64"
+	/* Memory backend shared with vhost-user processes */
+	QemuSharedMemoryID string = "qemuctl-mem"
+)
+
+const (
+	QemuOutputLogFileName string = "qemu.log"
 )
 
 type QemuCommand struct {
 	QemuPath      string
 	Configuration *config.ConfigurationData
 	Monitor       *QemuMonitor
+	/* Supervised processes are children of qemuctl daemon: no -daemonize */
+	Supervised bool
+	/* State saved by suspend, loaded with -incoming */
+	IncomingFile string
 }
 
 func NewQemuCommand(configData *config.ConfigurationData, qemuMonitor *QemuMonitor) (qemu *QemuCommand) {
@@ -42,6 +54,36 @@ func NewQemuCommand(configData *config.ConfigurationData, qemuMonitor *QemuMonit
 	}
 }
 
+/*
+ * NewMachineCommand builds the QEMU command of machine the way a start does:
+ * MAC addresses checked, host ports allocated, private networks attached
+ * and the state saved by suspend loaded. supervised tells whether qemuctl
+ * daemon runs it. Nothing is written: starts call PrepareRestore and Prepare.
+ */
+func NewMachineCommand(configData *config.ConfigurationData, machine *runtime.Machine, supervised bool) (qemu *QemuCommand, err error) {
+	err = config.CheckMacAddresses(configData, machine.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	/* Resolved again on every (re)start: "auto" ports may change */
+	err = config.AllocateHostPorts(configData, machine.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	err = config.AttachNetworks(configData)
+	if err != nil {
+		return nil, err
+	}
+
+	qemu = NewQemuCommand(configData, NewQemuMonitor(machine))
+	qemu.Supervised = supervised
+	qemu.IncomingFile = GetRestoreFile(machine)
+
+	return qemu, nil
+}
+
 func (qemu *QemuCommand) getBoolString(qemuFlag bool, trueValue string, falseValue string) string {
 	if qemuFlag {
 		return trueValue
@@ -67,10 +109,10 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	var machineSpec string
 	var netSpec string
 
+	/* Only paths are taken from the machine: building the argv has no side effects */
 	var cd *config.ConfigurationData = qemu.Configuration
-
-	var machine *runtime.Machine = runtime.NewMachine(cd.Machine.MachineName)
-	var monitor *QemuMonitor = NewQemuMonitor(machine)
+	var monitor *QemuMonitor = qemu.Monitor
+	var machine *runtime.Machine = monitor.Machine
 
 	/* VNC Spec parser */
 	var vncRegex regexp.Regexp = *regexp.MustCompile(`[0-9\.]+:\d+`)
@@ -116,19 +158,22 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	// -- Memory
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-m", cd.Memory)
 
+	/* vhost-user backends need guest memory they can map */
+	if cd.Net.HasVhostUser() {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-object",
+			fmt.Sprintf("memory-backend-memfd,id=%s,size=%s,share=on", QemuSharedMemoryID, cd.Memory))
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-numa", fmt.Sprintf("node,memdev=%s", QemuSharedMemoryID))
+	}
+
 	// -- cpus
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-smp", fmt.Sprintf("%d", cd.CPUs))
 
-	// -- CDROM
-	if len(cd.Disks.ISOCDrom) > 0 {
-		qemuArgs = qemu.appendQemuArg(qemuArgs, "-cdrom", cd.Disks.ISOCDrom)
-	}
-
 	/*
 	 * Display specification
 	 */
 	if !cd.Display.EnableGraphics {
-		qemuArgs = append(qemuArgs, "-nographic")
+		// -nographic would take over the terminal; the serial port has its own socket
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-display", "none")
 	} else {
 		// -- VGA
 		qemuArgs = qemu.appendQemuArg(qemuArgs, "-vga", cd.Display.VGAType)
@@ -184,50 +229,74 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	}
 
 	// -- Background?
-	if cd.RunAsDaemon {
+	if cd.RunAsDaemon && !qemu.Supervised {
 		qemuArgs = append(qemuArgs, "-daemonize")
 	}
 
-	// -- Network spec
+	// -- Network spec, one device and backend per interface
 	{
-		/* Configure user network device */
-		netSpec = fmt.Sprintf("%s,netdev=%s", cd.Net.DeviceType, cd.Net.User.ID)
-		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", netSpec)
+		var sshNIC *config.NetworkInterface = cd.Net.GetSSHInterface()
 
-		/* Configure User NIC */
-		netSpec = fmt.Sprintf("user,id=%s", cd.Net.User.ID)
+		for index := range cd.Net {
+			nic := &cd.Net[index]
+			netID := nic.GetID(index)
 
-		if len(cd.Net.User.IPSubnet) > 0 {
-			netSpec = fmt.Sprintf("%s,net=%s", netSpec, cd.Net.User.IPSubnet)
-		}
+			/* Device specification */
+			netSpec = fmt.Sprintf("%s,netdev=%s,id=%s", nic.GetModel(), netID, GetDeviceID(netID))
+			if len(nic.MacAddress) > 0 {
+				netSpec = fmt.Sprintf("%s,mac=%s", netSpec, nic.MacAddress)
+			}
+			qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", netSpec)
 
-		if cd.SSH.LocalPort > 0 {
-			netSpec = fmt.Sprintf("%s,hostfwd=tcp::%d-:22", netSpec, cd.SSH.LocalPort)
-		}
+			/* Backend specification */
+			switch nic.GetBackend() {
+			case config.NetworkBackendUser:
+				netSpec = getUserNetdevSpec(netID, &nic.User, cd, nic == sshNIC)
 
-		/* Port fowards come here */
-		for _, _value := range cd.Net.User.PortForwards {
-			netSpec = fmt.Sprintf("%s,hostfwd=tcp::%d-:%d", netSpec, _value.HostPort, _value.GuestPort)
-		}
+			case config.NetworkBackendBridge:
+				netSpec = fmt.Sprintf("bridge,id=%s,br=%s", netID, nic.Bridge.Interface)
+				if len(nic.Bridge.Helper) > 0 {
+					netSpec = fmt.Sprintf("%s,helper=%s", netSpec, nic.Bridge.Helper)
+				}
 
-		qemuArgs = qemu.appendQemuArg(qemuArgs, "-netdev", netSpec)
+			case config.NetworkBackendTap:
+				netSpec = fmt.Sprintf("tap,id=%s", netID)
+				if len(nic.Tap.IfName) > 0 {
+					netSpec = fmt.Sprintf("%s,ifname=%s", netSpec, nic.Tap.IfName)
+				}
 
-		/*
-		 * Configure bridge, if any
-		 */
-		if len(cd.Net.Bridge.Interface) > 0 {
-			//-- Device specification
-			netSpec = fmt.Sprintf("%s,netdev=%s", cd.Net.DeviceType, cd.Net.Bridge.ID)
-			if len(cd.Net.Bridge.MacAddress) > 0 {
-				netSpec = fmt.Sprintf("%s,mac=", cd.Net.Bridge.MacAddress)
-			}
-			qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", netSpec)
+				/* QEMU runs /etc/qemu-ifup unless told not to */
+				netSpec = fmt.Sprintf("%s,script=%s,downscript=%s", netSpec,
+					getScriptOrNo(nic.Tap.Script), getScriptOrNo(nic.Tap.DownScript))
+				if nic.Tap.VHost {
+					netSpec = fmt.Sprintf("%s,vhost=on", netSpec)
+				}
+
+			case config.NetworkBackendSocket:
+				netSpec = fmt.Sprintf("socket,id=%s", netID)
+				if len(nic.Socket.Mcast) > 0 {
+					netSpec = fmt.Sprintf("%s,mcast=%s", netSpec, nic.Socket.Mcast)
+				} else {
+					netSpec = fmt.Sprintf("%s,udp=%s", netSpec, nic.Socket.UDP)
+				}
+				if len(nic.Socket.LocalAddress) > 0 {
+					netSpec = fmt.Sprintf("%s,localaddr=%s", netSpec, nic.Socket.LocalAddress)
+				}
+
+			case config.NetworkBackendVhostUser:
+				charID := fmt.Sprintf("%s-chr", netID)
+				charSpec := fmt.Sprintf("socket,id=%s,path=%s", charID, nic.VhostUser.Socket)
+				if nic.VhostUser.Server {
+					charSpec = fmt.Sprintf("%s,server=on,wait=off", charSpec)
+				}
+				qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", charSpec)
 
-			// Bridge definition
-			netSpec = fmt.Sprintf("bridge,id=%s,br=%s", cd.Net.Bridge.ID, cd.Net.Bridge.Interface)
-			if len(cd.Net.Bridge.Helper) > 0 {
-				netSpec = fmt.Sprintf("%s,helper=%s", netSpec, cd.Net.Bridge.Helper)
+				netSpec = fmt.Sprintf("vhost-user,id=%s,chardev=%s", netID, charID)
+
+			default:
+				return nil, fmt.Errorf("interface '%s': unknown backend '%s'", netID, nic.GetBackend())
 			}
+
 			qemuArgs = qemu.appendQemuArg(qemuArgs, "-netdev", netSpec)
 		}
 	}
@@ -235,30 +304,189 @@ func (qemu *QemuCommand) getQemuArgs() (qemuArgs []string, err error) {
 	/*
 	 * Disk specification
 	 */
-	if len(cd.Disks.BlockDevice) > 0 { // TODO: Use stat to check whether it is a valid block device
-		driveName := "xvda"
-		// Appends drive/device specification
-		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", fmt.Sprintf("virtio-blk-pci,drive=%s", driveName))
-
-		// Appends block device configuration
-		qemuArgs = qemu.appendQemuArg(qemuArgs,
-			"-blockdev",
-			fmt.Sprintf("node-name=%s,driver=raw,file.driver=host_device,file.filename=%s", driveName, cd.Disks.BlockDevice))
-	} else {
-		// -- Otherwise, we finally add hard disk info
-		qemuArgs = append(qemuArgs, cd.Disks.HardDisk)
+	diskArgs, err := getDiskArgs(cd, machine)
+	if err != nil {
+		return nil, err
+	}
+	qemuArgs = append(qemuArgs, diskArgs...)
+
+	/* Root ports for "qemuctl attach", last so the devices above keep their PCI addresses */
+	for slot := 0; slot < cd.Machine.HotplugSlots; slot++ {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device",
+			fmt.Sprintf("pcie-root-port,id=%s%d,chassis=%d", QemuHotplugPortPrefix, slot, slot+1))
 	}
 
 	/* Add a monitor specfication to be able to operate on the machine */
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetChardevSpec())
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-qmp", monitor.GetMonitorSpec())
+	if qemu.Supervised {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetEventsChardevSpec())
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-qmp", monitor.GetEventsMonitorSpec())
+	}
+
+	/* Serial console goes to a socket in the runtime directory */
+	qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetSerialChardevSpec(cd.Console.Log))
+	qemuArgs = qemu.appendQemuArg(qemuArgs, "-serial", monitor.GetSerialSpec())
+
+	/* Guest agent channel, also a socket in the runtime directory */
+	if cd.GuestAgent.Enabled {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-chardev", monitor.GetAgentChardevSpec())
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", monitor.GetAgentSerialSpec())
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-device", monitor.GetAgentPortSpec())
+	}
 
 	/* Add PIDfile spec */
 	qemuArgs = qemu.appendQemuArg(qemuArgs, "-pidfile", monitor.GetPidFilePath())
 
+	/* Resume a suspended machine where it was left */
+	if len(qemu.IncomingFile) > 0 {
+		qemuArgs = qemu.appendQemuArg(qemuArgs, "-incoming", GetIncomingSpec(qemu.IncomingFile))
+	}
+
 	return qemuArgs, nil
 }
 
+/* getUserNetdevSpec returns the SLIRP backend of a user NIC; withSSH adds the SSH forward */
+func getUserNetdevSpec(netID string, user *config.UserNetwork, cd *config.ConfigurationData, withSSH bool) (netSpec string) {
+	netSpec = fmt.Sprintf("user,id=%s", netID)
+
+	if len(user.IPSubnet) > 0 {
+		netSpec = fmt.Sprintf("%s,net=%s", netSpec, user.IPSubnet)
+	}
+
+	/* SLIRP options */
+	if len(user.Hostname) > 0 {
+		netSpec = fmt.Sprintf("%s,hostname=%s", netSpec, user.Hostname)
+	}
+
+	for _, domain := range user.DNSSearch {
+		netSpec = fmt.Sprintf("%s,dnssearch=%s", netSpec, domain)
+	}
+
+	if user.Restrict {
+		netSpec = fmt.Sprintf("%s,restrict=on", netSpec)
+	}
+
+	if withSSH && cd.SSH.LocalPort > 0 {
+		netSpec = fmt.Sprintf("%s,hostfwd=%s:%s:%d-%s:22", netSpec, config.ForwardProtocolTCP,
+			formatForwardAddress(cd.SSH.HostAddress), cd.SSH.LocalPort,
+			formatForwardAddress(cd.SSH.GuestAddress))
+	}
+
+	/* Port fowards come here */
+	for index := range user.PortForwards {
+		forward := &user.PortForwards[index]
+		netSpec = fmt.Sprintf("%s,hostfwd=%s:%s:%d-%s:%d", netSpec, forward.GetProtocol(),
+			formatForwardAddress(forward.HostAddress), forward.HostPort,
+			formatForwardAddress(forward.GuestAddress), forward.GuestPort)
+	}
+
+	/* Guest forwards: commas in the target are doubled, as QEMU option values want */
+	for _, forward := range user.GuestForwards {
+		netSpec = fmt.Sprintf("%s,guestfwd=tcp:%s:%d-%s", netSpec, forward.GuestAddress,
+			forward.GuestPort, strings.ReplaceAll(forward.Target, ",", ",,"))
+	}
+
+	return netSpec
+}
+
+/* getScriptOrNo returns script, or "no" to keep QEMU from running its default */
+func getScriptOrNo(script string) string {
+	if len(script) > 0 {
+		return script
+	}
+
+	return "no"
+}
+
+/* formatForwardAddress brackets IPv6 addresses, as hostfwd expects */
+func formatForwardAddress(address string) string {
+	if strings.Contains(address, ":") {
+		return "[" + address + "]"
+	}
+
+	return address
+}
+
+// GetCommandLine returns the argv QEMU would be launched with, binary first,
+// without preparing or launching anything.
+func (qemu *QemuCommand) GetCommandLine() (qemuArgs []string, err error) {
+	return qemu.getQemuArgs()
+}
+
+// Prepare creates whatever the machine needs before QEMU runs: disk images,
+// the cloud-init seed and a fresh console log.
+func (qemu *QemuCommand) Prepare() (err error) {
+	var machine *runtime.Machine = qemu.Monitor.Machine
+
+	/* Clones made without --full read these images as they were when cloned */
+	user, err := config.FindDiskUser(machine)
+	if err != nil {
+		return err
+	}
+	if len(user) > 0 {
+		return fmt.Errorf("machine '%s' uses disks of '%s' as backing files: destroy it, or clone with --full", user, machine.Name)
+	}
+
+	log.Printf("[prepare] provisioning disk images for '%s'", machine.Name)
+	err = ProvisionDiskImages(qemu.Configuration, machine)
+	if err != nil {
+		return err
+	}
+
+	/* Generate the cloud-init seed, or refresh it if the config changed */
+	err = cloudinit.EnsureSeed(qemu.Configuration, machine)
+	if err != nil {
+		return err
+	}
+
+	err = qemu.Monitor.RotateConsoleLog(qemu.Configuration)
+	if err != nil {
+		log.Printf("[prepare] could not rotate console log: %s", err.Error())
+	}
+
+	return nil
+}
+
+// Start launches QEMU as a child process and returns without waiting for it.
+// Its output goes to qemu.log in the runtime directory.
+func (qemu *QemuCommand) Start() (command *exec.Cmd, err error) {
+	var qemuArgs []string
+	var outputFile *os.File
+
+	qemuArgs, err = qemu.getQemuArgs()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Println("[QemuCommand::Start] Executing QEMU with:")
+	log.Printf("qemu_path ....... %s\n", qemu.QemuPath)
+	log.Printf("qemu_args ....... %s\n", strings.Join(qemuArgs, " "))
+
+	outputFile, err = os.OpenFile(
+		fmt.Sprintf("%s/%s", qemu.Monitor.Machine.RuntimeDirectory, QemuOutputLogFileName),
+		os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer outputFile.Close()
+
+	command = exec.Command(qemu.QemuPath, qemuArgs[1:]...)
+	command.Dir = os.ExpandEnv("$HOME")
+	command.Stdout = outputFile
+	command.Stderr = outputFile
+	/* Own process group: terminal signals aimed at qemuctl do not reach QEMU */
+	command.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	err = command.Start()
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("[QemuCommand::Start] QEMU started with pid %d", command.Process.Pid)
+	return command, nil
+}
+
 func (qemu *QemuCommand) Launch() (err error) {
 	var procAttrs *os.ProcAttr = nil
 	var qemuArgs []string
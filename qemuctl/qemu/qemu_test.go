@@ -0,0 +1,162 @@
+package qemuctl_qemu
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	config "luizpuglisi.com/qemuctl/helpers"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+/* go test ./qemu -update rewrites the golden files from the current output */
+var updateGolden = flag.Bool("update", false, "update golden files in testdata")
+
+const (
+	testQemuPath         string = "qemu-system-x86_64"
+	testMachineName      string = "vm0"
+	testRuntimeDirectory string = "/run/qemuctl/machines/vm0"
+)
+
+/* newTestCommand builds a QemuCommand for testdata/<name>.yaml without touching ~/.qemuctl */
+func newTestCommand(t *testing.T, name string) *QemuCommand {
+	configBytes, err := os.ReadFile(filepath.Join("testdata", name+".yaml"))
+	if err != nil {
+		t.Fatalf("could not read config: %s", err.Error())
+	}
+
+	configData, err := config.ParseConfigData(configBytes)
+	if err != nil {
+		t.Fatalf("could not parse config: %s", err.Error())
+	}
+
+	machine := &runtime.Machine{
+		Name:             testMachineName,
+		RuntimeDirectory: testRuntimeDirectory,
+		ConfigFile:       testRuntimeDirectory + "/config.yaml",
+	}
+
+	return &QemuCommand{
+		QemuPath:      testQemuPath,
+		Configuration: configData,
+		Monitor:       NewQemuMonitor(machine),
+	}
+}
+
+func TestQemuArgsGolden(t *testing.T) {
+	var testCases = []struct {
+		name       string
+		supervised bool
+		networks   []string
+		/* Restore a suspended machine from this state file */
+		incomingFile string
+	}{
+		{name: "minimal"},
+		{name: "tpm-passthrough"},
+		{name: "tpm-emulator"},
+		{name: "vnc"},
+		{name: "vnc-display-number"},
+		{name: "spice"},
+		{name: "kernel-boot"},
+		{name: "bios-boot"},
+		{name: "bridge"},
+		{name: "block-device"},
+		{name: "port-forwards"},
+		{name: "user-net-options"},
+		{name: "multi-nic"},
+		{name: "networks", networks: []string{"lab0", "lab1"}},
+		{name: "disks"},
+		{name: "hotplug"},
+		{name: "guest-agent"},
+		{name: "cloud-init"},
+		{name: "daemon"},
+		{name: "daemon", supervised: true},
+		{name: "restore", incomingFile: testRuntimeDirectory + "/" + runtime.MachineStateFileName},
+	}
+
+	for _, testCase := range testCases {
+		goldenName := testCase.name
+		if testCase.supervised {
+			goldenName += "-supervised"
+		}
+
+		t.Run(goldenName, func(t *testing.T) {
+			qemu := newTestCommand(t, testCase.name)
+			qemu.Supervised = testCase.supervised
+			qemu.IncomingFile = testCase.incomingFile
+
+			/* Networks live under ~/.qemuctl: use a scratch home */
+			if len(testCase.networks) > 0 {
+				t.Setenv("HOME", t.TempDir())
+				for _, networkName := range testCase.networks {
+					if _, err := runtime.CreateNetwork(networkName, ""); err != nil {
+						t.Fatalf("could not create network: %s", err.Error())
+					}
+				}
+
+				if err := config.AttachNetworks(qemu.Configuration); err != nil {
+					t.Fatalf("could not attach networks: %s", err.Error())
+				}
+			}
+
+			qemuArgs, err := qemu.getQemuArgs()
+			if err != nil {
+				t.Fatalf("getQemuArgs failed: %s", err.Error())
+			}
+
+			/* One argument per line keeps diffs readable */
+			got := strings.Join(qemuArgs, "\n") + "\n"
+			goldenPath := filepath.Join("testdata", goldenName+".args")
+
+			if *updateGolden {
+				err = os.WriteFile(goldenPath, []byte(got), 0644)
+				if err != nil {
+					t.Fatalf("could not update golden file: %s", err.Error())
+				}
+			}
+
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatalf("could not read golden file (run with -update to create it): %s", err.Error())
+			}
+
+			if got != string(want) {
+				t.Errorf("arguments differ from %s\n--- got\n%s--- want\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+func TestQemuArgsErrors(t *testing.T) {
+	var testCases = []struct {
+		name   string
+		config string
+	}{
+		{
+			name:   "duplicate disk id",
+			config: "disks:\n  - id: a\n    file: /a.img\n  - id: a\n    file: /b.img\n",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			configData, err := config.ParseConfigData([]byte(testCase.config))
+			if err != nil {
+				t.Fatalf("could not parse config: %s", err.Error())
+			}
+
+			qemu := &QemuCommand{
+				QemuPath:      testQemuPath,
+				Configuration: configData,
+				Monitor:       NewQemuMonitor(&runtime.Machine{Name: testMachineName, RuntimeDirectory: testRuntimeDirectory}),
+			}
+
+			_, err = qemu.getQemuArgs()
+			if err == nil {
+				t.Errorf("expected an error")
+			}
+		})
+	}
+}
@@ -3,16 +3,52 @@ package qemuctl_qemu
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"sync"
 	"time"
 )
 
 const (
-	QmpCapabilitiesCommand    string = "qmp_capabilities"
-	QmpQueryStatusCommand     string = "query-status"
-	QmpSystemPowerdownCommand string = "system_powerdown"
-	QmpDefaultBufferSize      int    = 1024
+	QmpCapabilitiesCommand         string = "qmp_capabilities"
+	QmpQueryStatusCommand          string = "query-status"
+	QmpSystemPowerdownCommand      string = "system_powerdown"
+	QmpQuitCommand                 string = "quit"
+	QmpStopCommand                 string = "stop"
+	QmpContCommand                 string = "cont"
+	QmpSystemResetCommand          string = "system_reset"
+	QmpMigrateCommand              string = "migrate"
+	QmpMigrateCancelCommand        string = "migrate_cancel"
+	QmpQueryMigrateCommand         string = "query-migrate"
+	QmpMigrateSetParametersCommand string = "migrate-set-parameters"
+	QmpQueryCpusFastCommand        string = "query-cpus-fast"
+	QmpQueryBalloonCommand         string = "query-balloon"
+	QmpQueryBlockstatsCommand      string = "query-blockstats"
+	QmpHumanMonitorCommand         string = "human-monitor-command"
+	QmpBlockdevAddCommand          string = "blockdev-add"
+	QmpBlockdevDelCommand          string = "blockdev-del"
+	QmpBlockdevOpenTrayCommand     string = "blockdev-open-tray"
+	QmpBlockdevCloseTrayCommand    string = "blockdev-close-tray"
+	QmpBlockdevRemoveMediumCommand string = "blockdev-remove-medium"
+	QmpBlockdevInsertMediumCommand string = "blockdev-insert-medium"
+	QmpDeviceAddCommand            string = "device_add"
+	QmpDeviceDelCommand            string = "device_del"
+	QmpNetdevAddCommand            string = "netdev_add"
+	QmpNetdevDelCommand            string = "netdev_del"
+	QmpQomListCommand              string = "qom-list"
+	QmpQueryPciCommand             string = "query-pci"
+
+	QmpEventPowerdown string = "POWERDOWN"
+	QmpEventShutdown  string = "SHUTDOWN"
+	QmpEventReset     string = "RESET"
+	QmpEventStop      string = "STOP"
+	QmpEventResume    string = "RESUME"
+	/* Sent once the guest has released a device given to device_del */
+	QmpEventDeviceDeleted string = "DEVICE_DELETED"
+
+	QmpDefaultCommandTimeout time.Duration = 30 * time.Second
+	QmpEventQueueSize        int           = 64
 )
 
 type QmpHeaderVersionQemu struct {
@@ -27,174 +63,368 @@ type QmpHeaderVersionData struct {
 
 type QmpHeader struct {
 	QMP struct {
-		Version QmpHeaderVersionData `json:"version"`
-		Package string               `json:"package"`
+		Version      QmpHeaderVersionData `json:"version"`
+		Package      string               `json:"package"`
+		Capabilities []string             `json:"capabilities"`
 	} `json:"QMP"`
 }
 
-type QmpCommandArguments struct {
-	Device string `json:"device"`
+// Run states reported by query-status
+const (
+	QmpStatusRunning   string = "running"
+	QmpStatusPaused    string = "paused"
+	QmpStatusInMigrate string = "inmigrate"
+)
+
+// Migration states reported by query-migrate
+const (
+	QmpMigrationCompleted string = "completed"
+	QmpMigrationFailed    string = "failed"
+	QmpMigrationCancelled string = "cancelled"
+)
+
+type QmpQueryMigrateResult struct {
+	Status    string `json:"status"`
+	ErrorDesc string `json:"error-desc"`
 }
 
-type QmpBasicCommand struct {
-	Command string `json:"execute"`
+type QmpQueryStatusResult struct {
+	Status     string `json:"status"`
+	SingleStep bool   `json:"singlestep"`
+	Running    bool   `json:"running"`
 }
 
-type QmpCommandQueryStatus struct {
-	Command string `json:"execute"`
+// QmpError is the error object QEMU sends back when a command fails
+type QmpError struct {
+	Class       string `json:"class"`
+	Description string `json:"desc"`
 }
 
-type QmpQueryStatusResult struct {
-	Return struct {
-		Status     string `json:"status"`
-		SingleStep bool   `json:"singlestep"`
-		Running    bool   `json:"running"`
-	} `json:"return"`
+func (qmpError *QmpError) Error() string {
+	return fmt.Sprintf("qmp: %s: %s", qmpError.Class, qmpError.Description)
+}
+
+type QmpTimestamp struct {
+	Seconds      int64 `json:"seconds"`
+	Microseconds int64 `json:"microseconds"`
 }
 
-type QmpQueryStatusReturn struct {
-	Return QmpQueryStatusResult `json:"result"`
+func (ts QmpTimestamp) Time() time.Time {
+	return time.Unix(ts.Seconds, ts.Microseconds*1000)
 }
 
-type QmpBasicResult struct {
-	Result interface{} `json:"result"`
+// QmpEvent is an asynchronous message sent by QEMU (POWERDOWN, SHUTDOWN, RESET...)
+type QmpEvent struct {
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data,omitempty"`
+	Timestamp QmpTimestamp    `json:"timestamp"`
 }
 
-type QmpEventResult struct {
-	Result struct {
-		Timestamp struct {
-			Seconds      int64 `json:"seconds"`
-			Microseconds int   `json:"microseconds"`
-		} `json:"timestamp"`
-		Event string      `json:"event"`
-		Data  interface{} `json:"data"`
-	} `json:"result"`
+/* qmpMessage is anything QEMU may write on the socket: greeting, reply or event */
+type qmpMessage struct {
+	QMP       json.RawMessage `json:"QMP"`
+	ID        *uint64         `json:"id"`
+	Return    json.RawMessage `json:"return"`
+	Error     *QmpError       `json:"error"`
+	Event     string          `json:"event"`
+	Data      json.RawMessage `json:"data"`
+	Timestamp QmpTimestamp    `json:"timestamp"`
 }
 
-func (command *QmpBasicCommand) Execute(socket net.Conn) (result *QmpBasicResult, err error) {
-	var jsonBytes []byte
-	var buffer []byte = make([]byte, QmpDefaultBufferSize)
-	var nBytes int
+type qmpRequest struct {
+	Command   string      `json:"execute"`
+	Arguments interface{} `json:"arguments,omitempty"`
+	ID        uint64      `json:"id"`
+}
+
+// QmpClient keeps a single QMP connection, matches replies to commands by id
+// and delivers asynchronous events on a channel.
+type QmpClient struct {
+	Header         QmpHeader
+	CommandTimeout time.Duration
+
+	conn    net.Conn
+	decoder *json.Decoder
+
+	writeLock sync.Mutex
+
+	lock    sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan qmpMessage
+	err     error
 
-	result = &QmpBasicResult{}
+	events chan QmpEvent
+	done   chan struct{}
+}
+
+// DialQmp connects to the QMP socket at socketPath, reads the greeting and
+// negotiates capabilities.
+func DialQmp(socketPath string) (client *QmpClient, err error) {
+	var conn net.Conn
 
-	/* Marshal struct into bytes */
-	log.Printf("[QmpCommand] execute: creating json bytes")
-	jsonBytes, err = json.Marshal(command)
+	log.Printf("[qmp] connecting to '%s'", socketPath)
+	conn, err = net.Dial("unix", socketPath)
 	if err != nil {
 		return nil, err
 	}
 
-	log.Printf("[QmpCommand] execute: json bytes is [%s]", string(jsonBytes))
-
-	/* Send command data to socket */
-	log.Printf("[QmpCommand] execute: sending command to socket")
-	nBytes, err = socket.Write(jsonBytes)
+	client, err = NewQmpClient(conn)
 	if err != nil {
+		conn.Close()
 		return nil, err
 	}
 
-	/* Read return JSON from socket */
-	log.Printf("[QmpCommand] execute: reading result from socket")
-	jsonBytes = make([]byte, 0)
+	return client, nil
+}
 
-	for nBytes, err = socket.Read(buffer); err == nil && nBytes > 0; {
-		jsonBytes = append(jsonBytes, buffer[:nBytes]...)
-		if nBytes < QmpDefaultBufferSize {
-			break
-		}
+// NewQmpClient runs the QMP handshake over an already established connection.
+func NewQmpClient(conn net.Conn) (client *QmpClient, err error) {
+	var greeting qmpMessage
+
+	client = &QmpClient{
+		CommandTimeout: QmpDefaultCommandTimeout,
+		conn:           conn,
+		decoder:        json.NewDecoder(conn),
+		pending:        make(map[uint64]chan qmpMessage),
+		events:         make(chan QmpEvent, QmpEventQueueSize),
+		done:           make(chan struct{}),
 	}
 
-	/* Unmarshal jsonBytes into result */
-	err = json.Unmarshal(jsonBytes, &result)
-
-	log.Printf("[QmpCommand] execute: result is [%v]", result)
-
-	return result, err
-}
+	/* The greeting is the first object on the stream */
+	conn.SetReadDeadline(time.Now().Add(client.CommandTimeout))
+	err = client.decoder.Decode(&greeting)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		return nil, fmt.Errorf("could not read QMP greeting: %s", err.Error())
+	}
 
-func (command *QmpCommandQueryStatus) Execute(socket net.Conn) (result *QmpQueryStatusResult, err error) {
-	var jsonBytes []byte
-	var buffer []byte = make([]byte, QmpDefaultBufferSize)
-	var nBytes int
+	if greeting.QMP == nil {
+		return nil, fmt.Errorf("unexpected QMP greeting")
+	}
 
-	result = &QmpQueryStatusResult{}
+	err = json.Unmarshal(greeting.QMP, &client.Header.QMP)
+	if err != nil {
+		return nil, fmt.Errorf("invalid QMP greeting: %s", err.Error())
+	}
 
-	/* Marshal struct into bytes */
-	log.Printf("[QmpCommandQuery] execute: creating json bytes")
+	log.Printf("[qmp] connected to QEMU %d.%d.%d",
+		client.Header.QMP.Version.Qemu.Major,
+		client.Header.QMP.Version.Qemu.Minor,
+		client.Header.QMP.Version.Qemu.Micro)
 
-	command.Command = QmpQueryStatusCommand
+	go client.readLoop()
 
-	jsonBytes, err = json.Marshal(command)
+	err = client.Execute(QmpCapabilitiesCommand, nil, nil)
 	if err != nil {
+		client.Close()
 		return nil, err
 	}
 
-	log.Printf("[QmpCommandQuery] execute: json bytes is [%s]", string(jsonBytes))
+	return client, nil
+}
 
-	/* Send command data to socket */
-	log.Printf("[QmpCommandQuery] execute: sending command to socket")
-	_, err = socket.Write(jsonBytes)
-	if err != nil {
-		return nil, err
-	}
+func (client *QmpClient) readLoop() {
+	var err error
 
-	/* Read return JSON from socket */
-	log.Printf("[QmpCommandQuery] execute: reading result from socket")
-	jsonBytes = make([]byte, 0)
+	for {
+		var message qmpMessage
 
-	for nBytes, err = socket.Read(buffer); err == nil && nBytes > 0; {
-		jsonBytes = append(jsonBytes, buffer[:nBytes]...)
-		if nBytes < QmpDefaultBufferSize {
+		err = client.decoder.Decode(&message)
+		if err != nil {
 			break
 		}
+
+		if len(message.Event) > 0 {
+			event := QmpEvent{
+				Event:     message.Event,
+				Data:      message.Data,
+				Timestamp: message.Timestamp,
+			}
+
+			select {
+			case client.events <- event:
+			default:
+				log.Printf("[qmp] event queue full, dropping event %s", event.Event)
+			}
+			continue
+		}
+
+		if message.ID == nil {
+			log.Printf("[qmp] ignoring reply without id")
+			continue
+		}
+
+		client.lock.Lock()
+		replyChannel, found := client.pending[*message.ID]
+		delete(client.pending, *message.ID)
+		client.lock.Unlock()
+
+		if !found {
+			log.Printf("[qmp] ignoring reply for unknown id %d", *message.ID)
+			continue
+		}
+
+		replyChannel <- message
 	}
 
-	/* Unmarshal jsonBytes into result */
-	err = json.Unmarshal(jsonBytes, &result)
+	if err == io.EOF {
+		log.Printf("[qmp] connection closed by QEMU")
+	} else {
+		log.Printf("[qmp] read loop finished: %s", err.Error())
+	}
 
-	log.Printf("[QmpCommandQuery] execute: result is [%v]", result)
+	client.lock.Lock()
+	client.err = err
+	for id, replyChannel := range client.pending {
+		close(replyChannel)
+		delete(client.pending, id)
+	}
+	client.lock.Unlock()
 
-	return result, err
+	close(client.events)
+	close(client.done)
 }
 
-func (event *QmpEventResult) ReadEvent(socket net.Conn) (err error) {
-	var buffer []byte = make([]byte, QmpDefaultBufferSize)
-	var jsonData []byte = make([]byte, 0)
-	var nBytes int
+// Execute sends command with the given arguments and waits for its reply. If
+// result is not nil, the "return" member of the reply is unmarshaled into it.
+func (client *QmpClient) Execute(command string, arguments interface{}, result interface{}) (err error) {
+	var replyChannel chan qmpMessage = make(chan qmpMessage, 1)
+	var request qmpRequest
+	var requestBytes []byte
+
+	client.lock.Lock()
+	if client.err != nil {
+		client.lock.Unlock()
+		return fmt.Errorf("qmp connection is closed: %s", client.err.Error())
+	}
+	client.nextID++
+	request = qmpRequest{
+		Command:   command,
+		Arguments: arguments,
+		ID:        client.nextID,
+	}
+	client.pending[request.ID] = replyChannel
+	client.lock.Unlock()
+
+	requestBytes, err = json.Marshal(request)
+	if err != nil {
+		client.forget(request.ID)
+		return err
+	}
 
-	var deadLineDuration time.Duration = 10 * 1000000000
+	log.Printf("[qmp] sending [%s]", string(requestBytes))
 
-	/* Set some deadline to socket */
-	deadLine := time.Now().Add(deadLineDuration)
-	if _err := socket.SetReadDeadline(deadLine); _err != nil {
-		log.Printf("[ReadEvent] could not set socket deadline: %s", _err.Error())
+	client.writeLock.Lock()
+	_, err = client.conn.Write(requestBytes)
+	client.writeLock.Unlock()
+	if err != nil {
+		client.forget(request.ID)
+		return err
 	}
 
-	log.Printf("[ReadEvent] reading data from socket")
-	for nBytes, err = socket.Read(buffer); err == nil && nBytes > 0; {
-		jsonData = append(jsonData, buffer[:nBytes]...)
+	timer := time.NewTimer(client.CommandTimeout)
+	defer timer.Stop()
 
-		if nBytes < QmpDefaultBufferSize {
-			break
+	select {
+	case reply, ok := <-replyChannel:
+		{
+			if !ok {
+				return fmt.Errorf("qmp connection closed while waiting for '%s'", command)
+			}
+
+			if reply.Error != nil {
+				return reply.Error
+			}
+
+			log.Printf("[qmp] '%s' returned [%s]", command, string(reply.Return))
+
+			if result != nil && reply.Return != nil {
+				err = json.Unmarshal(reply.Return, result)
+			}
+		}
+	case <-timer.C:
+		{
+			client.forget(request.ID)
+			err = fmt.Errorf("timeout waiting for reply to '%s'", command)
 		}
 	}
 
-	log.Printf("[ReadEvent] socket.read returned: err is %v, nBytes is %d", err, nBytes)
+	return err
+}
 
-	/* Reset socket deadline */
-	if _err := socket.SetReadDeadline(time.Unix(0, 0)); _err != nil {
-		log.Printf("[ReadEvent] could not reset socket deadline: %s", _err.Error())
+// HumanMonitorCommand runs an HMP command line and returns its text output.
+func (client *QmpClient) HumanMonitorCommand(commandLine string) (output string, err error) {
+	var arguments = struct {
+		CommandLine string `json:"command-line"`
+	}{
+		CommandLine: commandLine,
 	}
-	/* Check for err from socket.Read() */
+
+	err = client.Execute(QmpHumanMonitorCommand, &arguments, &output)
 	if err != nil {
-		return err
-	} else if nBytes == 0 {
-		return fmt.Errorf("no more data")
+		return "", err
 	}
 
-	log.Printf("[ReadEvent] received from socket: [%s]", string(jsonData))
+	return output, nil
+}
 
-	err = json.Unmarshal(jsonData, &event)
-	return err
+func (client *QmpClient) forget(id uint64) {
+	client.lock.Lock()
+	delete(client.pending, id)
+	client.lock.Unlock()
+}
+
+// Events returns the channel on which asynchronous events are delivered. It
+// is closed when the connection goes away.
+func (client *QmpClient) Events() <-chan QmpEvent {
+	return client.events
+}
+
+// Done is closed when the connection goes away.
+func (client *QmpClient) Done() <-chan struct{} {
+	return client.done
+}
+
+// Err returns the error that ended the connection, if any.
+func (client *QmpClient) Err() error {
+	client.lock.Lock()
+	defer client.lock.Unlock()
+
+	return client.err
+}
+
+// WaitEvent discards events until one named eventName arrives. A zero timeout
+// waits forever.
+func (client *QmpClient) WaitEvent(eventName string, timeout time.Duration) (event *QmpEvent, err error) {
+	var timeoutChannel <-chan time.Time
+
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		timeoutChannel = timer.C
+	}
+
+	for {
+		select {
+		case received, ok := <-client.events:
+			{
+				if !ok {
+					return nil, fmt.Errorf("qmp connection closed while waiting for %s", eventName)
+				}
+
+				log.Printf("[qmp] event received: %s", received.Event)
+				if received.Event == eventName {
+					return &received, nil
+				}
+			}
+		case <-timeoutChannel:
+			{
+				return nil, fmt.Errorf("timeout waiting for event %s", eventName)
+			}
+		}
+	}
+}
+
+func (client *QmpClient) Close() error {
+	return client.conn.Close()
 }
@@ -0,0 +1,276 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+type qmpCPUInfo struct {
+	CPUIndex int `json:"cpu-index"`
+	ThreadID int `json:"thread-id"`
+}
+
+type qmpBalloonInfo struct {
+	Actual int64 `json:"actual"`
+}
+
+type qmpBlockStats struct {
+	Device   string `json:"device"`
+	NodeName string `json:"node-name"`
+	Qdev     string `json:"qdev"`
+	Stats    struct {
+		ReadBytes       uint64 `json:"rd_bytes"`
+		WriteBytes      uint64 `json:"wr_bytes"`
+		ReadOperations  uint64 `json:"rd_operations"`
+		WriteOperations uint64 `json:"wr_operations"`
+	} `json:"stats"`
+}
+
+// VCPUStats is the host side of a vCPU: its QEMU thread
+type VCPUStats struct {
+	Index      int     `json:"index"`
+	ThreadID   int     `json:"threadId"`
+	CPUSeconds float64 `json:"cpuSeconds"`
+	CPUPercent float64 `json:"cpuPercent"`
+
+	cpuTicks uint64
+}
+
+// DiskStats are the I/O counters of a disk, rates in bytes per second
+type DiskStats struct {
+	Name            string  `json:"name"`
+	ReadBytes       uint64  `json:"readBytes"`
+	WriteBytes      uint64  `json:"writeBytes"`
+	ReadOperations  uint64  `json:"readOperations"`
+	WriteOperations uint64  `json:"writeOperations"`
+	ReadRate        float64 `json:"readRate"`
+	WriteRate       float64 `json:"writeRate"`
+}
+
+// NetworkStats are the counters of a tap backend, as the guest sees them:
+// what the host interface sends, the guest receives.
+type NetworkStats struct {
+	Interface string  `json:"interface"`
+	RxBytes   uint64  `json:"rxBytes"`
+	TxBytes   uint64  `json:"txBytes"`
+	RxPackets uint64  `json:"rxPackets"`
+	TxPackets uint64  `json:"txPackets"`
+	RxRate    float64 `json:"rxRate"`
+	TxRate    float64 `json:"txRate"`
+}
+
+// MachineStats is a sample of what a started machine takes from the host.
+// Percentages and rates are only known once compared to a previous sample.
+type MachineStats struct {
+	Name          string         `json:"name"`
+	Status        string         `json:"status"`
+	Pid           int            `json:"pid"`
+	Time          time.Time      `json:"time"`
+	CPUSeconds    float64        `json:"cpuSeconds"`
+	CPUPercent    float64        `json:"cpuPercent"`
+	RSS           int64          `json:"rss"`
+	BalloonActual int64          `json:"balloonActual,omitempty"`
+	VCPUs         []VCPUStats    `json:"vcpus"`
+	Disks         []DiskStats    `json:"disks"`
+	Networks      []NetworkStats `json:"networks"`
+
+	cpuTicks uint64
+}
+
+/*
+ * CollectStats samples machine: vCPU threads, balloon and block counters
+ * come from QMP, CPU time and RSS from /proc, network counters from the tap
+ * interfaces QEMU holds. User mode networking has no host interface to count.
+ */
+func CollectStats(machine *runtime.Machine) (stats *MachineStats, err error) {
+	var cpus []qmpCPUInfo
+	var balloon qmpBalloonInfo
+	var blockStats []qmpBlockStats
+
+	if machine.QemuPid <= 0 {
+		return nil, fmt.Errorf("machine '%s' has no QEMU process", machine.Name)
+	}
+
+	client, err := NewQemuMonitor(machine).Connect()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+
+	err = client.Execute(QmpQueryCpusFastCommand, nil, &cpus)
+	if err != nil {
+		return nil, err
+	}
+
+	err = client.Execute(QmpQueryBlockstatsCommand, nil, &blockStats)
+	if err != nil {
+		return nil, err
+	}
+
+	stats = &MachineStats{
+		Name:   machine.Name,
+		Status: machine.Status,
+		Pid:    machine.QemuPid,
+		Time:   time.Now(),
+	}
+
+	/* Without a balloon device there is nothing to report */
+	if client.Execute(QmpQueryBalloonCommand, nil, &balloon) == nil {
+		stats.BalloonActual = balloon.Actual
+	}
+
+	stats.cpuTicks, err = runtime.ReadCPUTicks(machine.QemuPid, 0)
+	if err != nil {
+		return nil, err
+	}
+	stats.CPUSeconds = ticksToSeconds(stats.cpuTicks)
+
+	stats.RSS, err = runtime.ReadRSS(machine.QemuPid)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, cpu := range cpus {
+		vcpu := VCPUStats{Index: cpu.CPUIndex, ThreadID: cpu.ThreadID}
+		vcpu.cpuTicks, err = runtime.ReadCPUTicks(machine.QemuPid, cpu.ThreadID)
+		if err != nil {
+			log.Printf("[stats] could not read vCPU %d of '%s': %s", cpu.CPUIndex, machine.Name, err.Error())
+		}
+		vcpu.CPUSeconds = ticksToSeconds(vcpu.cpuTicks)
+		stats.VCPUs = append(stats.VCPUs, vcpu)
+	}
+
+	for _, block := range blockStats {
+		stats.Disks = append(stats.Disks, DiskStats{
+			Name:            getBlockName(block),
+			ReadBytes:       block.Stats.ReadBytes,
+			WriteBytes:      block.Stats.WriteBytes,
+			ReadOperations:  block.Stats.ReadOperations,
+			WriteOperations: block.Stats.WriteOperations,
+		})
+	}
+
+	interfaces, err := runtime.GetTapInterfaces(machine.QemuPid)
+	if err != nil {
+		log.Printf("[stats] could not list tap interfaces of '%s': %s", machine.Name, err.Error())
+	}
+
+	for _, interfaceName := range interfaces {
+		counters, err := runtime.ReadInterfaceCounters(interfaceName)
+		if err != nil {
+			log.Printf("[stats] could not read counters of '%s': %s", interfaceName, err.Error())
+			continue
+		}
+
+		stats.Networks = append(stats.Networks, NetworkStats{
+			Interface: interfaceName,
+			RxBytes:   counters.TxBytes,
+			TxBytes:   counters.RxBytes,
+			RxPackets: counters.TxPackets,
+			TxPackets: counters.RxPackets,
+		})
+	}
+
+	return stats, nil
+}
+
+/* getBlockName names a block device: -blockdev disks only have a node name */
+func getBlockName(block qmpBlockStats) string {
+	if len(block.NodeName) > 0 {
+		return block.NodeName
+	}
+
+	if len(block.Device) > 0 {
+		return block.Device
+	}
+
+	return block.Qdev
+}
+
+// ComputeRates fills the CPU percentages and I/O rates of stats from what
+// changed since previous, a sample of the same QEMU process.
+func (stats *MachineStats) ComputeRates(previous *MachineStats) {
+	if previous == nil || previous.Pid != stats.Pid {
+		return
+	}
+
+	elapsed := stats.Time.Sub(previous.Time).Seconds()
+	if elapsed <= 0 {
+		return
+	}
+
+	stats.CPUPercent = cpuPercent(previous.cpuTicks, stats.cpuTicks, elapsed)
+
+	for index := range stats.VCPUs {
+		for _, old := range previous.VCPUs {
+			if old.ThreadID == stats.VCPUs[index].ThreadID {
+				stats.VCPUs[index].CPUPercent = cpuPercent(old.cpuTicks, stats.VCPUs[index].cpuTicks, elapsed)
+			}
+		}
+	}
+
+	for index := range stats.Disks {
+		disk := &stats.Disks[index]
+		for _, old := range previous.Disks {
+			if old.Name == disk.Name {
+				disk.ReadRate = rate(old.ReadBytes, disk.ReadBytes, elapsed)
+				disk.WriteRate = rate(old.WriteBytes, disk.WriteBytes, elapsed)
+			}
+		}
+	}
+
+	for index := range stats.Networks {
+		network := &stats.Networks[index]
+		for _, old := range previous.Networks {
+			if old.Interface == network.Interface {
+				network.RxRate = rate(old.RxBytes, network.RxBytes, elapsed)
+				network.TxRate = rate(old.TxBytes, network.TxBytes, elapsed)
+			}
+		}
+	}
+}
+
+// GetDiskRates returns the read and write rates of every disk together
+func (stats *MachineStats) GetDiskRates() (readRate float64, writeRate float64) {
+	for _, disk := range stats.Disks {
+		readRate += disk.ReadRate
+		writeRate += disk.WriteRate
+	}
+
+	return readRate, writeRate
+}
+
+// GetNetworkRates returns the receive and transmit rates of every tap together
+func (stats *MachineStats) GetNetworkRates() (rxRate float64, txRate float64) {
+	for _, network := range stats.Networks {
+		rxRate += network.RxRate
+		txRate += network.TxRate
+	}
+
+	return rxRate, txRate
+}
+
+func ticksToSeconds(ticks uint64) float64 {
+	return float64(ticks) / float64(runtime.ProcClockTicksPerSecond)
+}
+
+/* cpuPercent is the share of one host CPU used between two samples */
+func cpuPercent(before uint64, after uint64, elapsed float64) float64 {
+	if after < before {
+		return 0
+	}
+
+	return float64(after-before) / float64(runtime.ProcClockTicksPerSecond) / elapsed * 100
+}
+
+/* rate is how fast a counter grew between two samples, per second */
+func rate(before uint64, after uint64, elapsed float64) float64 {
+	if after < before {
+		return 0
+	}
+
+	return float64(after-before) / elapsed
+}
@@ -0,0 +1,231 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	/* How long the guest gets to power itself off, unless told otherwise */
+	QemuStopDefaultTimeout time.Duration = 60 * time.Second
+	/* How long every escalation step gets: quit, SIGTERM, SIGKILL */
+	QemuStopEscalationTimeout time.Duration = 5 * time.Second
+	QemuStopPollInterval      time.Duration = 100 * time.Millisecond
+	/* The most the guest agent gets out of the timeout, before ACPI is tried */
+	QemuStopAgentTimeout time.Duration = 20 * time.Second
+
+	/* How the machine went down, as recorded in its exit reason */
+	StopMethodAgent     string = "guest-shutdown"
+	StopMethodPowerdown string = "powerdown"
+	StopMethodQuit      string = "quit"
+	StopMethodSIGTERM   string = "SIGTERM"
+	StopMethodSIGKILL   string = "SIGKILL"
+	StopMethodGone      string = "not running"
+)
+
+/*
+ * Stop shuts the machine down and waits for QEMU to exit. The guest gets
+ * timeout to power off: asked by its guest agent first, when that answers,
+ * then by an ACPI powerdown. QEMU is asked to quit next, and finally its
+ * recorded PID gets SIGTERM and SIGKILL. force skips the guest shutdown.
+ * The returned method tells which step did it.
+ */
+func (monitor *QemuMonitor) Stop(timeout time.Duration, force bool) (method string, err error) {
+	var pid int = monitor.Machine.QemuPid
+
+	if pid > 0 && processExited(pid) {
+		return StopMethodGone, nil
+	}
+
+	if !force {
+		/* A paused guest cannot handle the powerdown request */
+		if monitor.Machine.IsPaused() {
+			err = monitor.Resume()
+			if err != nil {
+				log.Printf("[stop] could not resume '%s': %s", monitor.Machine.Name, err.Error())
+			}
+		}
+
+		/* The agent gets part of the time: a guest that ignores it may still obey ACPI */
+		var deadline time.Time = time.Now().Add(timeout)
+
+		err = monitor.agentShutdown(getAgentStopTimeout(timeout))
+		if err == nil {
+			return StopMethodAgent, nil
+		}
+		log.Printf("[stop] guest shutdown of '%s' failed: %s", monitor.Machine.Name, err.Error())
+
+		err = monitor.sendStopCommand(QmpSystemPowerdownCommand, getRemainingTime(deadline))
+		if err == nil {
+			return StopMethodPowerdown, nil
+		}
+		log.Printf("[stop] powerdown of '%s' failed: %s", monitor.Machine.Name, err.Error())
+	}
+
+	err = monitor.sendStopCommand(QmpQuitCommand, QemuStopEscalationTimeout)
+	if err == nil {
+		return StopMethodQuit, nil
+	}
+	log.Printf("[stop] quit of '%s' failed: %s", monitor.Machine.Name, err.Error())
+
+	if pid <= 0 {
+		return "", fmt.Errorf("machine '%s' did not stop and has no PID to signal", monitor.Machine.Name)
+	}
+
+	for _, signal := range []syscall.Signal{syscall.SIGTERM, syscall.SIGKILL} {
+		log.Printf("[stop] sending %s to process %d", signalName(signal), pid)
+
+		err = syscall.Kill(pid, signal)
+		if err == syscall.ESRCH {
+			return StopMethodGone, nil
+		} else if err != nil {
+			return "", err
+		}
+
+		if waitForExit(pid, nil, QemuStopEscalationTimeout) {
+			return signalName(signal), nil
+		}
+	}
+
+	return "", fmt.Errorf("process %d of machine '%s' survived SIGKILL", pid, monitor.Machine.Name)
+}
+
+/*
+ * StopMachine stops a machine started without the daemon and records how:
+ * stopped once QEMU is gone, still started if it survived everything.
+ */
+func StopMachine(machine *runtime.Machine, timeout time.Duration, force bool) (method string, err error) {
+	method, err = NewQemuMonitor(machine).Stop(timeout, force)
+	if err != nil {
+		if machine.QemuPid <= 0 || processExited(machine.QemuPid) {
+			machine.UpdateStatus(runtime.MachineStatusDegraded)
+		}
+		return "", err
+	}
+
+	machine.QemuPid = 0
+	machine.SSHLocalPort = 0
+	machine.HostForwards = nil
+	machine.ExitReason = fmt.Sprintf("stopped (%s)", method)
+	machine.ExitTime = time.Now()
+	machine.UpdateStatus(runtime.MachineStatusStopped)
+
+	return method, nil
+}
+
+/* sendStopCommand runs a QMP command that should make QEMU exit, and waits for it to */
+func (monitor *QemuMonitor) sendStopCommand(command string, timeout time.Duration) (err error) {
+	client, err := monitor.Connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("[stop] sending %s to '%s'", command, monitor.Machine.Name)
+	err = client.Execute(command, nil, nil)
+	if err != nil {
+		select {
+		case <-client.Done():
+			/* quit may close the connection before answering */
+		default:
+			return err
+		}
+	}
+
+	if !waitForExit(monitor.Machine.QemuPid, client.Done(), timeout) {
+		return fmt.Errorf("machine '%s' still running after %s", monitor.Machine.Name, timeout)
+	}
+
+	return nil
+}
+
+/*
+ * agentShutdown has the guest agent power the guest off, and waits for QEMU
+ * to exit. The QMP connection is only there to see it go.
+ */
+func (monitor *QemuMonitor) agentShutdown(timeout time.Duration) (err error) {
+	agent, err := monitor.ConnectAgent()
+	if err != nil {
+		return err
+	}
+	defer agent.Close()
+
+	client, err := monitor.Connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	log.Printf("[stop] sending %s to '%s'", QgaShutdownCommand, monitor.Machine.Name)
+	err = agent.Shutdown(QgaShutdownPowerdown)
+	if err != nil {
+		return err
+	}
+
+	if !waitForExit(monitor.Machine.QemuPid, client.Done(), timeout) {
+		return fmt.Errorf("machine '%s' still running after %s", monitor.Machine.Name, timeout)
+	}
+
+	return nil
+}
+
+/* getAgentStopTimeout returns the share of timeout the guest agent gets */
+func getAgentStopTimeout(timeout time.Duration) time.Duration {
+	if timeout/2 > QemuStopAgentTimeout {
+		return QemuStopAgentTimeout
+	}
+
+	return timeout / 2
+}
+
+/* getRemainingTime returns the time left until deadline, and never less than one escalation step */
+func getRemainingTime(deadline time.Time) time.Duration {
+	if remaining := time.Until(deadline); remaining > QemuStopEscalationTimeout {
+		return remaining
+	}
+
+	return QemuStopEscalationTimeout
+}
+
+/*
+ * waitForExit waits until QEMU is gone: its monitor connection closed and,
+ * when we know it, its process exited. -no-shutdown keeps QEMU around after
+ * the guest powered off, so the SHUTDOWN event alone is not enough.
+ */
+func waitForExit(pid int, done <-chan struct{}, timeout time.Duration) bool {
+	var deadline <-chan time.Time = time.After(timeout)
+
+	if done != nil {
+		select {
+		case <-done:
+		case <-deadline:
+			return false
+		}
+	}
+
+	for pid > 0 && !processExited(pid) {
+		select {
+		case <-time.After(QemuStopPollInterval):
+		case <-deadline:
+			return false
+		}
+	}
+
+	return true
+}
+
+func processExited(pid int) bool {
+	return syscall.Kill(pid, 0) == syscall.ESRCH
+}
+
+func signalName(signal syscall.Signal) string {
+	if signal == syscall.SIGKILL {
+		return StopMethodSIGKILL
+	}
+
+	return StopMethodSIGTERM
+}
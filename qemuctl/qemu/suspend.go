@@ -0,0 +1,231 @@
+package qemuctl_qemu
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+const (
+	/* Saving or loading the whole guest memory may take a while */
+	QemuSuspendTimeout      time.Duration = 10 * time.Minute
+	QemuRestoreTimeout      time.Duration = 10 * time.Minute
+	QemuMigratePollInterval time.Duration = 200 * time.Millisecond
+	/* The state goes to a local file: do not throttle it (bytes per second) */
+	QemuSuspendMaxBandwidth int64 = 1 << 40
+
+	/* Where the state is written until the migration completes */
+	QemuPartialStateSuffix string = ".partial"
+)
+
+/* shellQuote protects a path given to QEMU "exec:" migrations, run by /bin/sh */
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// GetIncomingSpec returns the -incoming value that loads stateFile
+func GetIncomingSpec(stateFile string) string {
+	return "exec:cat " + shellQuote(stateFile)
+}
+
+/*
+ * Suspend saves the machine state to its state file, then makes QEMU quit.
+ * The guest keeps its run state: a paused guest comes back paused. The state
+ * is only in place once the migration completed and QEMU is gone.
+ */
+func (monitor *QemuMonitor) Suspend() (err error) {
+	var stateFile string = monitor.Machine.GetStateFile()
+	var partialFile string = stateFile + QemuPartialStateSuffix
+
+	client, err := monitor.Connect()
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	err = client.Execute(QmpMigrateSetParametersCommand, map[string]interface{}{
+		"max-bandwidth": QemuSuspendMaxBandwidth,
+	}, nil)
+	if err != nil {
+		log.Printf("[suspend] could not lift migration bandwidth limit: %s", err.Error())
+	}
+
+	log.Printf("[suspend] saving state of '%s' to '%s'", monitor.Machine.Name, stateFile)
+	err = client.Execute(QmpMigrateCommand, map[string]interface{}{
+		"uri": "exec:cat > " + shellQuote(partialFile),
+	}, nil)
+	if err != nil {
+		os.Remove(partialFile)
+		return err
+	}
+
+	err = waitForMigration(client)
+	if err != nil {
+		client.Execute(QmpMigrateCancelCommand, nil, nil)
+		os.Remove(partialFile)
+		return err
+	}
+
+	err = os.Rename(partialFile, stateFile)
+	if err != nil {
+		os.Remove(partialFile)
+		return err
+	}
+
+	/* The guest is stopped once migrated: QEMU has nothing left to do */
+	log.Printf("[suspend] state saved, sending %s to '%s'", QmpQuitCommand, monitor.Machine.Name)
+	err = client.Execute(QmpQuitCommand, nil, nil)
+	if err != nil {
+		select {
+		case <-client.Done():
+		default:
+			os.Remove(stateFile)
+			return err
+		}
+	}
+
+	if !waitForExit(monitor.Machine.QemuPid, client.Done(), QemuStopEscalationTimeout) {
+		/* Should the guest run on, its saved state is already stale */
+		os.Remove(stateFile)
+		return fmt.Errorf("machine '%s' still running after %s", monitor.Machine.Name, QemuStopEscalationTimeout)
+	}
+
+	return nil
+}
+
+/* waitForMigration polls query-migrate until the outgoing migration is over */
+func waitForMigration(client *QmpClient) (err error) {
+	var deadline time.Time = time.Now().Add(QemuSuspendTimeout)
+	var result QmpQueryMigrateResult
+
+	for time.Now().Before(deadline) {
+		err = client.Execute(QmpQueryMigrateCommand, nil, &result)
+		if err != nil {
+			return err
+		}
+
+		switch result.Status {
+		case QmpMigrationCompleted:
+			return nil
+		case QmpMigrationFailed, QmpMigrationCancelled:
+			if len(result.ErrorDesc) > 0 {
+				return fmt.Errorf("migration %s: %s", result.Status, result.ErrorDesc)
+			}
+			return fmt.Errorf("migration %s", result.Status)
+		}
+
+		time.Sleep(QemuMigratePollInterval)
+	}
+
+	return fmt.Errorf("migration still %s after %s", result.Status, QemuSuspendTimeout)
+}
+
+/*
+ * SuspendMachine suspends a machine started without the daemon and records
+ * it as suspended; it is left untouched if the state could not be saved.
+ */
+func SuspendMachine(machine *runtime.Machine) (err error) {
+	err = NewQemuMonitor(machine).Suspend()
+	if err != nil {
+		return err
+	}
+
+	RecordSuspended(machine)
+	return nil
+}
+
+// RecordSuspended marks machine as suspended once QEMU is gone
+func RecordSuspended(machine *runtime.Machine) {
+	machine.QemuPid = 0
+	machine.SSHLocalPort = 0
+	machine.HostForwards = nil
+	machine.ExitReason = "suspended"
+	machine.ExitTime = time.Now()
+	machine.UpdateStatus(runtime.MachineStatusSuspended)
+}
+
+/*
+ * GetRestoreFile returns the state file a start of machine loads, if any.
+ * It only looks: see PrepareRestore.
+ */
+func GetRestoreFile(machine *runtime.Machine) string {
+	if machine.IsSuspended() && machine.HasStateFile() {
+		return machine.GetStateFile()
+	}
+
+	return ""
+}
+
+/*
+ * PrepareRestore makes QEMU load the state saved by suspend, if any. A state
+ * file left next to a machine that is not suspended no longer matches its
+ * disks, and is dropped.
+ */
+func (qemu *QemuCommand) PrepareRestore() {
+	var machine *runtime.Machine = qemu.Monitor.Machine
+
+	if !machine.HasStateFile() {
+		return
+	}
+
+	if !machine.IsSuspended() {
+		log.Printf("[restore] dropping stale state of '%s'", machine.Name)
+		os.Remove(machine.GetStateFile())
+		return
+	}
+
+	log.Printf("[restore] restoring '%s' from '%s'", machine.Name, machine.GetStateFile())
+	qemu.IncomingFile = machine.GetStateFile()
+}
+
+/*
+ * FinishRestore waits for QEMU to load the state given by PrepareRestore,
+ * then removes it: the guest moves on from there, so that state must never
+ * be loaded again. It returns the status to record for the machine, which
+ * stays suspended if QEMU exited before the guest could run.
+ */
+func (qemu *QemuCommand) FinishRestore() (status string, err error) {
+	var machine *runtime.Machine = qemu.Monitor.Machine
+	var deadline time.Time = time.Now().Add(QemuRestoreTimeout)
+	var result *QmpQueryStatusResult
+
+	if len(qemu.IncomingFile) == 0 {
+		return runtime.MachineStatusStarted, nil
+	}
+
+	/* A foreground QEMU has already exited when we get here */
+	if !qemu.Configuration.RunAsDaemon && !qemu.Supervised {
+		os.Remove(qemu.IncomingFile)
+		return runtime.MachineStatusStarted, nil
+	}
+
+	for {
+		result, err = qemu.Monitor.QueryStatus()
+		if err == nil && result.Status != QmpStatusInMigrate {
+			break
+		}
+
+		if machine.QemuPid > 0 && processExited(machine.QemuPid) {
+			return runtime.MachineStatusSuspended, fmt.Errorf("QEMU exited while restoring '%s', see %s", machine.Name, QemuOutputLogFileName)
+		}
+
+		if time.Now().After(deadline) {
+			os.Remove(qemu.IncomingFile)
+			return runtime.MachineStatusStarted, fmt.Errorf("machine '%s' still restoring after %s", machine.Name, QemuRestoreTimeout)
+		}
+		time.Sleep(QemuMigratePollInterval)
+	}
+
+	os.Remove(qemu.IncomingFile)
+
+	log.Printf("[restore] '%s' restored, guest is %s", machine.Name, result.Status)
+	if result.Status == QmpStatusPaused {
+		return runtime.MachineStatusPaused, nil
+	}
+
+	return runtime.MachineStatusStarted, nil
+}
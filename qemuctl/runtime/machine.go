@@ -5,9 +5,12 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"net"
 	"os"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 func init() {
@@ -22,13 +25,31 @@ const (
 	MachineStatusStopped     string = "stopped"
 	MachineStatusDegraded    string = "degraded"
 	MachineStatusUnknown     string = "unknown"
+	MachineStatusPaused      string = "paused"
+	MachineStatusSuspended   string = "suspended"
 	MachineConfigFileName    string = "config.yaml"
+	/* Written by suspend, read back by the next start */
+	MachineStateFileName string = "suspended.state"
 )
 
+// HostForward is a host port forwarded to the guest, as QEMU was started with
+type HostForward struct {
+	Protocol    string `json:"protocol,omitempty"`
+	HostAddress string `json:"hostAddress,omitempty"`
+	HostPort    int    `json:"hostPort"`
+	GuestPort   int    `json:"guestPort"`
+}
+
 type MachineData struct {
-	QemuPid      int    `json:"qemuProcessPID"`
-	State        string `json:"machineState"`
-	SSHLocalPort int    `json:"sshLocalPort"`
+	QemuPid      int           `json:"qemuProcessPID"`
+	State        string        `json:"machineState"`
+	SSHLocalPort int           `json:"sshLocalPort"`
+	SSHAddress   string        `json:"sshAddress,omitempty"`
+	HostForwards []HostForward `json:"hostForwards,omitempty"`
+	Supervised   bool          `json:"supervised,omitempty"`
+	Restarts     int           `json:"restarts,omitempty"`
+	ExitReason   string        `json:"exitReason,omitempty"`
+	ExitTime     time.Time     `json:"exitTime,omitempty"`
 }
 
 type Machine struct {
@@ -36,6 +57,12 @@ type Machine struct {
 	Status           string
 	QemuPid          int
 	SSHLocalPort     int
+	SSHAddress       string
+	HostForwards     []HostForward
+	Supervised       bool
+	Restarts         int
+	ExitReason       string
+	ExitTime         time.Time
 	RuntimeDirectory string
 	ConfigFile       string
 	initialized      bool
@@ -69,6 +96,12 @@ func NewMachine(machineName string) (machine *Machine) {
 		Status:           machineData.State,
 		QemuPid:          machineData.QemuPid,
 		SSHLocalPort:     machineData.SSHLocalPort,
+		SSHAddress:       machineData.SSHAddress,
+		HostForwards:     machineData.HostForwards,
+		Supervised:       machineData.Supervised,
+		Restarts:         machineData.Restarts,
+		ExitReason:       machineData.ExitReason,
+		ExitTime:         machineData.ExitTime,
 		RuntimeDirectory: runtimeDirectory,
 		ConfigFile:       configFile,
 		initialized:      true,
@@ -89,6 +122,7 @@ func NewMachine(machineName string) (machine *Machine) {
 				machine.QemuPid = 0
 				machine.Status = MachineStatusDegraded
 				machine.SSHLocalPort = 0
+				machine.HostForwards = nil
 				machine.UpdateStatus(MachineStatusDegraded)
 			}
 		} else {
@@ -97,6 +131,7 @@ func NewMachine(machineName string) (machine *Machine) {
 			machine.QemuPid = 0
 			machine.Status = MachineStatusDegraded
 			machine.SSHLocalPort = 0
+			machine.HostForwards = nil
 			machine.UpdateStatus(MachineStatusDegraded)
 		}
 	}
@@ -104,6 +139,20 @@ func NewMachine(machineName string) (machine *Machine) {
 	return machine
 }
 
+// GetSSHAddress returns the host:port ssh connects to, empty without a forward
+func (m *Machine) GetSSHAddress() string {
+	if m.SSHLocalPort <= 0 {
+		return ""
+	}
+
+	address := m.SSHAddress
+	if len(address) == 0 {
+		address = "127.0.0.1"
+	}
+
+	return net.JoinHostPort(address, strconv.Itoa(m.SSHLocalPort))
+}
+
 func (m *Machine) Exists() bool {
 	fileInfo, err := os.Stat(m.RuntimeDirectory)
 	if os.IsNotExist(err) {
@@ -121,8 +170,17 @@ func (m *Machine) Destroy() bool {
 	return err == nil
 }
 
+// IsStarted tells whether QEMU runs for the machine, even if the guest is paused
 func (m *Machine) IsStarted() bool {
-	return (strings.Compare(MachineStatusStarted, m.Status) == 0)
+	return (strings.Compare(MachineStatusStarted, m.Status) == 0) || m.IsPaused()
+}
+
+func (m *Machine) IsPaused() bool {
+	return (strings.Compare(MachineStatusPaused, m.Status) == 0)
+}
+
+func (m *Machine) IsSuspended() bool {
+	return (strings.Compare(MachineStatusSuspended, m.Status) == 0)
 }
 
 func (m *Machine) IsStopped() bool {
@@ -152,11 +210,18 @@ func (m *Machine) UpdateStatus(status string) (err error) {
 	machineData = MachineData{
 		QemuPid:      m.QemuPid,
 		SSHLocalPort: m.SSHLocalPort,
+		SSHAddress:   m.SSHAddress,
+		HostForwards: m.HostForwards,
+		Supervised:   m.Supervised,
+		Restarts:     m.Restarts,
+		ExitReason:   m.ExitReason,
+		ExitTime:     m.ExitTime,
 		State:        status,
 	}
 
 	switch status {
-	case MachineStatusDegraded, MachineStatusStarted, MachineStatusStopped, MachineStatusUnknown:
+	case MachineStatusDegraded, MachineStatusStarted, MachineStatusStopped, MachineStatusUnknown,
+		MachineStatusPaused, MachineStatusSuspended:
 		{
 			log.Printf("[UpdateStatus] updating file '%s' with [%v].\n", statusFile, machineData)
 			jsonBytes, err := json.Marshal(machineData)
@@ -205,6 +270,10 @@ func (m *Machine) UpdateConfigFile(sourcePath string) (err error) {
 	return err
 }
 
+func (m *Machine) WriteConfigFile(configBytes []byte) (err error) {
+	return os.WriteFile(m.ConfigFile, configBytes, 0644)
+}
+
 func (m *Machine) GetMachineFileData(fileName string) (data []byte, err error) {
 	var filePath string = fmt.Sprintf("%s/%s", m.RuntimeDirectory, fileName)
 
@@ -215,3 +284,40 @@ func (m *Machine) GetMachineFileData(fileName string) (data []byte, err error) {
 
 	return data, nil
 }
+
+// GetStateFile returns where suspend saves the machine state
+func (m *Machine) GetStateFile() string {
+	return fmt.Sprintf("%s/%s", m.RuntimeDirectory, MachineStateFileName)
+}
+
+// HasStateFile tells whether a suspended state is waiting to be restored
+func (m *Machine) HasStateFile() bool {
+	fileInfo, err := os.Stat(m.GetStateFile())
+	return err == nil && fileInfo.Mode().IsRegular()
+}
+
+// Rename moves the runtime directory of a stopped machine to newName
+func (m *Machine) Rename(newName string) (err error) {
+	var target *Machine = &Machine{}
+
+	if m.IsStarted() {
+		return fmt.Errorf("machine '%s' is started", m.Name)
+	}
+
+	target.RuntimeDirectory = fmt.Sprintf("%s/%s", GetMachinesBaseDir(), newName)
+	if target.Exists() {
+		return fmt.Errorf("machine '%s' exists", newName)
+	}
+
+	log.Printf("[machine] renaming '%s' to '%s'", m.Name, newName)
+	err = os.Rename(m.RuntimeDirectory, target.RuntimeDirectory)
+	if err != nil {
+		return err
+	}
+
+	m.Name = newName
+	m.RuntimeDirectory = target.RuntimeDirectory
+	m.ConfigFile = fmt.Sprintf("%s/%s", m.RuntimeDirectory, MachineConfigFileName)
+
+	return nil
+}
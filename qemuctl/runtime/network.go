@@ -0,0 +1,159 @@
+package qemuctl_runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	NetworkBaseDirectoryName string = "networks"
+	NetworkFileExtension     string = ".json"
+
+	/* Every network gets its own multicast group and port, from these on */
+	NetworkMcastGroupFormat string = "230.0.%d.%d"
+	NetworkBasePort         int    = 42000
+	NetworkMaxCount         int    = 4096
+
+	NetworkDefaultLocalAddress string = "127.0.0.1"
+)
+
+// Network is a private L2 segment: machines joining it share a multicast
+// group, which QEMU's socket backend handles without root nor host bridge.
+type Network struct {
+	Name         string `json:"name"`
+	McastGroup   string `json:"mcastGroup"`
+	Port         int    `json:"port"`
+	LocalAddress string `json:"localAddress"`
+}
+
+// GetMcastAddress returns the group as the socket backend wants it
+func (network *Network) GetMcastAddress() string {
+	return fmt.Sprintf("%s:%d", network.McastGroup, network.Port)
+}
+
+func GetNetworksDir() string {
+	return fmt.Sprintf("%s/%s", GetUserDataDir(), NetworkBaseDirectoryName)
+}
+
+func GetNetworkPath(networkName string) string {
+	return fmt.Sprintf("%s/%s%s", GetNetworksDir(), networkName, NetworkFileExtension)
+}
+
+func NetworkExists(networkName string) bool {
+	_, err := os.Stat(GetNetworkPath(networkName))
+	return err == nil
+}
+
+func ReadNetwork(networkName string) (network *Network, err error) {
+	networkBytes, err := os.ReadFile(GetNetworkPath(networkName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("network '%s' does not exist", networkName)
+	} else if err != nil {
+		return nil, err
+	}
+
+	network = &Network{}
+	err = json.Unmarshal(networkBytes, network)
+	if err != nil {
+		return nil, fmt.Errorf("network '%s': %s", networkName, err.Error())
+	}
+
+	return network, nil
+}
+
+/*
+ * CreateNetwork records a new network on the first multicast group and port
+ * no other network uses. localAddress is the interface multicast goes
+ * through; loopback keeps the segment on this host.
+ */
+func CreateNetwork(networkName string, localAddress string) (network *Network, err error) {
+	var usedPorts map[int]bool = make(map[int]bool)
+
+	if NetworkExists(networkName) {
+		return nil, fmt.Errorf("network '%s' exists", networkName)
+	}
+
+	networks, err := ListNetworks()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, other := range networks {
+		usedPorts[other.Port] = true
+	}
+
+	if len(localAddress) == 0 {
+		localAddress = NetworkDefaultLocalAddress
+	}
+
+	for index := 1; index <= NetworkMaxCount; index++ {
+		if usedPorts[NetworkBasePort+index] {
+			continue
+		}
+
+		network = &Network{
+			Name:         networkName,
+			McastGroup:   fmt.Sprintf(NetworkMcastGroupFormat, index/256, index%256),
+			Port:         NetworkBasePort + index,
+			LocalAddress: localAddress,
+		}
+		break
+	}
+
+	if network == nil {
+		return nil, fmt.Errorf("too many networks (%d)", NetworkMaxCount)
+	}
+
+	networkBytes, err := json.MarshalIndent(network, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.MkdirAll(GetNetworksDir(), 0744)
+	if err != nil {
+		return nil, err
+	}
+
+	return network, os.WriteFile(GetNetworkPath(networkName), networkBytes, 0644)
+}
+
+func RemoveNetwork(networkName string) (err error) {
+	err = os.Remove(GetNetworkPath(networkName))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("network '%s' does not exist", networkName)
+	}
+
+	return err
+}
+
+// ListNetworks returns every network under GetNetworksDir, sorted by name
+func ListNetworks() (networks []*Network, err error) {
+	var networkNames []string
+
+	dirEntries, err := os.ReadDir(GetNetworksDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() && strings.HasSuffix(dirEntry.Name(), NetworkFileExtension) {
+			networkNames = append(networkNames, strings.TrimSuffix(dirEntry.Name(), NetworkFileExtension))
+		}
+	}
+	sort.Strings(networkNames)
+
+	for _, networkName := range networkNames {
+		network, err := ReadNetwork(networkName)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
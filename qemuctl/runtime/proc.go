@@ -0,0 +1,201 @@
+package qemuctl_runtime
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	/* USER_HZ: /proc reports CPU time in these ticks on every Linux we run on */
+	ProcClockTicksPerSecond uint64 = 100
+
+	ProcTunDevicePath string = "/dev/net/tun"
+)
+
+// InterfaceCounters are the host side counters of a network interface
+type InterfaceCounters struct {
+	RxBytes   uint64 `json:"rxBytes"`
+	TxBytes   uint64 `json:"txBytes"`
+	RxPackets uint64 `json:"rxPackets"`
+	TxPackets uint64 `json:"txPackets"`
+}
+
+/* readStatFields returns the fields of a /proc stat file from field 3 (state) on */
+func readStatFields(statPath string) (fields []string, err error) {
+	statBytes, err := os.ReadFile(statPath)
+	if err != nil {
+		return nil, err
+	}
+
+	/* comm may hold spaces and parentheses: fields start after the last ')' */
+	stat := string(statBytes)
+	end := strings.LastIndex(stat, ")")
+	if end < 0 {
+		return nil, fmt.Errorf("unexpected format of '%s'", statPath)
+	}
+
+	/* starttime (field 22) is the last one we read */
+	fields = strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return nil, fmt.Errorf("unexpected format of '%s'", statPath)
+	}
+
+	return fields, nil
+}
+
+// ReadCPUTicks returns the user and system time of a process, or of one of
+// its threads when tid is not 0, in clock ticks.
+func ReadCPUTicks(pid int, tid int) (ticks uint64, err error) {
+	var statPath string = fmt.Sprintf("/proc/%d/stat", pid)
+
+	if tid > 0 {
+		statPath = fmt.Sprintf("/proc/%d/task/%d/stat", pid, tid)
+	}
+
+	fields, err := readStatFields(statPath)
+	if err != nil {
+		return 0, err
+	}
+
+	/* utime and stime are fields 14 and 15 */
+	for _, field := range fields[11:13] {
+		value, err := strconv.ParseUint(field, 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("unexpected format of '%s'", statPath)
+		}
+		ticks += value
+	}
+
+	return ticks, nil
+}
+
+// ReadStartTime returns when a process started
+func ReadStartTime(pid int) (startTime time.Time, err error) {
+	var bootTime int64 = -1
+
+	fields, err := readStatFields(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return startTime, err
+	}
+
+	/* starttime, field 22, counts clock ticks since boot */
+	startTicks, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return startTime, fmt.Errorf("unexpected format of '/proc/%d/stat'", pid)
+	}
+
+	statBytes, err := os.ReadFile("/proc/stat")
+	if err != nil {
+		return startTime, err
+	}
+
+	for _, line := range strings.Split(string(statBytes), "\n") {
+		if value := strings.TrimPrefix(line, "btime "); value != line {
+			bootTime, err = strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+			if err != nil {
+				return startTime, fmt.Errorf("unexpected btime in '/proc/stat'")
+			}
+		}
+	}
+
+	if bootTime < 0 {
+		return startTime, fmt.Errorf("no btime in '/proc/stat'")
+	}
+
+	startMilliseconds := int64(startTicks * 1000 / ProcClockTicksPerSecond)
+	return time.Unix(bootTime, 0).Add(time.Duration(startMilliseconds) * time.Millisecond), nil
+}
+
+// ReadRSS returns the resident set size of a process, in bytes
+func ReadRSS(pid int) (rss int64, err error) {
+	var statusPath string = fmt.Sprintf("/proc/%d/status", pid)
+
+	statusBytes, err := os.ReadFile(statusPath)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, line := range strings.Split(string(statusBytes), "\n") {
+		if !strings.HasPrefix(line, "VmRSS:") {
+			continue
+		}
+
+		/* "VmRSS:	  123456 kB" */
+		fields := strings.Fields(strings.TrimPrefix(line, "VmRSS:"))
+		if len(fields) == 0 {
+			break
+		}
+
+		kilobytes, err := strconv.ParseInt(fields[0], 10, 64)
+		if err != nil {
+			break
+		}
+
+		return kilobytes * 1024, nil
+	}
+
+	return 0, fmt.Errorf("no VmRSS in '%s'", statusPath)
+}
+
+/*
+ * GetTapInterfaces returns the tap interfaces a process holds open, found
+ * through its /dev/net/tun descriptors. This covers taps opened by the
+ * bridge helper, whose names are not in the configuration.
+ */
+func GetTapInterfaces(pid int) (interfaces []string, err error) {
+	var fdDirectory string = fmt.Sprintf("/proc/%d/fd", pid)
+
+	dirEntries, err := os.ReadDir(fdDirectory)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dirEntry := range dirEntries {
+		target, err := os.Readlink(filepath.Join(fdDirectory, dirEntry.Name()))
+		if err != nil || target != ProcTunDevicePath {
+			continue
+		}
+
+		fdInfo, err := os.ReadFile(fmt.Sprintf("/proc/%d/fdinfo/%s", pid, dirEntry.Name()))
+		if err != nil {
+			continue
+		}
+
+		/* tun descriptors report their interface as "iff:	tap0" */
+		for _, line := range strings.Split(string(fdInfo), "\n") {
+			if name := strings.TrimPrefix(line, "iff:"); name != line {
+				interfaces = append(interfaces, strings.TrimSpace(name))
+			}
+		}
+	}
+
+	return interfaces, nil
+}
+
+// ReadInterfaceCounters returns the counters of a host network interface
+func ReadInterfaceCounters(interfaceName string) (counters InterfaceCounters, err error) {
+	var values map[string]*uint64 = map[string]*uint64{
+		"rx_bytes":   &counters.RxBytes,
+		"tx_bytes":   &counters.TxBytes,
+		"rx_packets": &counters.RxPackets,
+		"tx_packets": &counters.TxPackets,
+	}
+
+	for name, value := range values {
+		counterBytes, err := os.ReadFile(fmt.Sprintf("/sys/class/net/%s/statistics/%s", interfaceName, name))
+		if err != nil {
+			return counters, err
+		}
+
+		*value, err = strconv.ParseUint(strings.TrimSpace(string(counterBytes)), 10, 64)
+		if err != nil {
+			return counters, err
+		}
+	}
+
+	return counters, nil
+}
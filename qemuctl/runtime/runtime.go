@@ -13,16 +13,37 @@ func init() {
 const (
 	RuntimeBaseDirName     string = ".qemuctl"
 	RuntimeQemuPIDFileName string = "qemu.pid"
+	RuntimeControlSocket   string = "qemuctl.sock"
 )
 
 func GetUserDataDir() string {
 	return fmt.Sprintf("%s/%s", os.ExpandEnv("$HOME"), RuntimeBaseDirName)
 }
 
+func GetControlSocketPath() string {
+	return fmt.Sprintf("%s/%s", GetUserDataDir(), RuntimeControlSocket)
+}
+
 func GetMachinesBaseDir() string {
 	return fmt.Sprintf("%s/%s", GetUserDataDir(), MachineBaseDirectoryName)
 }
 
+// ListMachineNames returns the names of every machine under GetMachinesBaseDir
+func ListMachineNames() (machineNames []string, err error) {
+	dirEntries, err := os.ReadDir(GetMachinesBaseDir())
+	if err != nil {
+		return nil, err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if dirEntry.IsDir() {
+			machineNames = append(machineNames, dirEntry.Name())
+		}
+	}
+
+	return machineNames, nil
+}
+
 func SetupRuntimeData() (err error) {
 	var qemuctlDir string = GetUserDataDir()
 
@@ -0,0 +1,104 @@
+package qemuctl_runtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+const (
+	MachineSnapshotsFileName string = "snapshots.json"
+)
+
+type SnapshotData struct {
+	Tag          string    `json:"tag"`
+	Date         time.Time `json:"date"`
+	MachineState string    `json:"machineState"`
+}
+
+func (m *Machine) getSnapshotsFilePath() string {
+	return fmt.Sprintf("%s/%s", m.RuntimeDirectory, MachineSnapshotsFileName)
+}
+
+func (m *Machine) GetSnapshots() (snapshots []SnapshotData, err error) {
+	var fileData []byte
+
+	fileData, err = os.ReadFile(m.getSnapshotsFilePath())
+	if os.IsNotExist(err) {
+		return []SnapshotData{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(fileData, &snapshots)
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot data for machine '%s': %s", m.Name, err.Error())
+	}
+
+	return snapshots, nil
+}
+
+func (m *Machine) GetSnapshot(tag string) *SnapshotData {
+	snapshots, err := m.GetSnapshots()
+	if err != nil {
+		return nil
+	}
+
+	for _, snapshot := range snapshots {
+		if snapshot.Tag == tag {
+			return &snapshot
+		}
+	}
+
+	return nil
+}
+
+func (m *Machine) writeSnapshots(snapshots []SnapshotData) (err error) {
+	var jsonBytes []byte
+
+	jsonBytes, err = json.Marshal(snapshots)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[snapshots] writing [%s] to '%s'", string(jsonBytes), m.getSnapshotsFilePath())
+	return os.WriteFile(m.getSnapshotsFilePath(), jsonBytes, 0644)
+}
+
+func (m *Machine) AddSnapshot(snapshot SnapshotData) (err error) {
+	var snapshots []SnapshotData
+
+	snapshots, err = m.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	/* A tag is unique; replace any previous record */
+	for index, current := range snapshots {
+		if current.Tag == snapshot.Tag {
+			snapshots = append(snapshots[:index], snapshots[index+1:]...)
+			break
+		}
+	}
+
+	return m.writeSnapshots(append(snapshots, snapshot))
+}
+
+func (m *Machine) RemoveSnapshot(tag string) (err error) {
+	var snapshots []SnapshotData
+
+	snapshots, err = m.GetSnapshots()
+	if err != nil {
+		return err
+	}
+
+	for index, current := range snapshots {
+		if current.Tag == tag {
+			return m.writeSnapshots(append(snapshots[:index], snapshots[index+1:]...))
+		}
+	}
+
+	return fmt.Errorf("snapshot '%s' does not exist", tag)
+}
@@ -0,0 +1,74 @@
+package qemuctl_runtime
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	TemplateBaseDirectoryName string = "templates"
+	TemplateFileExtension     string = ".yaml"
+)
+
+func GetTemplatesDir() string {
+	return fmt.Sprintf("%s/%s", GetUserDataDir(), TemplateBaseDirectoryName)
+}
+
+func GetTemplatePath(templateName string) string {
+	return fmt.Sprintf("%s/%s%s", GetTemplatesDir(), templateName, TemplateFileExtension)
+}
+
+func TemplateExists(templateName string) bool {
+	_, err := os.Stat(GetTemplatePath(templateName))
+	return err == nil
+}
+
+// ReadTemplate returns the YAML of templateName as it was added
+func ReadTemplate(templateName string) (templateBytes []byte, err error) {
+	templateBytes, err = os.ReadFile(GetTemplatePath(templateName))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("template '%s' does not exist", templateName)
+	}
+
+	return templateBytes, err
+}
+
+func WriteTemplate(templateName string, templateBytes []byte) (err error) {
+	err = os.MkdirAll(GetTemplatesDir(), 0744)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(GetTemplatePath(templateName), templateBytes, 0644)
+}
+
+func RemoveTemplate(templateName string) (err error) {
+	err = os.Remove(GetTemplatePath(templateName))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("template '%s' does not exist", templateName)
+	}
+
+	return err
+}
+
+// ListTemplateNames returns the names of every template under GetTemplatesDir
+func ListTemplateNames() (templateNames []string, err error) {
+	dirEntries, err := os.ReadDir(GetTemplatesDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() && strings.HasSuffix(dirEntry.Name(), TemplateFileExtension) {
+			templateNames = append(templateNames, strings.TrimSuffix(dirEntry.Name(), TemplateFileExtension))
+		}
+	}
+
+	/* "base-ubuntu.yaml" sorts before "base.yaml" */
+	sort.Strings(templateNames)
+	return templateNames, nil
+}
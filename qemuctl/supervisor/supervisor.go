@@ -0,0 +1,497 @@
+package qemuctl_supervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	helpers "luizpuglisi.com/qemuctl/helpers"
+	qemuctl_qemu "luizpuglisi.com/qemuctl/qemu"
+	runtime "luizpuglisi.com/qemuctl/runtime"
+)
+
+// Restart policies
+const (
+	RestartPolicyNever     string = "never"
+	RestartPolicyOnFailure string = "on-failure"
+	RestartPolicyAlways    string = "always"
+
+	RestartInitialBackoff time.Duration = 1 * time.Second
+	RestartMaxBackoff     time.Duration = 60 * time.Second
+	/* A machine up for this long is considered healthy again */
+	RestartResetAfter time.Duration = 60 * time.Second
+
+	MonitorConnectTimeout time.Duration = 10 * time.Second
+	MonitorConnectRetry   time.Duration = 200 * time.Millisecond
+
+	/* How often the console log of a running machine is checked against console.logMaxSize */
+	ConsoleLogCheckInterval time.Duration = 30 * time.Second
+)
+
+var ErrNotSupervised = errors.New("machine is not supervised")
+
+type child struct {
+	machineName    string
+	process        *os.Process
+	command        *exec.Cmd
+	startTime      time.Time
+	restartPolicy  string
+	backoff        time.Duration
+	stopping       bool
+	suspended      bool
+	shutdownReason string
+	monitor        *qemuctl_qemu.QmpClient
+	done           chan struct{}
+}
+
+// Supervisor launches QEMU processes as its own children, reaps them and
+// restarts them according to their restart policy.
+type Supervisor struct {
+	lock     sync.Mutex
+	children map[string]*child
+	restarts map[string]*time.Timer
+}
+
+func NewSupervisor() *Supervisor {
+	return &Supervisor{
+		children: make(map[string]*child),
+		restarts: make(map[string]*time.Timer),
+	}
+}
+
+// IsSupervising tells whether machineName is a child of this supervisor
+func (s *Supervisor) IsSupervising(machineName string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	_, found := s.children[machineName]
+	return found
+}
+
+/*
+ * StartMachine launches the machine as a supervised child. A suspended
+ * machine is restored: this waits for its state to be loaded.
+ */
+func (s *Supervisor) StartMachine(machineName string) (pid int, err error) {
+	var status string
+
+	qemu, entry, err := s.launchMachine(machineName)
+	if err != nil {
+		return 0, err
+	}
+
+	/* Without the lock: reap must be able to run if QEMU exits meanwhile */
+	status, err = qemu.FinishRestore()
+	if err != nil {
+		log.Printf("[daemon] could not restore '%s': %s", machineName, err.Error())
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if status == runtime.MachineStatusSuspended {
+		/* QEMU exited before the guest ran: the state is still good */
+		entry.stopping = true
+		entry.suspended = true
+		if _, found := s.children[machineName]; !found {
+			qemuctl_qemu.RecordSuspended(qemu.Monitor.Machine)
+		}
+		return 0, err
+	}
+
+	if status != runtime.MachineStatusStarted {
+		qemu.Monitor.Machine.UpdateStatus(status)
+	}
+
+	return entry.process.Pid, err
+}
+
+/* launchMachine starts QEMU and registers it as a child */
+func (s *Supervisor) launchMachine(machineName string) (qemu *qemuctl_qemu.QemuCommand, entry *child, err error) {
+	var machine *runtime.Machine
+	var configData *helpers.ConfigurationData
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if _, found := s.children[machineName]; found {
+		return nil, nil, fmt.Errorf("machine '%s' is already started", machineName)
+	}
+
+	/* An explicit start overrides a pending restart */
+	if timer, found := s.restarts[machineName]; found {
+		timer.Stop()
+		delete(s.restarts, machineName)
+	}
+
+	machine = runtime.NewMachine(machineName)
+	if machine == nil || !machine.Exists() {
+		return nil, nil, fmt.Errorf("machine '%s' does not exist", machineName)
+	}
+
+	if machine.IsStarted() {
+		return nil, nil, fmt.Errorf("machine '%s' is already started", machineName)
+	}
+
+	configData, err = helpers.NewConfigHandler(machine.ConfigFile).ParseConfigFile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	qemu, err = qemuctl_qemu.NewMachineCommand(configData, machine, true)
+	if err != nil {
+		return nil, nil, err
+	}
+	qemu.PrepareRestore()
+
+	err = qemu.Prepare()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	command, err := qemu.Start()
+	if err != nil {
+		if len(qemu.IncomingFile) > 0 {
+			/* The guest did not run: it can still be restored */
+			qemuctl_qemu.RecordSuspended(machine)
+			return nil, nil, err
+		}
+		machine.QemuPid = 0
+		machine.SSHLocalPort = 0
+		machine.HostForwards = nil
+		machine.UpdateStatus(runtime.MachineStatusDegraded)
+		return nil, nil, err
+	}
+
+	entry = &child{
+		machineName:   machineName,
+		process:       command.Process,
+		command:       command,
+		startTime:     time.Now(),
+		restartPolicy: configData.RestartPolicy,
+		backoff:       RestartInitialBackoff,
+		done:          make(chan struct{}),
+	}
+	s.children[machineName] = entry
+
+	machine.QemuPid = command.Process.Pid
+	machine.SSHLocalPort = int(configData.SSH.LocalPort)
+	machine.SSHAddress = helpers.GetConnectAddress(configData.SSH.HostAddress)
+	machine.HostForwards = helpers.GetHostForwards(configData)
+	machine.Supervised = true
+	machine.UpdateStatus(runtime.MachineStatusStarted)
+
+	go s.watchEvents(entry, machine)
+	go watchConsoleLog(machine, configData, entry.done)
+	go s.reap(entry)
+
+	return qemu, entry, nil
+}
+
+/* watchEvents keeps a QMP connection to the child, remembering why it shut down */
+func (s *Supervisor) watchEvents(entry *child, machine *runtime.Machine) {
+	var client *qemuctl_qemu.QmpClient
+	var err error
+	var deadline time.Time = time.Now().Add(MonitorConnectTimeout)
+
+	monitor := qemuctl_qemu.NewQemuMonitor(machine)
+	for {
+		client, err = monitor.ConnectEvents()
+		if err == nil || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(MonitorConnectRetry)
+	}
+
+	if err != nil {
+		log.Printf("[daemon] could not connect to the monitor of '%s': %s", entry.machineName, err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	entry.monitor = client
+	s.lock.Unlock()
+
+	for event := range client.Events() {
+		log.Printf("[daemon] '%s': event %s %s", entry.machineName, event.Event, string(event.Data))
+
+		if event.Event == qemuctl_qemu.QmpEventShutdown {
+			var shutdown struct {
+				Reason string `json:"reason"`
+			}
+			json.Unmarshal(event.Data, &shutdown)
+
+			s.lock.Lock()
+			entry.shutdownReason = shutdown.Reason
+			s.lock.Unlock()
+		}
+	}
+}
+
+/*
+ * watchConsoleLog rotates the console log of a running machine once it grows
+ * past console.logMaxSize, until done is closed. Machines the daemon does not
+ * supervise only have their log rotated when they start.
+ */
+func watchConsoleLog(machine *runtime.Machine, configData *helpers.ConfigurationData, done <-chan struct{}) {
+	var ticker *time.Ticker
+
+	if !configData.Console.Log {
+		return
+	}
+
+	monitor := qemuctl_qemu.NewQemuMonitor(machine)
+
+	ticker = time.NewTicker(ConsoleLogCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			err := monitor.RotateRunningConsoleLog(configData)
+			if err != nil {
+				log.Printf("[daemon] could not rotate the console log of '%s': %s", machine.Name, err.Error())
+			}
+		}
+	}
+}
+
+/* reap waits for the child to exit, records why and restarts it if asked to */
+func (s *Supervisor) reap(entry *child) {
+	var exitReason string
+	var failed bool
+
+	err := entry.command.Wait()
+	close(entry.done)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.children, entry.machineName)
+	if entry.monitor != nil {
+		entry.monitor.Close()
+	}
+
+	state := entry.command.ProcessState
+	if err != nil && state == nil {
+		exitReason = err.Error()
+		failed = true
+	} else {
+		exitReason = state.String()
+		failed = !state.Success()
+	}
+
+	if len(entry.shutdownReason) > 0 {
+		exitReason = fmt.Sprintf("%s (%s)", exitReason, entry.shutdownReason)
+		failed = failed || entry.shutdownReason == "guest-panic"
+	}
+
+	log.Printf("[daemon] machine '%s' (pid %d) %s", entry.machineName, entry.process.Pid, exitReason)
+	if entry.suspended {
+		if machine := runtime.NewMachine(entry.machineName); machine != nil {
+			qemuctl_qemu.RecordSuspended(machine)
+		}
+	} else {
+		s.recordExit(entry.machineName, exitReason, failed && !entry.stopping)
+	}
+
+	if entry.stopping {
+		return
+	}
+
+	restart := entry.restartPolicy == RestartPolicyAlways ||
+		(entry.restartPolicy == RestartPolicyOnFailure && failed)
+	if !restart {
+		return
+	}
+
+	backoff := entry.backoff
+	if time.Since(entry.startTime) > RestartResetAfter {
+		backoff = RestartInitialBackoff
+	}
+
+	log.Printf("[daemon] restarting '%s' in %s", entry.machineName, backoff)
+	s.restarts[entry.machineName] = time.AfterFunc(backoff, func() {
+		s.restartMachine(entry.machineName, backoff)
+	})
+}
+
+func (s *Supervisor) restartMachine(machineName string, backoff time.Duration) {
+	s.lock.Lock()
+	delete(s.restarts, machineName)
+	s.lock.Unlock()
+
+	_, err := s.StartMachine(machineName)
+	if err != nil {
+		log.Printf("[daemon] could not restart '%s': %s", machineName, err.Error())
+		return
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if entry, found := s.children[machineName]; found {
+		entry.backoff = backoff * 2
+		if entry.backoff > RestartMaxBackoff {
+			entry.backoff = RestartMaxBackoff
+		}
+	}
+
+	if machine := runtime.NewMachine(machineName); machine != nil {
+		machine.Restarts++
+		machine.UpdateStatus(machine.Status)
+	}
+}
+
+/* recordExit stores the exit reason and time in the machine data */
+func (s *Supervisor) recordExit(machineName string, exitReason string, failed bool) {
+	machine := runtime.NewMachine(machineName)
+	if machine == nil {
+		return
+	}
+
+	status := runtime.MachineStatusStopped
+	if failed {
+		status = runtime.MachineStatusDegraded
+	}
+
+	machine.QemuPid = 0
+	machine.SSHLocalPort = 0
+	machine.HostForwards = nil
+	machine.ExitReason = exitReason
+	machine.ExitTime = time.Now()
+	machine.UpdateStatus(status)
+}
+
+// StopMachine stops the machine, see QemuMonitor.Stop; it will not be restarted
+func (s *Supervisor) StopMachine(machineName string, timeout time.Duration, force bool) (method string, err error) {
+	s.lock.Lock()
+	if timer, found := s.restarts[machineName]; found {
+		timer.Stop()
+		delete(s.restarts, machineName)
+	}
+
+	entry, found := s.children[machineName]
+	if found {
+		entry.stopping = true
+	}
+	s.lock.Unlock()
+
+	if !found {
+		return "", ErrNotSupervised
+	}
+
+	machine := runtime.NewMachine(machineName)
+	method, err = qemuctl_qemu.NewQemuMonitor(machine).Stop(timeout, force)
+	if err != nil {
+		return "", err
+	}
+
+	/* reap records the exit: wait for it, so that callers see the new status */
+	for deadline := time.Now().Add(qemuctl_qemu.QemuStopEscalationTimeout); time.Now().Before(deadline); {
+		if !s.IsSupervising(machineName) {
+			break
+		}
+		time.Sleep(qemuctl_qemu.QemuStopPollInterval)
+	}
+
+	return method, nil
+}
+
+/*
+ * SuspendMachine saves the machine state and makes QEMU quit, see
+ * QemuMonitor.Suspend; it is then recorded as suspended, not restarted.
+ */
+func (s *Supervisor) SuspendMachine(machineName string) (err error) {
+	s.lock.Lock()
+	entry, found := s.children[machineName]
+	if found {
+		entry.stopping = true
+		entry.suspended = true
+	}
+	s.lock.Unlock()
+
+	if !found {
+		return ErrNotSupervised
+	}
+
+	machine := runtime.NewMachine(machineName)
+	err = qemuctl_qemu.NewQemuMonitor(machine).Suspend()
+	if err != nil {
+		/* The guest runs on: back to its restart policy */
+		s.lock.Lock()
+		entry.stopping = false
+		entry.suspended = false
+		s.lock.Unlock()
+		return err
+	}
+
+	/* reap records the suspension: wait for it, so that callers see the new status */
+	for deadline := time.Now().Add(qemuctl_qemu.QemuStopEscalationTimeout); time.Now().Before(deadline); {
+		if !s.IsSupervising(machineName) {
+			break
+		}
+		time.Sleep(qemuctl_qemu.QemuStopPollInterval)
+	}
+
+	return nil
+}
+
+/*
+ * AdoptMachines watches supervised machines left running by a previous
+ * daemon. They are not our children, so we only learn that they are gone
+ * when their monitor connection closes.
+ */
+func (s *Supervisor) AdoptMachines() {
+	dirEntries, err := os.ReadDir(runtime.GetMachinesBaseDir())
+	if err != nil {
+		return
+	}
+
+	for _, dirEntry := range dirEntries {
+		if !dirEntry.IsDir() {
+			continue
+		}
+
+		machine := runtime.NewMachine(dirEntry.Name())
+		if machine == nil || !machine.IsStarted() || !machine.Supervised {
+			continue
+		}
+
+		client, err := qemuctl_qemu.NewQemuMonitor(machine).ConnectEvents()
+		if err != nil {
+			log.Printf("[daemon] could not adopt '%s': %s", machine.Name, err.Error())
+			continue
+		}
+
+		log.Printf("[daemon] adopted machine '%s' (pid %d)", machine.Name, machine.QemuPid)
+
+		configData, err := helpers.NewConfigHandler(machine.ConfigFile).ParseConfigFile()
+		if err == nil {
+			go watchConsoleLog(machine, configData, client.Done())
+		}
+
+		go func(machineName string, pid int) {
+			<-client.Done()
+			client.Close()
+
+			/* Not our child: nothing to reap, just make sure it is gone */
+			if syscall.Kill(pid, 0) == nil {
+				log.Printf("[daemon] monitor of '%s' closed but pid %d is alive", machineName, pid)
+				return
+			}
+
+			s.lock.Lock()
+			s.recordExit(machineName, "exited (adopted, status unknown)", false)
+			s.lock.Unlock()
+		}(machine.Name, machine.QemuPid)
+	}
+}